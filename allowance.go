@@ -0,0 +1,129 @@
+package permitta
+
+import (
+	"cmp"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"slices"
+	"time"
+)
+
+// Allowance is what's left of the limits of an operation across every entity in the EntityPermissionOrder e.g 3 more creates this hour, 40 more this month and 2000 left of the quota, see Remaining
+type Allowance struct {
+	Operation string `json:"operation"`
+	// Decision tells if the operation is permitted at all, without considering usage, see CheckOperation. If it's denied, nothing remains in any window
+	Decision Decision `json:"decision"`
+	// Windows holds every window that at least one entity limits, in notation order : batch, quota, all, minute to year, then custom durations. Windows that no entity limits are unlimited, so they are left out
+	Windows []WindowAllowance `json:"windows"`
+}
+
+// WindowAllowance is what's left of the limits of a single window after intersecting every entity, and the entity whose limit is binding
+type WindowAllowance struct {
+	Window    string `json:"window"`    // the notation limit key e.g "batch", "quota", "all", "hour", or the key of the custom duration e.g "32s"
+	Entity    string `json:"entity"`    // the entity with the least remaining in the window, which is the binding constraint e.g constants.EntityOrg
+	Limit     uint   `json:"limit"`     // the limit of the binding entity
+	Remaining uint   `json:"remaining"` // the effective remaining of the window, the least remaining of every entity
+	// Reset is when the usage of the window of the binding entity is reset, see RateLimit.Reset , it's zero for batch, quota and all time limits, since they don't reset
+	Reset time.Time `json:"reset"`
+}
+
+// Remaining returns what's left of every limit of the operation, after intersecting the limits and usages of the entities in the EntityPermissionOrder that are charged for it, see Consume, at the time of the Clock of the request
+// For each window, the entity with the least remaining is the binding constraint. The quota is only in it for operations that increase the quota usage e.g create, since other operations aren't limited by it
+//
+//	allowance := permitta.Remaining(requestData)
+//	if hourAllowance, isLimited := allowance.Window("hour"); isLimited {
+//		fmt.Printf("You can create %d more files this hour", hourAllowance.Remaining)
+//	}
+func Remaining(requestData PermissionWithUsageRequestData) Allowance {
+	now := requestData.now()
+	allowance := Allowance{Operation: requestData.Operation}
+	allowance.Decision, _ = checkEntityLevels(requestData, now, func(entity Entity) Decision {
+		return checkEntityOperation(requestData.Operation, entity.Permission, now)
+	})
+
+	windowIndexes := make(map[string]int)
+	for _, entity := range chargedEntities(requestData, now) {
+		for _, windowAllowance := range entityAllowances(requestData.Operation, entity, now) {
+			windowIndex, isWindowFound := windowIndexes[windowAllowance.Window]
+			if isWindowFound == false {
+				windowIndexes[windowAllowance.Window] = len(allowance.Windows)
+				allowance.Windows = append(allowance.Windows, windowAllowance)
+				continue
+			}
+			// the first entity in the order is binding if entities have the same remaining
+			if windowAllowance.Remaining < allowance.Windows[windowIndex].Remaining {
+				allowance.Windows[windowIndex] = windowAllowance
+			}
+		}
+	}
+
+	// windows that only later entities limit were added last
+	slices.SortStableFunc(allowance.Windows, func(a WindowAllowance, b WindowAllowance) int {
+		return cmp.Compare(windowOrder(a.Window), windowOrder(b.Window))
+	})
+
+	if allowance.Decision.Allowed == false {
+		for i := range allowance.Windows {
+			allowance.Windows[i].Remaining = 0
+		}
+	}
+	return allowance
+}
+
+// entityAllowances returns what's left of every limit of the operation of the entity at the time now, batch, quota and all time limits first, then the duration based limits, see entityRateLimits
+func entityAllowances(operation string, entity Entity, now time.Time) []WindowAllowance {
+	operationLimits := GetOperationLimits(operation, entity.Permission)
+	operationUsage := getOperationUsage(operation, entity.Usage)
+
+	// the batch limit is never unlimited, and is the most that can be done in a single operation, whatever the usage is
+	batchLimit := operationLimits.getBatchLimit()
+	windowAllowances := []WindowAllowance{{Window: constants.NotationOperationBatchLimitKey, Entity: entity.Key(), Limit: batchLimit, Remaining: batchLimit}}
+
+	quotaLimit := entity.Permission.QuotaLimit
+	if operationQuotaEffect(operation) == constants.QuotaEffectIncrease && quotaLimit != constants.Unlimited {
+		windowAllowances = append(windowAllowances, WindowAllowance{Window: constants.AllowanceQuotaWindow, Entity: entity.Key(), Limit: quotaLimit, Remaining: remainingWithin(quotaLimit, entity.Usage.QuotaUsage)})
+	}
+
+	allTimeLimit := operationLimits.AllTimeLimit
+	if allTimeLimit != constants.Unlimited {
+		windowAllowances = append(windowAllowances, WindowAllowance{Window: constants.NotationOperationAllTimeLimitKey, Entity: entity.Key(), Limit: allTimeLimit, Remaining: remainingWithin(allTimeLimit, operationUsage.AllTime)})
+	}
+
+	for _, rateLimit := range entityRateLimits(operation, entity, now) {
+		windowAllowances = append(windowAllowances, WindowAllowance{Window: rateLimit.Window, Entity: rateLimit.Entity, Limit: rateLimit.Limit, Remaining: rateLimit.Remaining, Reset: rateLimit.Reset})
+	}
+	return windowAllowances
+}
+
+// windowOrder returns the position of the window in notation order, see Allowance.Windows , custom durations are ordered by duration after every other window
+func windowOrder(window string) time.Duration {
+	windowKeys := append([]string{constants.NotationOperationBatchLimitKey, constants.AllowanceQuotaWindow, constants.NotationOperationAllTimeLimitKey}, durationWindowKeys...)
+	if windowIndex := slices.Index(windowKeys, window); windowIndex != -1 {
+		return time.Duration(windowIndex - len(windowKeys))
+	}
+	every, _ := time.ParseDuration(window)
+	return every
+}
+
+// Window returns the allowance of the window of the notation limit key e.g "hour", it reports false if no entity limits the window
+func (allowance Allowance) Window(window string) (WindowAllowance, bool) {
+	for _, windowAllowance := range allowance.Windows {
+		if windowAllowance.Window == window {
+			return windowAllowance, true
+		}
+	}
+	return WindowAllowance{}, false
+}
+
+// Binding returns the window with the least remaining, which is the most the next operation quantity can be, it reports false if there are no windows
+func (allowance Allowance) Binding() (WindowAllowance, bool) {
+	if len(allowance.Windows) == 0 {
+		return WindowAllowance{}, false
+	}
+	binding := allowance.Windows[0]
+	for _, windowAllowance := range allowance.Windows[1:] {
+		if windowAllowance.Remaining < binding.Remaining {
+			binding = windowAllowance
+		}
+	}
+	return binding, true
+}
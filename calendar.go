@@ -0,0 +1,163 @@
+package permitta
+
+import (
+	constants "github.com/limitlessdonald/permitta/constants"
+	"slices"
+	"sync"
+	"time"
+)
+
+// calendarWindowKeys are the notation limit keys of the windows that can be aligned to the calendar
+// fortnights don't have a calendar boundary, so they are always rolling
+var calendarWindowKeys = []string{
+	constants.NotationOperationMinuteLimitKey,
+	constants.NotationOperationHourLimitKey,
+	constants.NotationOperationDayLimitKey,
+	constants.NotationOperationWeekLimitKey,
+	constants.NotationOperationMonthLimitKey,
+	constants.NotationOperationQuarterLimitKey,
+	constants.NotationOperationYearLimitKey,
+}
+
+// locations caches the locations that have been loaded, since time.LoadLocation reads from disk every time
+var locations sync.Map
+
+// isCalendarWindow reports if the window of the notation limit key e.g "month" is aligned to the calendar
+func (operationLimit OperationLimit) isCalendarWindow(limitKey string) bool {
+	return slices.Contains(operationLimit.CalendarWindows, limitKey)
+}
+
+// location returns the location calendar windows are aligned in, UTC is used if Location is empty or invalid
+func (operationLimit OperationLimit) location() *time.Location {
+	location, err := loadLocation(operationLimit.Location)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// loadLocation returns the location of the IANA time zone name e.g Europe/Paris, or UTC if the name is empty
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if location, isLocationFound := locations.Load(name); isLocationFound {
+		return location.(*time.Location), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, location)
+	return location, nil
+}
+
+// calendarWindowStart returns the start of the calendar window e.g the 1st of the month, that t is in
+// Weeks start on Monday. Monthly, quarterly and yearly windows start on the anchorDay of the month (the 1st if anchorDay is 0), or the last day of the month if the month is shorter,
+// quarters start in January, April, July and October, and years start in January
+func calendarWindowStart(limitKey string, t time.Time, location *time.Location, anchorDay uint) time.Time {
+	t = t.In(location)
+	year, month, day := t.Date()
+
+	switch limitKey {
+	case constants.NotationOperationMinuteLimitKey:
+		return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, location)
+	case constants.NotationOperationHourLimitKey:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, location)
+	case constants.NotationOperationDayLimitKey:
+		return time.Date(year, month, day, 0, 0, 0, 0, location)
+	case constants.NotationOperationWeekLimitKey:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-daysSinceMonday, 0, 0, 0, 0, location)
+	case constants.NotationOperationMonthLimitKey:
+		return anchoredWindowStart(t, year, month, 1, anchorDay, location)
+	case constants.NotationOperationQuarterLimitKey:
+		quarterStartMonth := time.Month((int(month)-1)/3*3 + 1)
+		return anchoredWindowStart(t, year, quarterStartMonth, 3, anchorDay, location)
+	case constants.NotationOperationYearLimitKey:
+		return anchoredWindowStart(t, year, time.January, 12, anchorDay, location)
+	}
+
+	return t
+}
+
+// anchoredWindowStart returns the start of the window that begins on the anchor day of startMonth, or of the window before it, which is monthsPerWindow months earlier, if t is before the anchor day
+func anchoredWindowStart(t time.Time, year int, startMonth time.Month, monthsPerWindow int, anchorDay uint, location *time.Location) time.Time {
+	windowStart := anchoredDate(year, startMonth, anchorDay, location)
+	if t.Before(windowStart) {
+		windowStart = anchoredDate(year, startMonth-time.Month(monthsPerWindow), anchorDay, location)
+	}
+	return windowStart
+}
+
+// anchoredDate returns the anchor day of the month, or the last day of the month if the month is shorter
+func anchoredDate(year int, month time.Month, anchorDay uint, location *time.Location) time.Time {
+	if anchorDay < 1 {
+		anchorDay = 1
+	}
+	daysInMonth := time.Date(year, month+1, 0, 0, 0, 0, 0, location).Day()
+	day := min(int(anchorDay), daysInMonth)
+	return time.Date(year, month, day, 0, 0, 0, 0, location)
+}
+
+// isInCurrentCalendarWindow reports if the last time is in the same calendar window as now
+func (operationLimit OperationLimit) isInCurrentCalendarWindow(limitKey string, lastTime time.Time, now time.Time) bool {
+	if lastTime.IsZero() {
+		return false
+	}
+	windowStart := calendarWindowStart(limitKey, now, operationLimit.location(), operationLimit.AnchorDay)
+	return lastTime.Before(windowStart) == false
+}
+
+// withinTheLast returns the usage field of the notation limit key e.g "hour" returns &WithinTheLastHour
+func (operationUsage *OperationUsage) withinTheLast(limitKey string) *uint {
+	switch limitKey {
+	case constants.NotationOperationMinuteLimitKey:
+		return &operationUsage.WithinTheLastMinute
+	case constants.NotationOperationHourLimitKey:
+		return &operationUsage.WithinTheLastHour
+	case constants.NotationOperationDayLimitKey:
+		return &operationUsage.WithinTheLastDay
+	case constants.NotationOperationWeekLimitKey:
+		return &operationUsage.WithinTheLastWeek
+	case constants.NotationOperationFortnightLimitKey:
+		return &operationUsage.WithinTheLastFortnight
+	case constants.NotationOperationMonthLimitKey:
+		return &operationUsage.WithinTheLastMonth
+	case constants.NotationOperationQuarterLimitKey:
+		return &operationUsage.WithinTheLastQuarter
+	case constants.NotationOperationYearLimitKey:
+		return &operationUsage.WithinTheLastYear
+	}
+	return nil
+}
+
+// sanitizeCalendarWindows sets the usage of calendar windows, the usage is reset if a calendar boundary has passed since the last time, else it's kept as it was before sanitization
+func (operationUsage *OperationUsage) sanitizeCalendarWindows(unsanitizedUsage OperationUsage, operationLimits OperationLimit, now time.Time) {
+	for _, limitKey := range operationLimits.CalendarWindows {
+		usageWithin := operationUsage.withinTheLast(limitKey)
+		if usageWithin == nil {
+			continue
+		}
+		if operationLimits.isInCurrentCalendarWindow(limitKey, unsanitizedUsage.LastTime, now) {
+			*usageWithin = *unsanitizedUsage.withinTheLast(limitKey)
+		} else {
+			*usageWithin = 0
+		}
+	}
+}
+
+// updateCalendarWindows adds the operation quantity to the usage of calendar windows, the usage is reset to the operation quantity if a calendar boundary has passed since the last time
+func (operationUsage *OperationUsage) updateCalendarWindows(previousUsage OperationUsage, operationLimits OperationLimit, operationQuantity uint, operationTime time.Time) {
+	for _, limitKey := range operationLimits.CalendarWindows {
+		usageWithin := operationUsage.withinTheLast(limitKey)
+		if usageWithin == nil {
+			continue
+		}
+		if operationLimits.isInCurrentCalendarWindow(limitKey, previousUsage.LastTime, operationTime) {
+			*usageWithin = *previousUsage.withinTheLast(limitKey) + operationQuantity
+		} else {
+			*usageWithin = operationQuantity
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package permitta
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time permissions are checked at, e.g the time start and end times, schedules and duration limits are compared with
+// Set PermissionRequestData.Clock to check permissions deterministically in tests, or as of a past time e.g in audits, see FakeClock
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock that tells the real time, it's used when PermissionRequestData.Clock is nil
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock whose time only changes when it's set or advanced, it's safe for concurrent use
+type FakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewFakeClock returns a FakeClock that is stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (fakeClock *FakeClock) Now() time.Time {
+	fakeClock.mutex.Lock()
+	defer fakeClock.mutex.Unlock()
+	return fakeClock.now
+}
+
+// Set moves the clock to now
+func (fakeClock *FakeClock) Set(now time.Time) {
+	fakeClock.mutex.Lock()
+	defer fakeClock.mutex.Unlock()
+	fakeClock.now = now
+}
+
+// Advance moves the clock forward by duration, or backward if duration is negative
+func (fakeClock *FakeClock) Advance(duration time.Duration) {
+	fakeClock.mutex.Lock()
+	defer fakeClock.mutex.Unlock()
+	fakeClock.now = fakeClock.now.Add(duration)
+}
+
+// now returns the time of the Clock of the request, or the real time if it has no Clock
+func (permissionRequestData PermissionRequestData) now() time.Time {
+	if permissionRequestData.Clock == nil {
+		return time.Now()
+	}
+	return permissionRequestData.Clock.Now()
+}
@@ -0,0 +1,152 @@
+package permitta
+
+import (
+	constants "github.com/limitlessdonald/permitta/constants"
+	"maps"
+	"slices"
+	"time"
+)
+
+// CompiledPermission is a notation parsed once, with its condition parsed too, it's immutable so it can be shared between goroutines, see Compiler
+// Checks of a CompiledPermission don't parse anything, and don't allocate, except when the condition is evaluated, or when the operation has custom duration limits, whose usages are looked up by CustomDurationLimit.Key
+type CompiledPermission struct {
+	notation   string
+	permission Permission
+	condition  *Condition // nil if the permission has no condition
+}
+
+// CompilePermission parses the notation and its condition into a CompiledPermission, without caching it, see Compiler.Compile
+func CompilePermission(notation string) (*CompiledPermission, error) {
+	permission, err := ParseNotation(notation)
+	if err != nil {
+		return nil, err
+	}
+	compiledPermission := &CompiledPermission{notation: notation, permission: permission}
+	if permission.Condition != "" {
+		compiledPermission.condition, err = ParseCondition(permission.Condition)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compiledPermission, nil
+}
+
+// Notation returns the notation the permission was compiled from
+func (compiledPermission *CompiledPermission) Notation() string {
+	return compiledPermission.notation
+}
+
+// Permission returns a copy of the compiled permission, it can be modified without changing the compiled permission
+func (compiledPermission *CompiledPermission) Permission() Permission {
+	return clonePermission(compiledPermission.permission)
+}
+
+// Check checks if the operation is permitted at the time now, without considering usage, like CheckOperation for a single permission
+// The context is what the condition of the permission is evaluated with, it can be nil if the permission has no condition
+func (compiledPermission *CompiledPermission) Check(operation string, context map[string]any, now time.Time) Decision {
+	if conditionDecision := compiledPermission.checkCondition(context); conditionDecision.Allowed == false {
+		return conditionDecision
+	}
+	return checkEntityOperation(operation, compiledPermission.permission, now)
+}
+
+// CheckWithUsage checks if the operation quantity + usage is within the limits of the permission at the time now, like CheckOperationWithUsage for a single permission
+func (compiledPermission *CompiledPermission) CheckWithUsage(operation string, operationQuantity uint, usage PermissionUsage, context map[string]any, now time.Time) Decision {
+	if conditionDecision := compiledPermission.checkCondition(context); conditionDecision.Allowed == false {
+		return conditionDecision
+	}
+	decision := checkEntityOperationWithUsage(operation, operationQuantity, Entity{Permission: compiledPermission.permission, Usage: usage}, now)
+	if decision.Allowed == true {
+		decision.Quantity = operationQuantity
+	}
+	return decision
+}
+
+// checkCondition is checkPermissionCondition with the condition that was parsed when the permission was compiled
+func (compiledPermission *CompiledPermission) checkCondition(context map[string]any) Decision {
+	if compiledPermission.condition == nil {
+		return Decision{Allowed: true}
+	}
+	isMet, err := compiledPermission.condition.Evaluate(context)
+	if err != nil {
+		return deniedDecision("", constants.ReasonConditionError)
+	}
+	if isMet == false {
+		return deniedDecision("", constants.ReasonConditionNotMet)
+	}
+	return Decision{Allowed: true}
+}
+
+// Compiler compiles notations into CompiledPermissions, and keeps the most recently used ones in a cache of a fixed capacity, so a notation that is checked often is only parsed once
+// It's safe to use from multiple goroutines. Operations should be registered before notations are compiled, since a cached notation isn't parsed again when an operation is registered, see RegisterOperation
+//
+//	compiler := permitta.NewCompiler(1000)
+//	compiledPermission, err := compiler.Compile("crud-|c=batch:5,hour:100")
+//	decision := compiledPermission.CheckWithUsage(constants.OperationCreate, 1, usage, nil, time.Now())
+type Compiler struct {
+	cache *lruCache[*CompiledPermission] // keyed by notation
+}
+
+// NewCompiler returns a Compiler that caches up to capacity compiled notations, constants.DefaultCompilerCacheSize is used if capacity is less than 1
+func NewCompiler(capacity int) *Compiler {
+	if capacity < 1 {
+		capacity = constants.DefaultCompilerCacheSize
+	}
+	return &Compiler{cache: newLRUCache[*CompiledPermission](capacity)}
+}
+
+// defaultCompiler is the Compiler used by Compile
+var defaultCompiler = NewCompiler(constants.DefaultCompilerCacheSize)
+
+// Compile compiles the notation with a Compiler shared by the package, see Compiler.Compile
+func Compile(notation string) (*CompiledPermission, error) {
+	return defaultCompiler.Compile(notation)
+}
+
+// Compile returns the CompiledPermission of the notation from the cache, or compiles and caches it, evicting the least recently used notation if the cache is full
+// Notations that can't be parsed aren't cached, so they return the error of ParseNotation or ParseCondition every time
+func (compiler *Compiler) Compile(notation string) (*CompiledPermission, error) {
+	if compiledPermission, isCached := compiler.cache.get(notation); isCached {
+		return compiledPermission, nil
+	}
+
+	// parsing is done without holding the lock, so other notations can be looked up meanwhile
+	compiledPermission, err := CompilePermission(notation)
+	if err != nil {
+		return nil, err
+	}
+	// another goroutine may have compiled the same notation meanwhile, its CompiledPermission is kept so every caller shares the same one
+	return compiler.cache.add(notation, compiledPermission), nil
+}
+
+// Len returns the number of notations in the cache
+func (compiler *Compiler) Len() int {
+	return compiler.cache.len()
+}
+
+// clonePermission returns a copy of the permission that doesn't share its schedules, registered operations or limits with it
+func clonePermission(permission Permission) Permission {
+	clonedPermission := permission
+	clonedPermission.Schedules = slices.Clone(permission.Schedules)
+	for i := range clonedPermission.Schedules {
+		clonedPermission.Schedules[i].Days = slices.Clone(clonedPermission.Schedules[i].Days)
+	}
+	clonedPermission.CreateOperationLimits = cloneOperationLimit(permission.CreateOperationLimits)
+	clonedPermission.ReadOperationLimits = cloneOperationLimit(permission.ReadOperationLimits)
+	clonedPermission.UpdateOperationLimits = cloneOperationLimit(permission.UpdateOperationLimits)
+	clonedPermission.DeleteOperationLimits = cloneOperationLimit(permission.DeleteOperationLimits)
+	clonedPermission.ExecuteOperationLimits = cloneOperationLimit(permission.ExecuteOperationLimits)
+	clonedPermission.Operations = maps.Clone(permission.Operations)
+	for name, operationPermission := range clonedPermission.Operations {
+		operationPermission.Limits = cloneOperationLimit(operationPermission.Limits)
+		clonedPermission.Operations[name] = operationPermission
+	}
+	return clonedPermission
+}
+
+// cloneOperationLimit returns a copy of the operation limit that doesn't share its custom duration limits or calendar windows with it
+func cloneOperationLimit(operationLimit OperationLimit) OperationLimit {
+	operationLimit.CustomDurationsLimit = slices.Clone(operationLimit.CustomDurationsLimit)
+	operationLimit.CalendarWindows = slices.Clone(operationLimit.CalendarWindows)
+	return operationLimit
+}
@@ -0,0 +1,561 @@
+package permitta
+
+import (
+	"errors"
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidCondition is wrapped by the errors of ParseCondition and Condition.Evaluate
+var ErrInvalidCondition = errors.New("invalid condition")
+
+// Condition is a parsed condition expression, see ParseCondition
+type Condition struct {
+	source string
+	root   conditionNode
+}
+
+// ParseCondition parses a condition expression e.g resource.owner == $uid && subject.mfa == true
+//
+// Values are numbers, 'strings' or "strings", true, false, null, lists e.g ['admin', 'owner'], and variables, which are names e.g subject.id (optionally starting with $) that are looked up in the context.
+// Dotted names are looked up as a whole key first, then through nested maps e.g subject.id is context["subject"].(map[string]any)["id"].
+// Comparisons are ==, !=, <, <=, >, >= and in, which checks if a value is in a list, or if an IP is in a CIDR range e.g request.ip in '10.0.0.0/8'.
+// Conditions are combined with && (and), || (or), ! (not) and parentheses
+func ParseCondition(expression string) (*Condition, error) {
+	tokens, err := tokenizeCondition(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := conditionParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.tokens) {
+		return nil, fmt.Errorf("%w : unexpected '%s' at offset %d", ErrInvalidCondition, parser.tokens[parser.position].text, parser.tokens[parser.position].offset)
+	}
+	return &Condition{source: expression, root: root}, nil
+}
+
+// String returns the expression the condition was parsed from
+func (condition *Condition) String() string {
+	return condition.source
+}
+
+// Evaluate evaluates the condition with the context, it returns an error if a variable is not in the context, or values can't be compared, e.g a string and a number with <
+func (condition *Condition) Evaluate(context map[string]any) (bool, error) {
+	value, err := condition.root.evaluate(context)
+	if err != nil {
+		return false, err
+	}
+	result, isBool := value.(bool)
+	if isBool == false {
+		return false, fmt.Errorf("%w : '%s' is not true or false", ErrInvalidCondition, condition.source)
+	}
+	return result, nil
+}
+
+// checkPermissionCondition checks the Condition of the permission with the context, a permission without a Condition always applies
+// A Condition that can't be parsed denies with constants.ReasonInvalidCondition, a Condition that is false denies with constants.ReasonConditionNotMet,
+// and a Condition that can't be evaluated with the context e.g because a variable is missing, denies with constants.ReasonConditionError, so it can't be told apart from a Condition that is false by leaving a variable out
+func checkPermissionCondition(permission Permission, context map[string]any) Decision {
+	if permission.Condition == "" {
+		return Decision{Allowed: true}
+	}
+
+	condition, err := parseCachedCondition(permission.Condition)
+	if err != nil {
+		return deniedDecision("", constants.ReasonInvalidCondition)
+	}
+	isMet, err := condition.Evaluate(context)
+	if err != nil {
+		return deniedDecision("", constants.ReasonConditionError)
+	}
+	if isMet == false {
+		return deniedDecision("", constants.ReasonConditionNotMet)
+	}
+	return Decision{Allowed: true}
+}
+
+// parsedCondition is the result of ParseCondition for an expression, see parseCachedCondition
+type parsedCondition struct {
+	condition *Condition
+	err       error
+}
+
+// parsedConditions caches the parsedCondition of the most recently checked condition expressions, keyed by expression, since the same few conditions are checked for every entity on every request
+// It's bounded, so conditions that come from notations of many tenants don't grow it without limit
+var parsedConditions = newLRUCache[parsedCondition](constants.ConditionCacheSize)
+
+// parseCachedCondition is ParseCondition, with the result cached in parsedConditions, a Condition isn't modified once it's parsed, so it can be shared
+func parseCachedCondition(expression string) (*Condition, error) {
+	if cached, isCached := parsedConditions.get(expression); isCached {
+		return cached.condition, cached.err
+	}
+	condition, err := ParseCondition(expression)
+	cached := parsedConditions.add(expression, parsedCondition{condition: condition, err: err})
+	return cached.condition, cached.err
+}
+
+type conditionTokenKind int
+
+const (
+	conditionTokenOperator conditionTokenKind = iota
+	conditionTokenNumber
+	conditionTokenString
+	conditionTokenName
+)
+
+type conditionToken struct {
+	kind   conditionTokenKind
+	text   string
+	offset int
+}
+
+// conditionOperators are the operators of the condition language, longest first so e.g "==" isn't read as "="
+var conditionOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func tokenizeCondition(expression string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	for i := 0; i < len(expression); {
+		character := expression[i]
+		switch {
+		case character == ' ' || character == '\t' || character == '\n' || character == '\r':
+			i++
+
+		case character == '\'' || character == '"':
+			end := strings.IndexByte(expression[i+1:], character)
+			if end == -1 {
+				return nil, fmt.Errorf("%w : unterminated string at offset %d", ErrInvalidCondition, i)
+			}
+			tokens = append(tokens, conditionToken{kind: conditionTokenString, text: expression[i+1 : i+1+end], offset: i})
+			i = i + end + 2
+
+		case character >= '0' && character <= '9' || character == '-' && i+1 < len(expression) && expression[i+1] >= '0' && expression[i+1] <= '9':
+			start := i
+			i++
+			for i < len(expression) && (expression[i] >= '0' && expression[i] <= '9' || expression[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, conditionToken{kind: conditionTokenNumber, text: expression[start:i], offset: start})
+
+		case isConditionNameCharacter(character) || character == '$':
+			start := i
+			i++
+			for i < len(expression) && (isConditionNameCharacter(expression[i]) || expression[i] == '.' || expression[i] >= '0' && expression[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, conditionToken{kind: conditionTokenName, text: expression[start:i], offset: start})
+
+		default:
+			isOperator := false
+			for _, operator := range conditionOperators {
+				if strings.HasPrefix(expression[i:], operator) {
+					tokens = append(tokens, conditionToken{kind: conditionTokenOperator, text: operator, offset: i})
+					i = i + len(operator)
+					isOperator = true
+					break
+				}
+			}
+			if isOperator == false {
+				return nil, fmt.Errorf("%w : unexpected '%c' at offset %d", ErrInvalidCondition, character, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func isConditionNameCharacter(character byte) bool {
+	return character >= 'a' && character <= 'z' || character >= 'A' && character <= 'Z' || character == '_'
+}
+
+// conditionParser is a recursive descent parser, from the lowest precedence, ||, to the highest, values
+type conditionParser struct {
+	tokens   []conditionToken
+	position int
+}
+
+func (parser *conditionParser) peek() (conditionToken, bool) {
+	if parser.position >= len(parser.tokens) {
+		return conditionToken{}, false
+	}
+	return parser.tokens[parser.position], true
+}
+
+// accept moves to the next token if the current token is the operator or keyword
+func (parser *conditionParser) accept(text string) bool {
+	token, hasToken := parser.peek()
+	if hasToken && token.text == text && token.kind != conditionTokenString {
+		parser.position++
+		return true
+	}
+	return false
+}
+
+func (parser *conditionParser) unexpected() error {
+	token, hasToken := parser.peek()
+	if hasToken == false {
+		return fmt.Errorf("%w : unexpected end of condition", ErrInvalidCondition)
+	}
+	return fmt.Errorf("%w : unexpected '%s' at offset %d", ErrInvalidCondition, token.text, token.offset)
+}
+
+func (parser *conditionParser) parseOr() (conditionNode, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("||") {
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = conditionLogical{operator: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (parser *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for parser.accept("&&") {
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = conditionLogical{operator: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (parser *conditionParser) parseNot() (conditionNode, error) {
+	if parser.accept("!") {
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return conditionNot{operand: operand}, nil
+	}
+	return parser.parseComparison()
+}
+
+func (parser *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := parser.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if parser.accept(operator) {
+			right, err := parser.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			return conditionComparison{operator: operator, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (parser *conditionParser) parseValue() (conditionNode, error) {
+	token, hasToken := parser.peek()
+	if hasToken == false {
+		return nil, parser.unexpected()
+	}
+
+	switch token.kind {
+	case conditionTokenNumber:
+		parser.position++
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w : invalid number '%s' at offset %d", ErrInvalidCondition, token.text, token.offset)
+		}
+		return conditionLiteral{value: number}, nil
+	case conditionTokenString:
+		parser.position++
+		return conditionLiteral{value: token.text}, nil
+	case conditionTokenName:
+		parser.position++
+		switch token.text {
+		case "true":
+			return conditionLiteral{value: true}, nil
+		case "false":
+			return conditionLiteral{value: false}, nil
+		case "null":
+			return conditionLiteral{value: nil}, nil
+		case "in":
+			return nil, fmt.Errorf("%w : unexpected 'in' at offset %d", ErrInvalidCondition, token.offset)
+		}
+		return conditionVariable{name: strings.TrimPrefix(token.text, "$")}, nil
+	}
+
+	if parser.accept("(") {
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.accept(")") == false {
+			return nil, parser.unexpected()
+		}
+		return node, nil
+	}
+
+	if parser.accept("[") {
+		var list conditionList
+		if parser.accept("]") {
+			return list, nil
+		}
+		for {
+			item, err := parser.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			if parser.accept("]") {
+				return list, nil
+			}
+			if parser.accept(",") == false {
+				return nil, parser.unexpected()
+			}
+		}
+	}
+
+	return nil, parser.unexpected()
+}
+
+// conditionNode is a node of a parsed condition
+type conditionNode interface {
+	evaluate(context map[string]any) (any, error)
+}
+
+type conditionLiteral struct{ value any }
+
+type conditionVariable struct{ name string }
+
+type conditionList struct{ items []conditionNode }
+
+type conditionNot struct{ operand conditionNode }
+
+type conditionLogical struct {
+	operator    string
+	left, right conditionNode
+}
+
+type conditionComparison struct {
+	operator    string
+	left, right conditionNode
+}
+
+func (literal conditionLiteral) evaluate(map[string]any) (any, error) {
+	return literal.value, nil
+}
+
+// evaluate looks up the variable in the context, the whole name is tried first, then nested maps are followed for dotted names
+func (variable conditionVariable) evaluate(context map[string]any) (any, error) {
+	if value, isFound := context[variable.name]; isFound {
+		return normalizeConditionValue(value), nil
+	}
+
+	var current any = context
+	for _, part := range strings.Split(variable.name, ".") {
+		var isFound bool
+		switch currentMap := current.(type) {
+		case map[string]any:
+			current, isFound = currentMap[part]
+		case map[string]string:
+			current, isFound = currentMap[part]
+		}
+		if isFound == false {
+			return nil, fmt.Errorf("%w : unknown variable '%s'", ErrInvalidCondition, variable.name)
+		}
+	}
+	return normalizeConditionValue(current), nil
+}
+
+func (list conditionList) evaluate(context map[string]any) (any, error) {
+	values := make([]any, 0, len(list.items))
+	for _, item := range list.items {
+		value, err := item.evaluate(context)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (not conditionNot) evaluate(context map[string]any) (any, error) {
+	value, err := evaluateConditionBool(not.operand, context)
+	if err != nil {
+		return nil, err
+	}
+	return value == false, nil
+}
+
+// evaluate short circuits, so e.g the right side of && isn't evaluated if the left side is false
+func (logical conditionLogical) evaluate(context map[string]any) (any, error) {
+	left, err := evaluateConditionBool(logical.left, context)
+	if err != nil {
+		return nil, err
+	}
+	if logical.operator == "&&" && left == false {
+		return false, nil
+	}
+	if logical.operator == "||" && left == true {
+		return true, nil
+	}
+	return evaluateConditionBool(logical.right, context)
+}
+
+func (comparison conditionComparison) evaluate(context map[string]any) (any, error) {
+	left, err := comparison.left.evaluate(context)
+	if err != nil {
+		return nil, err
+	}
+	right, err := comparison.right.evaluate(context)
+	if err != nil {
+		return nil, err
+	}
+
+	switch comparison.operator {
+	case "==":
+		return conditionValuesEqual(left, right)
+	case "!=":
+		isEqual, err := conditionValuesEqual(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return isEqual == false, nil
+	case "in":
+		return evaluateConditionIn(left, right)
+	}
+
+	leftNumber, isLeftNumber := left.(float64)
+	rightNumber, isRightNumber := right.(float64)
+	if isLeftNumber && isRightNumber {
+		return compareConditionOrder(comparison.operator, leftNumber < rightNumber, leftNumber == rightNumber), nil
+	}
+	leftString, isLeftString := left.(string)
+	rightString, isRightString := right.(string)
+	if isLeftString && isRightString {
+		return compareConditionOrder(comparison.operator, leftString < rightString, leftString == rightString), nil
+	}
+	return nil, fmt.Errorf("%w : can't compare %v %s %v", ErrInvalidCondition, left, comparison.operator, right)
+}
+
+// conditionValuesEqual checks if two values are equal, only numbers, strings, true, false and null can be compared, since comparing lists or maps with == panics
+func conditionValuesEqual(left any, right any) (bool, error) {
+	if isConditionScalar(left) == false || isConditionScalar(right) == false {
+		return false, fmt.Errorf("%w : can't compare %v with %v, only numbers, strings, true, false and null can be compared", ErrInvalidCondition, left, right)
+	}
+	return left == right, nil
+}
+
+// isConditionScalar checks if the normalized value is a number, a string, true, false or null, see normalizeConditionValue
+func isConditionScalar(value any) bool {
+	switch value.(type) {
+	case nil, float64, string, bool:
+		return true
+	}
+	return false
+}
+
+func compareConditionOrder(operator string, isLess bool, isEqual bool) bool {
+	switch operator {
+	case "<":
+		return isLess
+	case "<=":
+		return isLess || isEqual
+	case ">":
+		return isLess == false && isEqual == false
+	}
+	return isLess == false
+}
+
+// evaluateConditionIn checks if left is one of the values of the list on the right, or if left is an IP in the CIDR range on the right
+func evaluateConditionIn(left any, right any) (any, error) {
+	switch rightValue := right.(type) {
+	case []any:
+		for _, item := range rightValue {
+			isEqual, err := conditionValuesEqual(left, item)
+			if err != nil {
+				return nil, err
+			}
+			if isEqual == true {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		_, network, err := net.ParseCIDR(rightValue)
+		if err != nil {
+			return nil, fmt.Errorf("%w : '%s' is not a list or a CIDR range", ErrInvalidCondition, rightValue)
+		}
+		leftString, _ := left.(string)
+		ip := net.ParseIP(leftString)
+		if ip == nil {
+			return nil, fmt.Errorf("%w : %v is not an IP", ErrInvalidCondition, left)
+		}
+		return network.Contains(ip), nil
+	}
+	return nil, fmt.Errorf("%w : %v is not a list or a CIDR range", ErrInvalidCondition, right)
+}
+
+func evaluateConditionBool(node conditionNode, context map[string]any) (bool, error) {
+	value, err := node.evaluate(context)
+	if err != nil {
+		return false, err
+	}
+	result, isBool := value.(bool)
+	if isBool == false {
+		return false, fmt.Errorf("%w : %v is not true or false", ErrInvalidCondition, value)
+	}
+	return result, nil
+}
+
+// normalizeConditionValue converts the values of the context to the types the condition language uses, numbers are float64 and lists are []any
+func normalizeConditionValue(value any) any {
+	switch typedValue := value.(type) {
+	case int:
+		return float64(typedValue)
+	case int8:
+		return float64(typedValue)
+	case int16:
+		return float64(typedValue)
+	case int32:
+		return float64(typedValue)
+	case int64:
+		return float64(typedValue)
+	case uint:
+		return float64(typedValue)
+	case uint8:
+		return float64(typedValue)
+	case uint16:
+		return float64(typedValue)
+	case uint32:
+		return float64(typedValue)
+	case uint64:
+		return float64(typedValue)
+	case float32:
+		return float64(typedValue)
+	case []string:
+		values := make([]any, 0, len(typedValue))
+		for _, item := range typedValue {
+			values = append(values, item)
+		}
+		return values
+	case []any:
+		values := make([]any, 0, len(typedValue))
+		for _, item := range typedValue {
+			values = append(values, normalizeConditionValue(item))
+		}
+		return values
+	case net.IP:
+		return typedValue.String()
+	}
+	return value
+}
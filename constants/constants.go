@@ -23,13 +23,42 @@ const (
 	ListOfAcceptedDurations            = ListOfAcceptedDurationsSeconds + ListOfAcceptedDurationsMinutes + ListOfAcceptedDurationsHours + ListOfAcceptedDurationsDays + ListOfAcceptedDurationsWeek + ListOfAcceptedDurationsMonth + ListOfAcceptedDurationsYear
 )
 
+// EntityKeySeparator separates the entity type and ID in an entity key e.g role:auditor
+const EntityKeySeparator = ":"
+
+// Combining rules decide how the decisions of the entities of the same type are combined, see PermissionRequestData.CombiningRules
+const (
+	CombiningRuleAllOf           = "all-of"           // every entity of the type must permit the operation, and all of them are charged
+	CombiningRuleAnyOf           = "any-of"           // at least one entity of the type must permit the operation, the first one that does is charged
+	CombiningRuleFirstApplicable = "first-applicable" // the first entity of the type that grants the operation decides, and is charged
+)
+
+// Combining algorithms decide how the decisions of the entity types in the EntityPermissionOrder are combined, see PermissionRequestData.CombiningAlgorithm
+const (
+	CombiningAlgorithmStrictHierarchy = "strict-hierarchy" // every entity type in the order must permit the operation, an explicit deny is just a denial
+	CombiningAlgorithmDenyOverrides   = "deny-overrides"   // an explicit deny of any entity denies the operation, entity types that don't grant it are skipped, at least one must grant it
+	CombiningAlgorithmPermitOverrides = "permit-overrides" // the operation is permitted if any entity type permits it, even if others deny it
+)
+
+// Quota effects of an operation, see OperationDefinition.QuotaEffect
+const (
+	QuotaEffectNone     = 0  // the operation doesn't change the quota usage e.g read
+	QuotaEffectIncrease = 1  // the operation increases the quota usage by the operation quantity e.g create
+	QuotaEffectDecrease = -1 // the operation reduces the quota usage by the operation quantity e.g delete
+)
+
 const (
 	NotationSectionSeparator                = "|"
+	NotationPolicySeparator                 = ";" // separates the resources of a policy notation e.g files{crude};videos{-r---}
+	NotationResourceStart                   = "{"
+	NotationResourceEnd                     = "}"
 	NotationOperationLimitsSeparator        = ","
 	NotationOperationLimitAndValueSeparator = ":"
 	NotationCustomLimitValuePrefix          = "["
 	NotationCustomLimitValueSuffix          = "]"
 	NotationCustomLimitValueListSeparator   = "&"
+	NotationScheduleSeparator               = "&" // separates the schedules of a schedule= section e.g days=mon-fri;hours=08:00-18:00&days=sat;hours=10:00-14:00
+	NotationSchedulePartSeparator           = ";" // separates the days=, hours= and tz= parts of a schedule
 
 	NotationOperationBatchLimitKey     = "batch"
 	NotationOperationAllTimeLimitKey   = "all"
@@ -42,6 +71,77 @@ const (
 	NotationOperationQuarterLimitKey   = "quarter"
 	NotationOperationYearLimitKey      = "year"
 	NotationOperationCustomLimitKey    = "custom"
+	NotationOperationTimeZoneKey       = "tz"
+	NotationOperationAnchorDayKey      = "anchor"
+	NotationCalendarAlignedSuffix      = "@cal" // e.g month@cal:1000 means 1000 per calendar month
+)
+
+// SlidingWindowBucketCount is the number of buckets each sliding window is divided into
+const SlidingWindowBucketCount = 60
+
+// DefaultUsageStoreMaxRetries is the number of times the engine retries when the usage was changed by someone else since it was loaded
+const DefaultUsageStoreMaxRetries = 10
+
+// SQL usage store, see NewSQLUsageStore
+const (
+	DefaultSQLUsageTableName   = "permitta_usages"
+	SQLPlaceholderQuestionMark = "?" // placeholder used by e.g MySQL and SQLite drivers
+	SQLPlaceholderDollar       = "$" // numbered placeholder used by e.g PostgreSQL drivers, $1, $2...
+)
+
+// DefaultQuantityHeader is the header HTTPMiddleware takes the operation quantity from when its QuantityHeader is empty
+const DefaultQuantityHeader = "X-Operation-Quantity"
+
+// AllowanceQuotaWindow is the WindowAllowance.Window of the quota limit, quota has no limit key in notation since it's its own section e.g q=5000
+const AllowanceQuotaWindow = "quota"
+
+// DefaultCompilerCacheSize is the number of compiled notations kept by the Compiler used by Compile, and by a Compiler created with a capacity less than 1
+const DefaultCompilerCacheSize = 1024
+
+// ConditionCacheSize is the number of parsed condition expressions kept when the conditions of permissions are checked
+const ConditionCacheSize = 1024
+
+// FileUsageStoreCompactionThreshold is the least number of lines the file of a FileUsageStore has before it's compacted
+const FileUsageStoreCompactionThreshold = 1000
+
+// Headers set by RateLimit.Headers, from the IETF RateLimit header fields draft
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// Reasons used in a Decision to describe why an operation was denied
+const (
+	ReasonInvalidOperation             = "invalid_operation"
+	ReasonInvalidEntityPermissionOrder = "invalid_entity_permission_order"
+	ReasonInvalidCombiningAlgorithm    = "invalid_combining_algorithm"
+	ReasonInvalidCombiningRule         = "invalid_combining_rule"
+	ReasonInvalidEntity                = "invalid_entity"
+	ReasonInvalidLimit                 = "invalid_limit"
+	ReasonInvalidUsage                 = "invalid_usage"
+	ReasonExplicitlyDenied             = "explicitly_denied"
+	ReasonInvalidCondition             = "invalid_condition"
+	ReasonConditionNotMet              = "condition_not_met"
+	ReasonConditionError               = "condition_error"
+	ReasonOperationNotGranted          = "operation_not_granted"
+	ReasonNotStarted                   = "not_started"
+	ReasonExpired                      = "expired"
+	ReasonOutsideSchedule              = "outside_schedule"
+	ReasonInvalidSchedule              = "invalid_schedule"
+	ReasonBatchLimitExceeded           = "batch_limit_exceeded"
+	ReasonQuotaLimitExceeded           = "quota_limit_exceeded"
+	ReasonAllTimeLimitExceeded         = "all_time_limit_exceeded"
+	ReasonMinuteLimitExceeded          = "minute_limit_exceeded"
+	ReasonHourLimitExceeded            = "hour_limit_exceeded"
+	ReasonDayLimitExceeded             = "day_limit_exceeded"
+	ReasonWeekLimitExceeded            = "week_limit_exceeded"
+	ReasonFortnightLimitExceeded       = "fortnight_limit_exceeded"
+	ReasonMonthLimitExceeded           = "month_limit_exceeded"
+	ReasonQuarterLimitExceeded         = "quarter_limit_exceeded"
+	ReasonYearLimitExceeded            = "year_limit_exceeded"
+	ReasonCustomDurationLimitExceeded  = "custom_duration_limit_exceeded"
 )
 
 const (
@@ -0,0 +1,183 @@
+package permitta
+
+import (
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CustomDurationLimit is a limit for a custom duration/window, e.g "67 operations every 32 seconds" is CustomDurationLimit{Every: 32 * time.Second, Max: 67}
+// In notation, it's written as per_<count>_<unit>_<max> e.g per_32_seconds_67 , where unit is any of the units in constants.ListOfAcceptedDurations
+// Just like other limits, a Max of 0 means unlimited
+type CustomDurationLimit struct {
+	Every time.Duration
+	Max   uint
+}
+
+// CustomDurationUsages holds the usage within the last custom duration, keyed by CustomDurationLimit.Key() of the custom duration
+type CustomDurationUsages map[string]uint
+
+// customDurationUnits are the units used when converting a duration back to text, largest first
+var customDurationUnits = []struct {
+	singular string
+	plural   string
+	duration time.Duration
+}{
+	{"year", "years", constants.TimeDurationYear},
+	{"month", "months", constants.TimeDurationMonth},
+	{"week", "weeks", constants.TimeDurationWeek},
+	{"day", "days", constants.TimeDurationDay},
+	{"hour", "hours", time.Hour},
+	{"minute", "minutes", time.Minute},
+	{"second", "seconds", time.Second},
+}
+
+// Key returns the key of the custom duration, which is used in CustomDurationUsages
+func (customDurationLimit CustomDurationLimit) Key() string {
+	return customDurationLimit.Every.String()
+}
+
+// String returns the custom duration limit in notation form e.g per_32_seconds_67
+func (customDurationLimit CustomDurationLimit) String() string {
+	text, err := customDurationLimit.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
+
+// MarshalText converts the custom duration limit to its notation form e.g per_32_seconds_67 , using the largest unit the duration can be written in
+// This also means custom duration limits are stored as strings when converted to json
+func (customDurationLimit CustomDurationLimit) MarshalText() ([]byte, error) {
+	every := customDurationLimit.Every
+	if every < time.Second || every%time.Second != 0 {
+		return nil, fmt.Errorf("custom duration must be a whole number of seconds, got %s", every)
+	}
+
+	for _, unit := range customDurationUnits {
+		if every%unit.duration != 0 {
+			continue
+		}
+		count := every / unit.duration
+		unitName := unit.plural
+		if count == 1 {
+			unitName = unit.singular
+		}
+		return []byte(fmt.Sprintf("per_%d_%s_%d", count, unitName, customDurationLimit.Max)), nil
+	}
+
+	return nil, fmt.Errorf("invalid custom duration %s", every)
+}
+
+// UnmarshalText parses a custom duration limit in notation form e.g per_32_seconds_67
+func (customDurationLimit *CustomDurationLimit) UnmarshalText(text []byte) error {
+	parsedCustomDurationLimit, err := parseCustomDurationLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*customDurationLimit = parsedCustomDurationLimit
+	return nil
+}
+
+// parseCustomDurationLimit parses a custom duration limit in notation form e.g per_32_seconds_67
+func parseCustomDurationLimit(customDurationLimitString string) (CustomDurationLimit, error) {
+	splitCustomDurationLimit := strings.Split(customDurationLimitString, "_")
+	if len(splitCustomDurationLimit) != 4 || splitCustomDurationLimit[0] != "per" {
+		return CustomDurationLimit{}, fmt.Errorf("custom duration limit must be written as per_<count>_<unit>_<max>, got '%s'", customDurationLimitString)
+	}
+
+	count, countErr := strconv.ParseUint(splitCustomDurationLimit[1], 10, 32)
+	if countErr != nil || count < 1 {
+		return CustomDurationLimit{}, fmt.Errorf("count of custom duration limit '%s' must be at least 1", customDurationLimitString)
+	}
+
+	unitDuration, isUnitValid := durationUnit(splitCustomDurationLimit[2])
+	if isUnitValid == false {
+		return CustomDurationLimit{}, fmt.Errorf("unknown unit '%s' in custom duration limit '%s', valid units are %s", splitCustomDurationLimit[2], customDurationLimitString, strings.Trim(constants.ListOfAcceptedDurations, "|"))
+	}
+
+	maxValue, maxValueErr := stringToPositiveIntegerOrZero(splitCustomDurationLimit[3])
+	if maxValueErr != nil {
+		return CustomDurationLimit{}, fmt.Errorf("limit of custom duration limit '%s' must be a whole number", customDurationLimitString)
+	}
+
+	return CustomDurationLimit{Every: time.Duration(count) * unitDuration, Max: maxValue}, nil
+}
+
+// durationUnit returns the duration of a unit in constants.ListOfAcceptedDurations e.g "mins" is time.Minute
+// Units are case-sensitive because "m" is minute and "M" is month
+func durationUnit(unit string) (time.Duration, bool) {
+	unitLists := []struct {
+		list     string
+		duration time.Duration
+	}{
+		{constants.ListOfAcceptedDurationsSeconds, time.Second},
+		{constants.ListOfAcceptedDurationsMinutes, time.Minute},
+		{constants.ListOfAcceptedDurationsHours, time.Hour},
+		{constants.ListOfAcceptedDurationsDays, constants.TimeDurationDay},
+		{constants.ListOfAcceptedDurationsWeek, constants.TimeDurationWeek},
+		{constants.ListOfAcceptedDurationsMonth, constants.TimeDurationMonth},
+		{constants.ListOfAcceptedDurationsYear, constants.TimeDurationYear},
+	}
+
+	for _, unitList := range unitLists {
+		for _, acceptedUnit := range strings.Split(strings.Trim(unitList.list, "|"), "|") {
+			if unit == acceptedUnit {
+				return unitList.duration, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// sanitizeCustomDurationUsages resets the usage of every custom duration that has passed since lastTime, see OperationUsage.sanitizeDurationUsage
+// If any usage is reset, it returns a copy, so the usage of the caller isn't modified, else it returns the same usages, since checks sanitize usage on every request and shouldn't allocate for it
+func sanitizeCustomDurationUsages(customDurationUsages CustomDurationUsages, durationDiff time.Duration) CustomDurationUsages {
+	sanitizedUsages := customDurationUsages
+	isCopied := false
+	for key, usage := range customDurationUsages {
+		every, err := time.ParseDuration(key)
+		if usage == 0 || err == nil && durationDiff <= every {
+			continue
+		}
+		if isCopied == false {
+			sanitizedUsages = maps.Clone(customDurationUsages)
+			isCopied = true
+		}
+		sanitizedUsages[key] = 0
+	}
+	return sanitizedUsages
+}
+
+// updateCustomDurationUsages adds the operation quantity to the usage of every custom duration that is tracked, either because it's in the usage already or it's in the limits
+// if the custom duration has passed since the last time, the usage is reset to the operation quantity
+func updateCustomDurationUsages(customDurationUsages CustomDurationUsages, customDurationLimits []CustomDurationLimit, operationQuantity uint, durationFromLastTime time.Duration) CustomDurationUsages {
+	if customDurationUsages == nil && len(customDurationLimits) == 0 {
+		return nil
+	}
+
+	updatedUsages := make(CustomDurationUsages)
+	everyByKey := make(map[string]time.Duration)
+	for key := range customDurationUsages {
+		if every, err := time.ParseDuration(key); err == nil {
+			everyByKey[key] = every
+		}
+	}
+	for _, customDurationLimit := range customDurationLimits {
+		everyByKey[customDurationLimit.Key()] = customDurationLimit.Every
+	}
+
+	for key, every := range everyByKey {
+		if durationFromLastTime <= every {
+			updatedUsages[key] = customDurationUsages[key] + operationQuantity
+		} else {
+			updatedUsages[key] = operationQuantity
+		}
+	}
+
+	return updatedUsages
+}
@@ -0,0 +1,374 @@
+package permitta
+
+import (
+	"cmp"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"slices"
+	"strings"
+	"time"
+)
+
+// scheduleWeek is the length of the week schedules repeat over
+const scheduleWeek = 7 * constants.TimeDurationDay
+
+// EffectivePermission folds the permissions of every entity in the EntityPermissionOrder into the one Permission that decides what the subject can actually do, e.g for an admin page, or to cache it instead of checking every entity on every request
+//   - an operation is granted if every entity grants it, and denied if any entity denies it
+//   - every limit and the quota is the lowest limit of the entities that aren't unlimited, the batch limit of entities that don't set it is 1
+//   - the start time is the latest start time, the end time is the earliest end time, and the schedules are the times every entity's schedules are open
+//   - the conditions of the entities are joined with &&
+//
+// The entities are folded the way the strict-hierarchy combining algorithm and the all-of combining rule combine them, so with other algorithms or rules the effective permission can be stricter than what CheckOperation permits
+// Calendar windows of a limit follow the entity whose limit is the lowest, they are aligned in the time zone and anchor day of the first entity that has calendar windows for the operation
+// Schedules in different time zones are compared in UTC, with the offsets of their time zones at the time of the Clock of the request. If the entities are never in effect at the same time, nothing is granted
+// The UTC schedules are only valid until the offset of one of those time zones changes e.g at the next daylight saving time change, after that they are off by the change, so an effective permission with schedules in different time zones must not be cached past it, compute it again instead
+// An entity type in the order that isn't registered makes CheckOperation deny every operation with constants.ReasonInvalidEntity, so the effective permission grants nothing either
+// The effective permission can be written as a notation with PermissionToNotation, see EffectiveNotation
+func EffectivePermission(permissionRequestData PermissionRequestData) Permission {
+	requestData := PermissionWithUsageRequestData{PermissionRequestData: permissionRequestData}
+	var effectivePermission Permission
+	var entitySchedules [][]Schedule
+	var conditions []string
+	isFirstEntity := true
+	hasInvalidEntity := false
+
+	for _, currentEntityType := range getEntityPermissionOrder(permissionRequestData) {
+		if isEntityValid(currentEntityType) == false {
+			hasInvalidEntity = true
+			continue
+		}
+		for _, entity := range entityLevel(currentEntityType, requestData) {
+			permission := entity.Permission
+			if len(permission.Schedules) > 0 {
+				entitySchedules = append(entitySchedules, permission.Schedules)
+			}
+			if permission.Condition != "" && slices.Contains(conditions, permission.Condition) == false {
+				conditions = append(conditions, permission.Condition)
+			}
+			if isFirstEntity {
+				effectivePermission = permission
+				effectivePermission.Operations = nil
+				effectivePermission.CreateOperationLimits = copyOperationLimits(permission.CreateOperationLimits)
+				effectivePermission.ReadOperationLimits = copyOperationLimits(permission.ReadOperationLimits)
+				effectivePermission.UpdateOperationLimits = copyOperationLimits(permission.UpdateOperationLimits)
+				effectivePermission.DeleteOperationLimits = copyOperationLimits(permission.DeleteOperationLimits)
+				effectivePermission.ExecuteOperationLimits = copyOperationLimits(permission.ExecuteOperationLimits)
+				for operation, operationPermission := range permission.Operations {
+					operationPermission.Limits = copyOperationLimits(operationPermission.Limits)
+					setEffectiveOperationPermission(&effectivePermission, operation, operationPermission)
+				}
+				isFirstEntity = false
+				continue
+			}
+			effectivePermission = foldPermissions(effectivePermission, permission)
+		}
+	}
+
+	switch len(conditions) {
+	case 0:
+		effectivePermission.Condition = ""
+	case 1:
+		effectivePermission.Condition = conditions[0]
+	default:
+		effectivePermission.Condition = "(" + strings.Join(conditions, ") && (") + ")"
+	}
+
+	effectivePermission.Schedules = nil
+	if len(entitySchedules) == 1 {
+		effectivePermission.Schedules = slices.Clone(entitySchedules[0])
+	}
+	if len(entitySchedules) > 1 {
+		effectivePermission.Schedules = intersectSchedules(entitySchedules, permissionRequestData.now())
+		// the entities are never in effect at the same time
+		if len(effectivePermission.Schedules) == 0 {
+			effectivePermission = withoutGrants(effectivePermission)
+		}
+	}
+	if hasInvalidEntity {
+		effectivePermission = withoutGrants(effectivePermission)
+	}
+
+	return effectivePermission
+}
+
+// EffectiveNotation returns the notation of the EffectivePermission e.g "cr---|q=500|c=batch:2,hour:5"
+func EffectiveNotation(permissionRequestData PermissionRequestData) string {
+	return PermissionToNotation(EffectivePermission(permissionRequestData))
+}
+
+// foldPermissions folds the permission of the next entity into the effective permission, except for schedules and conditions which are folded by EffectivePermission
+func foldPermissions(effectivePermission Permission, permission Permission) Permission {
+	effectivePermission.Create = effectivePermission.Create && permission.Create
+	effectivePermission.Read = effectivePermission.Read && permission.Read
+	effectivePermission.Update = effectivePermission.Update && permission.Update
+	effectivePermission.Delete = effectivePermission.Delete && permission.Delete
+	effectivePermission.Execute = effectivePermission.Execute && permission.Execute
+	effectivePermission.DenyCreate = effectivePermission.DenyCreate || permission.DenyCreate
+	effectivePermission.DenyRead = effectivePermission.DenyRead || permission.DenyRead
+	effectivePermission.DenyUpdate = effectivePermission.DenyUpdate || permission.DenyUpdate
+	effectivePermission.DenyDelete = effectivePermission.DenyDelete || permission.DenyDelete
+	effectivePermission.DenyExecute = effectivePermission.DenyExecute || permission.DenyExecute
+
+	effectivePermission.QuotaLimit = lowestLimit(effectivePermission.QuotaLimit, permission.QuotaLimit)
+	if permission.StartTime.After(effectivePermission.StartTime) {
+		effectivePermission.StartTime = permission.StartTime
+	}
+	if permission.EndTime.IsZero() == false && (effectivePermission.EndTime.IsZero() || permission.EndTime.Before(effectivePermission.EndTime)) {
+		effectivePermission.EndTime = permission.EndTime
+	}
+
+	effectivePermission.CreateOperationLimits = foldOperationLimits(effectivePermission.CreateOperationLimits, permission.CreateOperationLimits)
+	effectivePermission.ReadOperationLimits = foldOperationLimits(effectivePermission.ReadOperationLimits, permission.ReadOperationLimits)
+	effectivePermission.UpdateOperationLimits = foldOperationLimits(effectivePermission.UpdateOperationLimits, permission.UpdateOperationLimits)
+	effectivePermission.DeleteOperationLimits = foldOperationLimits(effectivePermission.DeleteOperationLimits, permission.DeleteOperationLimits)
+	effectivePermission.ExecuteOperationLimits = foldOperationLimits(effectivePermission.ExecuteOperationLimits, permission.ExecuteOperationLimits)
+
+	// registered operations that an entity doesn't have aren't granted by it
+	for operation := range effectivePermission.Operations {
+		if _, hasOperation := permission.Operations[operation]; hasOperation == false {
+			operationPermission := effectivePermission.Operations[operation]
+			operationPermission.Granted = false
+			effectivePermission.Operations[operation] = operationPermission
+		}
+	}
+	for operation, operationPermission := range permission.Operations {
+		effectiveOperationPermission, hasOperation := effectivePermission.Operations[operation]
+		if hasOperation == false {
+			// none of the previous entities granted it
+			operationPermission.Granted = false
+			operationPermission.Limits = copyOperationLimits(operationPermission.Limits)
+			setEffectiveOperationPermission(&effectivePermission, operation, operationPermission)
+			continue
+		}
+		effectiveOperationPermission.Granted = effectiveOperationPermission.Granted && operationPermission.Granted
+		effectiveOperationPermission.Denied = effectiveOperationPermission.Denied || operationPermission.Denied
+		effectiveOperationPermission.Limits = foldOperationLimits(effectiveOperationPermission.Limits, operationPermission.Limits)
+		effectivePermission.Operations[operation] = effectiveOperationPermission
+	}
+
+	return effectivePermission
+}
+
+// setEffectiveOperationPermission sets the permission of a registered operation, Operations is created the first time, it's never shared with the permissions of the entities
+func setEffectiveOperationPermission(effectivePermission *Permission, operation string, operationPermission OperationPermission) {
+	if effectivePermission.Operations == nil {
+		effectivePermission.Operations = make(map[string]OperationPermission)
+	}
+	effectivePermission.Operations[operation] = operationPermission
+}
+
+// copyOperationLimits returns a copy of the operation limits of the first entity, with its batch limit set, so the limits of the entity are never shared with the effective permission
+func copyOperationLimits(operationLimits OperationLimit) OperationLimit {
+	copiedLimits := operationLimits
+	copiedLimits.BatchLimit = operationLimits.getBatchLimit()
+	copiedLimits.CustomDurationsLimit = slices.Clone(operationLimits.CustomDurationsLimit)
+	copiedLimits.CalendarWindows = slices.Clone(operationLimits.CalendarWindows)
+	return copiedLimits
+}
+
+// foldOperationLimits returns the lowest of every limit of the two operation limits, the batch limit of limits that don't set it is 1, see OperationLimit.getBatchLimit
+func foldOperationLimits(effectiveLimits OperationLimit, operationLimits OperationLimit) OperationLimit {
+	foldedLimits := OperationLimit{
+		BatchLimit:   min(effectiveLimits.getBatchLimit(), operationLimits.getBatchLimit()),
+		AllTimeLimit: lowestLimit(effectiveLimits.AllTimeLimit, operationLimits.AllTimeLimit),
+		Location:     effectiveLimits.Location,
+		AnchorDay:    effectiveLimits.AnchorDay,
+	}
+	if len(effectiveLimits.CalendarWindows) == 0 {
+		foldedLimits.Location = operationLimits.Location
+		foldedLimits.AnchorDay = operationLimits.AnchorDay
+	}
+
+	for _, limitKey := range durationWindowKeys {
+		effectiveLimit := effectiveLimits.notationLimit(limitKey)
+		limit := operationLimits.notationLimit(limitKey)
+		foldedLimits.setNotationLimit(limitKey, lowestLimit(effectiveLimit, limit))
+		// the calendar window follows the limit that is kept
+		isCalendarWindow := effectiveLimits.isCalendarWindow(limitKey)
+		if limit != constants.Unlimited && (effectiveLimit == constants.Unlimited || limit < effectiveLimit) {
+			isCalendarWindow = operationLimits.isCalendarWindow(limitKey)
+		}
+		if isCalendarWindow && foldedLimits.notationLimit(limitKey) != constants.Unlimited {
+			foldedLimits.CalendarWindows = append(foldedLimits.CalendarWindows, limitKey)
+		}
+	}
+
+	if len(foldedLimits.CalendarWindows) == 0 {
+		foldedLimits.Location = ""
+		foldedLimits.AnchorDay = 0
+	}
+
+	foldedLimits.CustomDurationsLimit = slices.Clone(effectiveLimits.CustomDurationsLimit)
+	for _, customDurationLimit := range operationLimits.CustomDurationsLimit {
+		if customDurationLimit.Max == constants.Unlimited {
+			continue
+		}
+		customDurationIndex := slices.IndexFunc(foldedLimits.CustomDurationsLimit, func(effectiveCustomDurationLimit CustomDurationLimit) bool {
+			return effectiveCustomDurationLimit.Every == customDurationLimit.Every
+		})
+		if customDurationIndex == -1 {
+			foldedLimits.CustomDurationsLimit = append(foldedLimits.CustomDurationsLimit, customDurationLimit)
+			continue
+		}
+		foldedLimits.CustomDurationsLimit[customDurationIndex].Max = lowestLimit(foldedLimits.CustomDurationsLimit[customDurationIndex].Max, customDurationLimit.Max)
+	}
+	slices.SortStableFunc(foldedLimits.CustomDurationsLimit, func(a CustomDurationLimit, b CustomDurationLimit) int {
+		return cmp.Compare(a.Every, b.Every)
+	})
+	if len(foldedLimits.CustomDurationsLimit) == 0 {
+		foldedLimits.CustomDurationsLimit = nil
+	}
+
+	return foldedLimits
+}
+
+// lowestLimit returns the lowest of the two limits, a limit that is unlimited is higher than any other
+func lowestLimit(a uint, b uint) uint {
+	if a == constants.Unlimited {
+		return b
+	}
+	if b == constants.Unlimited {
+		return a
+	}
+	return min(a, b)
+}
+
+// withoutGrants returns the permission with none of its operations granted
+func withoutGrants(permission Permission) Permission {
+	permission.Create = false
+	permission.Read = false
+	permission.Update = false
+	permission.Delete = false
+	permission.Execute = false
+	for operation, operationPermission := range permission.Operations {
+		operationPermission.Granted = false
+		permission.Operations[operation] = operationPermission
+	}
+	return permission
+}
+
+// weekInterval is a window of time within a week, as durations since Sunday 00:00, end is after start and at most a week
+type weekInterval struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// intersectSchedules returns the schedules that are open when one of the schedules of every entity is open
+// If every schedule is in the same time zone, the schedules are intersected in it, else they are intersected in UTC, with the offsets of their time zones at the time now
+func intersectSchedules(entitySchedules [][]Schedule, now time.Time) []Schedule {
+	location := entitySchedules[0][0].Location
+	isSameLocation := true
+	for _, schedules := range entitySchedules {
+		for _, schedule := range schedules {
+			isSameLocation = isSameLocation && schedule.Location == location
+		}
+	}
+	if isSameLocation == false {
+		location = ""
+	}
+
+	intervals := scheduleWeekIntervals(entitySchedules[0], isSameLocation, now)
+	for _, schedules := range entitySchedules[1:] {
+		intervals = intersectWeekIntervals(intervals, scheduleWeekIntervals(schedules, isSameLocation, now))
+	}
+	return weekIntervalsToSchedules(intervals, location)
+}
+
+// scheduleWeekIntervals returns the windows of the schedules within a week, sorted and merged, in the time zone of the schedules if isSameLocation is true, else in UTC
+// The UTC windows use the offset of each time zone at the time now, so they are only valid until that offset changes
+func scheduleWeekIntervals(schedules []Schedule, isSameLocation bool, now time.Time) []weekInterval {
+	var intervals []weekInterval
+	for _, schedule := range schedules {
+		var offset time.Duration
+		if isSameLocation == false {
+			location, err := loadLocation(schedule.Location)
+			if err != nil {
+				continue
+			}
+			_, offsetSeconds := now.In(location).Zone()
+			offset = time.Duration(offsetSeconds) * time.Second
+		}
+
+		length := schedule.Until - schedule.From
+		if schedule.Until <= schedule.From {
+			length = length + constants.TimeDurationDay
+		}
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if schedule.opensOn(day) == false {
+				continue
+			}
+			start := (time.Duration(day)*constants.TimeDurationDay + schedule.From - offset + scheduleWeek) % scheduleWeek
+			end := start + length
+			if end <= scheduleWeek {
+				intervals = append(intervals, weekInterval{start: start, end: end})
+				continue
+			}
+			// the window wraps around the end of the week
+			intervals = append(intervals, weekInterval{start: start, end: scheduleWeek}, weekInterval{start: 0, end: end - scheduleWeek})
+		}
+	}
+
+	slices.SortFunc(intervals, func(a weekInterval, b weekInterval) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	var mergedIntervals []weekInterval
+	for _, interval := range intervals {
+		if len(mergedIntervals) > 0 && interval.start <= mergedIntervals[len(mergedIntervals)-1].end {
+			mergedIntervals[len(mergedIntervals)-1].end = max(mergedIntervals[len(mergedIntervals)-1].end, interval.end)
+			continue
+		}
+		mergedIntervals = append(mergedIntervals, interval)
+	}
+	return mergedIntervals
+}
+
+// intersectWeekIntervals returns the windows that are in both a and b, which are sorted and merged
+func intersectWeekIntervals(a []weekInterval, b []weekInterval) []weekInterval {
+	var intervals []weekInterval
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start := max(a[i].start, b[j].start)
+		end := min(a[i].end, b[j].end)
+		if start < end {
+			intervals = append(intervals, weekInterval{start: start, end: end})
+		}
+		if a[i].end < b[j].end {
+			i++
+		} else {
+			j++
+		}
+	}
+	return intervals
+}
+
+// weekIntervalsToSchedules converts windows within a week back to schedules, windows are split at midnight, and the days with the same hours are put in the same schedule
+func weekIntervalsToSchedules(intervals []weekInterval, location string) []Schedule {
+	var schedules []Schedule
+	for _, interval := range intervals {
+		for start := interval.start; start < interval.end; {
+			day := start / constants.TimeDurationDay
+			end := min(interval.end, (day+1)*constants.TimeDurationDay)
+			from := start - day*constants.TimeDurationDay
+			until := (end - day*constants.TimeDurationDay) % constants.TimeDurationDay
+
+			scheduleIndex := slices.IndexFunc(schedules, func(schedule Schedule) bool {
+				return schedule.From == from && schedule.Until == until
+			})
+			if scheduleIndex == -1 {
+				schedules = append(schedules, Schedule{From: from, Until: until, Location: location})
+				scheduleIndex = len(schedules) - 1
+			}
+			schedules[scheduleIndex].Days = append(schedules[scheduleIndex].Days, time.Weekday(day))
+			start = end
+		}
+	}
+
+	for i := range schedules {
+		slices.SortFunc(schedules[i].Days, func(a, b time.Weekday) int {
+			return mondayFirstDayIndex(a) - mondayFirstDayIndex(b)
+		})
+		// a schedule that opens every day has no days
+		if len(schedules[i].Days) == 7 {
+			schedules[i].Days = nil
+		}
+	}
+	return schedules
+}
@@ -0,0 +1,269 @@
+package permitta
+
+import (
+	"errors"
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"slices"
+	"time"
+)
+
+// ErrUsageConflict is returned by Engine.Consume when the usage kept being changed by someone else, more than Engine.MaxRetries times, and by SQLUsageStore.Put when the row did more than constants.DefaultUsageStoreMaxRetries times
+var ErrUsageConflict = errors.New("usage was changed concurrently too many times")
+
+// EntityIDs holds the ID of every entity in the EntityPermissionOrder, keyed by entity e.g {constants.EntityUser: "42", constants.EntityOrg: "acme"}
+type EntityIDs map[string]string
+
+// StoreRequestData is a PermissionRequestData for an Engine, instead of the usage of each entity, it holds the IDs used to load the usages from the UsageStore
+type StoreRequestData struct {
+	PermissionRequestData
+	OperationQuantity uint
+	EntityIDs         EntityIDs
+	Resource          string // optional, see UsageKey.Resource, PermissionRequestData.Resource is used if it's empty
+}
+
+// resource returns the resource usages are partitioned by
+func (requestData StoreRequestData) resource() string {
+	if requestData.Resource != "" {
+		return requestData.Resource
+	}
+	return requestData.PermissionRequestData.Resource
+}
+
+// Engine checks permissions against usages loaded from a UsageStore, and saves the updated usages back to it
+type Engine struct {
+	Store      UsageStore
+	MaxRetries int // number of times Consume retries when a usage is changed concurrently, constants.DefaultUsageStoreMaxRetries is used if it's 0 or less
+}
+
+// NewEngine returns an Engine that loads and saves usages with store
+func NewEngine(store UsageStore) *Engine {
+	return &Engine{Store: store, MaxRetries: constants.DefaultUsageStoreMaxRetries}
+}
+
+// loadedEntity is an entity whose usage was loaded, with the key and version of its usage
+type loadedEntity struct {
+	entityKey  string // see Entity.Key
+	usageKey   UsageKey
+	version    uint64
+	permission Permission
+}
+
+// loadedUsages holds the usages loaded for a request, with the entities in the EntityPermissionOrder, without duplicates
+type loadedUsages struct {
+	requestData PermissionWithUsageRequestData
+	entities    []loadedEntity
+}
+
+// load loads the usage of every entity in the EntityPermissionOrder
+// Entities that have an ID use it, other entities use the ID of their type in EntityIDs
+func (engine *Engine) load(requestData StoreRequestData) (loadedUsages, error) {
+	loaded := loadedUsages{
+		requestData: PermissionWithUsageRequestData{
+			PermissionRequestData: requestData.PermissionRequestData,
+			OperationQuantity:     requestData.OperationQuantity,
+		},
+	}
+	loaded.requestData.Resource = requestData.resource()
+	loaded.requestData.Entities = slices.Clone(requestData.Entities)
+	loadedEntityKeys := make(map[string]bool)
+
+	loadUsage := func(entityType string, entityID string, resource string) (UsageKey, PermissionUsage, uint64, error) {
+		if entityID == "" {
+			var isEntityIDFound bool
+			entityID, isEntityIDFound = requestData.EntityIDs[entityType]
+			if isEntityIDFound == false {
+				return UsageKey{}, PermissionUsage{}, 0, fmt.Errorf("no ID for entity %s", entityType)
+			}
+		}
+		usageKey := UsageKey{EntityType: entityType, EntityID: entityID, Resource: resource}
+		usage, version, err := engine.Store.Get(usageKey)
+		return usageKey, usage, version, err
+	}
+
+	for _, currentEntityType := range getEntityPermissionOrder(requestData.PermissionRequestData) {
+		// invalid entity types have no usage, the operation is denied with constants.ReasonInvalidEntity when it's checked
+		if isEntityValid(currentEntityType) == false {
+			continue
+		}
+		isInEntities := false
+		for i := range loaded.requestData.Entities {
+			entity := &loaded.requestData.Entities[i]
+			if entity.Type != currentEntityType {
+				continue
+			}
+			isInEntities = true
+			if loadedEntityKeys[entity.Key()] {
+				continue
+			}
+
+			// the usage of an entity with a policy is kept per resource name or pattern that matched, see Policy.Match
+			usageKey, usage, version, err := loadUsage(entity.Type, entity.ID, entity.usageResource(loaded.requestData.Resource))
+			if err != nil {
+				return loadedUsages{}, err
+			}
+			// the usage in the store is already the usage of the resource, so the usage of the policy isn't used
+			entity.Usage = usage
+			entity.PolicyUsage = nil
+			loadedEntityKeys[entity.Key()] = true
+			loaded.entities = append(loaded.entities, loadedEntity{entityKey: entity.Key(), usageKey: usageKey, version: version, permission: entity.forResource(loaded.requestData.Resource).Permission})
+		}
+		if isInEntities || loadedEntityKeys[currentEntityType] {
+			continue
+		}
+
+		usageKey, usage, version, err := loadUsage(currentEntityType, "", loaded.requestData.Resource)
+		if err != nil {
+			return loadedUsages{}, err
+		}
+		setEntityPermissionUsage(currentEntityType, &loaded.requestData, usage)
+		loadedEntityKeys[currentEntityType] = true
+		loaded.entities = append(loaded.entities, loadedEntity{entityKey: currentEntityType, usageKey: usageKey, version: version, permission: getEntityPermission(currentEntityType, requestData.PermissionRequestData)})
+	}
+
+	return loaded, nil
+}
+
+// Check loads the usage of every entity in the EntityPermissionOrder and checks the operation against it, just like CheckOperationWithUsage. It doesn't change any usage
+func (engine *Engine) Check(requestData StoreRequestData) (Decision, error) {
+	loaded, err := engine.load(requestData)
+	if err != nil {
+		return Decision{}, err
+	}
+	return CheckOperationWithUsage(loaded.requestData), nil
+}
+
+// RateLimit loads the usage of every entity in the EntityPermissionOrder and returns the tightest duration based limit of the operation, just like GetRateLimit
+func (engine *Engine) RateLimit(requestData StoreRequestData) (RateLimit, bool, error) {
+	rateLimits, err := engine.rateLimits(requestData)
+	if err != nil {
+		return RateLimit{}, false, err
+	}
+	rateLimit, hasRateLimit := tightestRateLimit(rateLimits)
+	return rateLimit, hasRateLimit, nil
+}
+
+// Remaining loads the usage of every entity in the EntityPermissionOrder and returns what's left of every limit of the operation, just like Remaining
+func (engine *Engine) Remaining(requestData StoreRequestData) (Allowance, error) {
+	loaded, err := engine.load(requestData)
+	if err != nil {
+		return Allowance{}, err
+	}
+	return Remaining(loaded.requestData), nil
+}
+
+// rateLimits loads the usage of every entity in the EntityPermissionOrder and returns every duration based limit of the operation, see getRateLimits
+func (engine *Engine) rateLimits(requestData StoreRequestData) ([]RateLimit, error) {
+	loaded, err := engine.load(requestData)
+	if err != nil {
+		return nil, err
+	}
+	return getRateLimits(loaded.requestData, loaded.requestData.now()), nil
+}
+
+// Consume loads the usage of every entity in the EntityPermissionOrder, checks the operation against it, and if it's permitted, saves the updated usages, see Consume
+//
+// Usages are saved with UsageStore.CompareAndSwap. If a usage was changed by someone else before any usage is saved, everything is loaded and checked again.
+// If it happens after some usages are saved, the operation has already been permitted, so only the remaining usages are reloaded and updated, which means limits can be exceeded slightly under heavy contention.
+// ErrUsageConflict is returned if this is retried more than MaxRetries times.
+// If saving a usage fails after other usages are saved, the usages that were saved are refunded before the error is returned, so an operation that isn't permitted isn't charged either
+func (engine *Engine) Consume(requestData StoreRequestData, operationTime time.Time) (Decision, error) {
+	decision, _, err := engine.consume(requestData, operationTime)
+	return decision, err
+}
+
+// consume is Consume, it also returns the entities whose usage was charged, so the operation can be refunded, see Engine.refund
+func (engine *Engine) consume(requestData StoreRequestData, operationTime time.Time) (Decision, []loadedEntity, error) {
+	maxRetries := engine.maxRetries()
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		loaded, err := engine.load(requestData)
+		if err != nil {
+			return Decision{}, nil, err
+		}
+
+		decision, updatedUsages := Consume(loaded.requestData, operationTime)
+		if decision.Allowed == false {
+			return decision, nil, nil
+		}
+
+		var chargedEntities []loadedEntity
+		isConflict := false
+		for _, entity := range loaded.entities {
+			updatedUsage, isCharged := updatedUsages[entity.entityKey]
+			if isCharged == false {
+				continue
+			}
+			isSaved, err := engine.Store.CompareAndSwap(entity.usageKey, entity.version, updatedUsage)
+			if err != nil {
+				return Decision{}, nil, engine.rollBack(chargedEntities, requestData, operationTime, err)
+			}
+			if isSaved == false {
+				if len(chargedEntities) == 0 {
+					isConflict = true
+					break
+				}
+				if err := engine.updateUntilSaved(entity, requestData, operationTime, UpdateUsage); err != nil {
+					return Decision{}, nil, engine.rollBack(chargedEntities, requestData, operationTime, err)
+				}
+			}
+			chargedEntities = append(chargedEntities, entity)
+		}
+
+		if isConflict == false {
+			return decision, chargedEntities, nil
+		}
+	}
+
+	return Decision{}, nil, ErrUsageConflict
+}
+
+// refund takes an operation that was charged with Engine.consume back out of the usage of the charged entities, e.g because the request failed after it was permitted, see refundUsage
+func (engine *Engine) refund(chargedEntities []loadedEntity, requestData StoreRequestData, operationTime time.Time) error {
+	for _, entity := range chargedEntities {
+		if err := engine.updateUntilSaved(entity, requestData, operationTime, refundUsage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollBack refunds the entities that were charged before saving the usage of another entity failed with err, and returns err, joined with the error of the refund if it fails too
+func (engine *Engine) rollBack(chargedEntities []loadedEntity, requestData StoreRequestData, operationTime time.Time, err error) error {
+	if refundErr := engine.refund(chargedEntities, requestData, operationTime); refundErr != nil {
+		return errors.Join(err, refundErr)
+	}
+	return err
+}
+
+// maxRetries returns MaxRetries, or constants.DefaultUsageStoreMaxRetries if it's 0 or less
+func (engine *Engine) maxRetries() int {
+	if engine.MaxRetries <= 0 {
+		return constants.DefaultUsageStoreMaxRetries
+	}
+	return engine.MaxRetries
+}
+
+// updateUntilSaved reloads the usage of the entity and saves it changed by update e.g UpdateUsage, until no one else changes it in between
+func (engine *Engine) updateUntilSaved(entity loadedEntity, requestData StoreRequestData, operationTime time.Time, update func(UpdateUsageData, PermissionUsage) PermissionUsage) error {
+	updateUsageData := UpdateUsageData{
+		Operation:         requestData.Operation,
+		OperationQuantity: requestData.OperationQuantity,
+		OperationTime:     operationTime,
+		OperationLimits:   GetOperationLimits(requestData.Operation, entity.permission),
+	}
+
+	maxRetries := engine.maxRetries()
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		usage, version, err := engine.Store.Get(entity.usageKey)
+		if err != nil {
+			return err
+		}
+		isSaved, err := engine.Store.CompareAndSwap(entity.usageKey, version, update(updateUsageData, usage))
+		if err != nil || isSaved {
+			return err
+		}
+	}
+
+	return ErrUsageConflict
+}
@@ -0,0 +1,251 @@
+package permitta
+
+import (
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Entity is an entity in the entity hierarchy, with its permission and usage e.g Entity{Type: "workspace", Permission: workspacePermission, Usage: workspaceUsage}
+// The entity type must be registered with RegisterEntityType, except for the default entities org, domain, group, role and user which are always registered
+// ID tells apart multiple entities of the same type, e.g a user with the roles "auditor" and "budget-viewer", see PermissionRequestData.CombiningRules
+// If the entity has a Policy, the permission and usage of the requested resource in Policy and PolicyUsage are used instead of Permission and Usage, see PermissionRequestData.Resource
+type Entity struct {
+	Type        string
+	ID          string
+	Permission  Permission
+	Usage       PermissionUsage
+	Policy      Policy
+	PolicyUsage PolicyUsage
+}
+
+// Key returns the entity type and ID as <type>:<id> e.g role:auditor , or just the type if the ID is empty
+// It's the entity in a Decision, and the key of the entity in UpdatedUsages
+func (entity Entity) Key() string {
+	if entity.ID == "" {
+		return entity.Type
+	}
+	return entity.Type + constants.EntityKeySeparator + entity.ID
+}
+
+// entityTypes is the registry of the entity types that can be used in the EntityPermissionOrder and in Entities
+var entityTypes = struct {
+	sync.RWMutex
+	registered map[string]bool
+}{
+	registered: map[string]bool{
+		constants.EntityOrg:    true,
+		constants.EntityDomain: true,
+		constants.EntityGroup:  true,
+		constants.EntityRole:   true,
+		constants.EntityUser:   true,
+	},
+}
+
+// RegisterEntityType adds an entity type e.g "workspace" or "project" to the entity types that can be used in the EntityPermissionOrder, it's meant to be called at startup
+// Entity types can't be empty, and can't contain whitespace or the order separator "->"
+func RegisterEntityType(entityType string) error {
+	if entityType == "" || strings.Contains(entityType, constants.OrderSeparator) || strings.IndexFunc(entityType, unicode.IsSpace) != -1 {
+		return fmt.Errorf("invalid entity type '%s', it can't be empty or contain whitespace or '%s'", entityType, constants.OrderSeparator)
+	}
+
+	entityTypes.Lock()
+	defer entityTypes.Unlock()
+	entityTypes.registered[entityType] = true
+	return nil
+}
+
+// IsEntityTypeRegistered reports if the entity type is registered, see RegisterEntityType
+func IsEntityTypeRegistered(entityType string) bool {
+	entityTypes.RLock()
+	defer entityTypes.RUnlock()
+	return entityTypes.registered[entityType]
+}
+
+// findEntity returns the index of the first entity of the entity type in entities, or -1 if there is none
+func findEntity(entities []Entity, entityType string) int {
+	for i := range entities {
+		if entities[i].Type == entityType {
+			return i
+		}
+	}
+	return -1
+}
+
+// entityLevel returns the entities of the entity type, from Entities if there is any of that type, else from the entity fields e.g UserEntityPermissions and UserEntityUsage
+func entityLevel(entityType string, usageRequestData PermissionWithUsageRequestData) []Entity {
+	var entities []Entity
+	for _, entity := range usageRequestData.Entities {
+		if entity.Type == entityType {
+			entities = append(entities, entity.forResource(usageRequestData.Resource))
+		}
+	}
+	if len(entities) > 0 {
+		return entities
+	}
+
+	return []Entity{{
+		Type:       entityType,
+		Permission: getEntityPermission(entityType, usageRequestData.PermissionRequestData),
+		Usage:      getEntityPermissionUsage(entityType, usageRequestData),
+	}}
+}
+
+// checkEntityLevels checks every entity type in the EntityPermissionOrder with check, combining the decisions of the entities of each type with the combining rule of the type,
+// then combining the decisions of the entity types with the CombiningAlgorithm
+// It returns the entities that granted the operation, which are the entities to charge when it's permitted
+// now is the time the request is checked at, see PermissionRequestData.Clock
+func checkEntityLevels(usageRequestData PermissionWithUsageRequestData, now time.Time, check func(Entity) Decision) (Decision, []Entity) {
+	permissionOrder := getEntityPermissionOrder(usageRequestData.PermissionRequestData)
+	if len(permissionOrder) < 1 {
+		return deniedDecision("", constants.ReasonInvalidEntityPermissionOrder), nil
+	}
+
+	combiningAlgorithm := usageRequestData.CombiningAlgorithm
+	if combiningAlgorithm == "" {
+		combiningAlgorithm = constants.CombiningAlgorithmStrictHierarchy
+	}
+	if combiningAlgorithm != constants.CombiningAlgorithmStrictHierarchy &&
+		combiningAlgorithm != constants.CombiningAlgorithmDenyOverrides &&
+		combiningAlgorithm != constants.CombiningAlgorithmPermitOverrides {
+		return deniedDecision("", constants.ReasonInvalidCombiningAlgorithm), nil
+	}
+
+	// the Condition of each entity's permission is checked before anything else, a permission whose condition isn't met doesn't apply to the request
+	checkWithCondition := func(entity Entity) Decision {
+		if decision := checkPermissionCondition(entity.Permission, usageRequestData.Context); decision.Allowed == false {
+			return decision
+		}
+		return check(entity)
+	}
+
+	// with deny-overrides, an explicit deny of any entity wins, even if other entities of the same type grant the operation
+	// an explicit deny only applies if the condition of the permission is met, e.g "!d" with if=request.network=='public' denies delete only from the public network
+	// an explicit deny whose condition can't be evaluated, e.g because request.network was left out of the context, still denies, otherwise it could be bypassed by leaving the variable out
+	if combiningAlgorithm == constants.CombiningAlgorithmDenyOverrides {
+		for _, currentEntityType := range permissionOrder {
+			for _, entity := range entityLevel(currentEntityType, usageRequestData) {
+				decision := checkPermissionCondition(entity.Permission, usageRequestData.Context)
+				if decision.Reason == constants.ReasonInvalidCondition {
+					decision.Entity = entity.Key()
+					return decision, nil
+				}
+				if decision.Reason == constants.ReasonConditionError {
+					if checkEntityOperation(usageRequestData.Operation, entity.Permission, now).Reason == constants.ReasonExplicitlyDenied {
+						decision.Entity = entity.Key()
+						return decision, nil
+					}
+					continue
+				}
+				if decision.Allowed == false {
+					continue
+				}
+				if decision := checkEntityOperation(usageRequestData.Operation, entity.Permission, now); decision.Reason == constants.ReasonExplicitlyDenied {
+					decision.Entity = entity.Key()
+					return decision, nil
+				}
+			}
+		}
+	}
+
+	var grantingEntities []Entity
+	var firstDeniedDecision Decision
+	var notApplicableDecision Decision
+	for _, currentEntityType := range permissionOrder {
+		// if any of the entity is invalid at any point decline permission
+		if isEntityValid(currentEntityType) == false {
+			return deniedDecision(currentEntityType, constants.ReasonInvalidEntity), nil
+		}
+
+		levelDecision, levelGrantingEntities := combineEntityDecisions(usageRequestData.CombiningRules[currentEntityType], usageRequestData.PermissionRequestData, now, entityLevel(currentEntityType, usageRequestData), checkWithCondition)
+		if levelDecision.Allowed == true {
+			grantingEntities = append(grantingEntities, levelGrantingEntities...)
+			continue
+		}
+		if levelDecision.Entity == "" {
+			levelDecision.Entity = currentEntityType
+		}
+
+		switch combiningAlgorithm {
+		case constants.CombiningAlgorithmStrictHierarchy:
+			return levelDecision, nil
+		case constants.CombiningAlgorithmDenyOverrides:
+			// entity types whose permission doesn't grant the operation, or isn't in effect, or whose condition isn't met, don't apply to it, every other denial e.g an exceeded limit or a condition that can't be evaluated still denies it
+			if levelDecision.Reason == constants.ReasonOperationNotGranted || levelDecision.Reason == constants.ReasonNotStarted || levelDecision.Reason == constants.ReasonExpired || levelDecision.Reason == constants.ReasonOutsideSchedule || levelDecision.Reason == constants.ReasonConditionNotMet {
+				if notApplicableDecision.Reason == "" {
+					notApplicableDecision = levelDecision
+				}
+				continue
+			}
+			return levelDecision, nil
+		case constants.CombiningAlgorithmPermitOverrides:
+			if firstDeniedDecision.Reason == "" {
+				firstDeniedDecision = levelDecision
+			}
+		}
+	}
+
+	if len(grantingEntities) == 0 && combiningAlgorithm != constants.CombiningAlgorithmStrictHierarchy {
+		if firstDeniedDecision.Reason != "" {
+			return firstDeniedDecision, nil
+		}
+		return notApplicableDecision, nil
+	}
+
+	return Decision{Allowed: true}, grantingEntities
+}
+
+// combineEntityDecisions checks the entities of the same type with check, and combines their decisions with the combining rule, see PermissionRequestData.CombiningRules
+// When the operation is denied, the decision of the first entity that denied it is returned
+func combineEntityDecisions(combiningRule string, permissionRequestData PermissionRequestData, now time.Time, entities []Entity, check func(Entity) Decision) (Decision, []Entity) {
+	var firstDeniedDecision Decision
+	recordDecision := func(entity Entity, decision Decision) Decision {
+		if decision.Allowed == false {
+			decision.Entity = entity.Key()
+			if firstDeniedDecision.Reason == "" {
+				firstDeniedDecision = decision
+			}
+		}
+		return decision
+	}
+	entityDecision := func(entity Entity) Decision {
+		return recordDecision(entity, check(entity))
+	}
+
+	switch combiningRule {
+	case "", constants.CombiningRuleAllOf:
+		for _, entity := range entities {
+			if decision := entityDecision(entity); decision.Allowed == false {
+				return decision, nil
+			}
+		}
+		return Decision{Allowed: true}, entities
+	case constants.CombiningRuleAnyOf:
+		for _, entity := range entities {
+			if entityDecision(entity).Allowed == true {
+				return Decision{Allowed: true}, []Entity{entity}
+			}
+		}
+		return firstDeniedDecision, nil
+	case constants.CombiningRuleFirstApplicable:
+		for _, entity := range entities {
+			// an entity is applicable if its condition is met and it grants the operation, whatever its limits are
+			if recordDecision(entity, checkPermissionCondition(entity.Permission, permissionRequestData.Context)).Allowed == false {
+				continue
+			}
+			if recordDecision(entity, checkEntityOperation(permissionRequestData.Operation, entity.Permission, now)).Allowed == false {
+				continue
+			}
+			if decision := entityDecision(entity); decision.Allowed == false {
+				return decision, nil
+			}
+			return Decision{Allowed: true}, []Entity{entity}
+		}
+		return firstDeniedDecision, nil
+	}
+
+	return deniedDecision("", constants.ReasonInvalidCombiningRule), nil
+}
@@ -0,0 +1,102 @@
+package permitta
+
+import (
+	"context"
+	"errors"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// logger is the logger permitta logs denials and notation problems to, it discards everything until SetLogger is called
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	logger.Store(slog.New(discardHandler{}))
+}
+
+// SetLogger sets the logger permitta logs to, e.g slog.Default() . Denied operations are logged at the info level, and problems with permissions, usage or notations at the warn level
+// Permissions and usage are never logged, only the entity, operation, reason, limit, usage and quantity of a denial. Passing nil discards logs again, which is the default
+func SetLogger(newLogger *slog.Logger) {
+	if newLogger == nil {
+		newLogger = slog.New(discardHandler{})
+	}
+	logger.Store(newLogger)
+}
+
+// discardHandler is a slog.Handler that is never enabled, so nothing is logged and no log record is built
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool   { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error  { return nil }
+func (handler discardHandler) WithAttrs([]slog.Attr) slog.Handler { return handler }
+func (handler discardHandler) WithGroup(string) slog.Handler      { return handler }
+
+// logDecision logs a denied operation, decisions with a reason starting with "invalid_" e.g constants.ReasonInvalidLimit are problems with the permissions or usage, so they are logged at the warn level
+func logDecision(operation string, decision Decision) {
+	if decision.Allowed == true {
+		return
+	}
+
+	level := slog.LevelInfo
+	if strings.HasPrefix(decision.Reason, "invalid_") {
+		level = slog.LevelWarn
+	}
+	currentLogger := logger.Load()
+	if currentLogger.Enabled(context.Background(), level) == false {
+		return
+	}
+
+	attributes := []slog.Attr{
+		slog.String("entity", decision.Entity),
+		slog.String("operation", operation),
+		slog.String("reason", decision.Reason),
+	}
+	if decision.Limit != constants.Unlimited || decision.Quantity != 0 {
+		attributes = append(attributes,
+			slog.Uint64("limit", uint64(decision.Limit)),
+			slog.Uint64("usage", uint64(decision.Usage)),
+			slog.Uint64("quantity", uint64(decision.Quantity)),
+		)
+	}
+	if decision.Window != "" {
+		attributes = append(attributes, slog.String("window", decision.Window))
+	}
+	if decision.NextOpen != nil {
+		attributes = append(attributes, slog.Time("next_open", *decision.NextOpen))
+	}
+	currentLogger.LogAttrs(context.Background(), level, "operation denied", attributes...)
+}
+
+// logNotationError logs a notation that couldn't be parsed, only where the problem is, and not the notation itself, is logged
+func logNotationError(message string, err error) {
+	currentLogger := logger.Load()
+	if currentLogger.Enabled(context.Background(), slog.LevelWarn) == false {
+		return
+	}
+
+	var notationError *NotationError
+	if errors.As(err, &notationError) == false {
+		currentLogger.LogAttrs(context.Background(), slog.LevelWarn, message, slog.String("error", err.Error()))
+		return
+	}
+	errorKind := "malformed notation"
+	if notationError.Err != nil {
+		errorKind = notationError.Err.Error()
+	}
+	attributes := []slog.Attr{
+		slog.String("error", errorKind),
+		slog.Int("section", notationError.Section),
+		slog.Int("offset", notationError.Offset),
+	}
+	if notationError.Resource != "" {
+		attributes = append(attributes, slog.String("resource", notationError.Resource))
+	}
+	currentLogger.LogAttrs(context.Background(), slog.LevelWarn, message, attributes...)
+}
+
+// logUsageStoreError logs a problem with a usage store that didn't stop it from working e.g a failed compaction
+func logUsageStoreError(message string, err error) {
+	logger.Load().LogAttrs(context.Background(), slog.LevelWarn, message, slog.String("error", err.Error()))
+}
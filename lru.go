@@ -0,0 +1,68 @@
+package permitta
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache keeps up to a fixed number of values keyed by string, and evicts the least recently used value when it's full, it's safe to use from multiple goroutines
+// It's the cache of a Compiler, and of the conditions parsed when permissions are checked, see parseCachedCondition
+type lruCache[V any] struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element // the elements of recency, keyed by key
+	recency  *list.List               // the lruEntries, most recently used first
+}
+
+// lruEntry is an element of lruCache.recency, the key is kept so it can be deleted from the entries when it's evicted
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// newLRUCache returns an empty lruCache that keeps up to capacity values
+func newLRUCache[V any](capacity int) *lruCache[V] {
+	return &lruCache[V]{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		recency:  list.New(),
+	}
+}
+
+// get returns the value of the key, and marks it as the most recently used
+func (cache *lruCache[V]) get(key string) (V, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, isCached := cache.entries[key]
+	if isCached == false {
+		var value V
+		return value, false
+	}
+	cache.recency.MoveToFront(element)
+	return element.Value.(*lruEntry[V]).value, true
+}
+
+// add caches the value of the key, evicting the least recently used value if the cache is full, and returns the cached value
+// If the key was added meanwhile e.g by another goroutine, the value that is already cached is kept and returned, so every caller shares the same value
+func (cache *lruCache[V]) add(key string, value V) V {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, isCached := cache.entries[key]; isCached {
+		cache.recency.MoveToFront(element)
+		return element.Value.(*lruEntry[V]).value
+	}
+	cache.entries[key] = cache.recency.PushFront(&lruEntry[V]{key: key, value: value})
+	if cache.recency.Len() > cache.capacity {
+		leastRecentlyUsed := cache.recency.Back()
+		cache.recency.Remove(leastRecentlyUsed)
+		delete(cache.entries, leastRecentlyUsed.Value.(*lruEntry[V]).key)
+	}
+	return value
+}
+
+// len returns the number of values in the cache
+func (cache *lruCache[V]) len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.recency.Len()
+}
@@ -0,0 +1,247 @@
+package permitta
+
+import (
+	"bufio"
+	"encoding/json"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SubjectResolver returns the request data of the subject of an HTTP request e.g the signed in user, which is its entity chain and permissions, and the IDs its usages are stored with
+// Operation and OperationQuantity can be left empty, they are then taken from the HTTP request, see HTTPMiddleware
+type SubjectResolver func(request *http.Request) (StoreRequestData, error)
+
+// HTTPMiddleware is a net/http middleware that checks every request against the permissions and usage of its subject, and charges the usage before calling the next handler
+//
+// The operation is taken from the route overrides in Routes, else from the method of the request, see RequestMethodToOperation. The quantity is taken from the QuantityHeader, else it's 1.
+// Denied requests get a 403 Forbidden response, or 429 Too Many Requests if a duration based limit is exceeded e.g hour or day@cal, with the Decision as the JSON body e.g {"error":"operation denied by user entity : hour_limit_exceeded","allowed":false,"entity":"user",...}
+// The usage is reserved with Engine.Consume before the next handler runs, so concurrent requests can't exceed a limit together. It's refunded when the next handler doesn't respond with a 2xx status code, so failed requests don't count against limits
+// A refunded request still counted against limits while it was running, so a concurrent request may be denied because of it
+type HTTPMiddleware struct {
+	Engine  *Engine
+	Resolve SubjectResolver
+	// Routes overrides the operation of routes, keyed by method and path e.g {"POST /run": constants.OperationExecute, "POST /files/*/share": "share"} , the method can be left out to match every method e.g "/jobs/**"
+	// Paths can be patterns, see Policy.Match, and the most specific route that matches wins
+	Routes map[string]string
+	// QuantityHeader is the header holding the operation quantity e.g the number of files uploaded, constants.DefaultQuantityHeader is used if it's empty
+	QuantityHeader string
+	// RateLimitHeaders adds the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the tightest limit to checked requests, and Retry-After to requests denied by a duration based limit, see GetRateLimit
+	// The remaining of permitted requests is what's left after the request is charged. The usages are loaded from the store a second time to get the limits
+	RateLimitHeaders bool
+}
+
+// NewHTTPMiddleware returns an HTTPMiddleware that checks and charges usages with engine, for the subjects returned by resolve
+func NewHTTPMiddleware(engine *Engine, resolve SubjectResolver) *HTTPMiddleware {
+	return &HTTPMiddleware{Engine: engine, Resolve: resolve, QuantityHeader: constants.DefaultQuantityHeader, RateLimitHeaders: true}
+}
+
+// errorResponse is the JSON body of a request that couldn't be checked
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// deniedResponse is the JSON body of a denied request
+type deniedResponse struct {
+	Error string `json:"error"`
+	Decision
+}
+
+// Handler returns next wrapped with the middleware
+func (middleware *HTTPMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		requestData, err := middleware.Resolve(request)
+		if err != nil {
+			writeJSONResponse(responseWriter, http.StatusUnauthorized, errorResponse{Error: "the subject of the request could not be resolved"})
+			return
+		}
+
+		if requestData.Operation == "" {
+			requestData.Operation = middleware.operation(request)
+		}
+		if requestData.Operation == "" {
+			writeJSONResponse(responseWriter, http.StatusMethodNotAllowed, errorResponse{Error: "no operation for method " + request.Method})
+			return
+		}
+		if requestData.OperationQuantity == 0 {
+			quantity, isValid := middleware.quantity(request)
+			if isValid == false {
+				writeJSONResponse(responseWriter, http.StatusBadRequest, errorResponse{Error: "invalid operation quantity"})
+				return
+			}
+			requestData.OperationQuantity = quantity
+		}
+
+		// the usage is reserved before the next handler runs, otherwise every request in flight would pass the check before any of them is charged
+		operationTime := requestData.now()
+		decision, chargedEntities, err := middleware.Engine.consume(requestData, operationTime)
+		if err != nil {
+			logger.Load().LogAttrs(request.Context(), slog.LevelError, "permission check failed", slog.String("operation", requestData.Operation), slog.String("error", err.Error()))
+			writeJSONResponse(responseWriter, http.StatusInternalServerError, errorResponse{Error: "permission check failed"})
+			return
+		}
+		if middleware.RateLimitHeaders == true {
+			middleware.setRateLimitHeaders(responseWriter, request, requestData, decision)
+		}
+		if decision.Allowed == false {
+			writeJSONResponse(responseWriter, deniedStatusCode(decision), deniedResponse{Error: decision.String(), Decision: decision})
+			return
+		}
+
+		statusRecorder := &statusRecorder{ResponseWriter: responseWriter}
+		next.ServeHTTP(statusRecorder, request)
+		// handlers that write nothing respond with 200 OK
+		if statusRecorder.status == 0 || (statusRecorder.status >= 200 && statusRecorder.status <= 299) {
+			return
+		}
+
+		// the response is already sent, so if the usage can't be refunded, it can only be logged
+		if err := middleware.Engine.refund(chargedEntities, requestData, operationTime); err != nil {
+			logger.Load().LogAttrs(request.Context(), slog.LevelWarn, "usage of a failed request could not be refunded", slog.String("operation", requestData.Operation), slog.Int("status", statusRecorder.status), slog.String("error", err.Error()))
+		}
+	})
+}
+
+// operation returns the operation of the most specific route that matches the request, or the operation of its method, see RequestMethodToOperation
+func (middleware *HTTPMiddleware) operation(request *http.Request) string {
+	bestPattern := ""
+	bestOperation := ""
+	isBestMethodSpecific := false
+	for route, operation := range middleware.Routes {
+		method, pattern, hasMethod := strings.Cut(route, " ")
+		if hasMethod == false {
+			method, pattern = "", route
+		}
+		pattern = strings.TrimSpace(pattern)
+		if method != "" && strings.EqualFold(method, request.Method) == false || matchResourcePattern(pattern, request.URL.Path) == false {
+			continue
+		}
+
+		// a route with a method wins over the same route without a method
+		comparison := 1
+		if bestOperation != "" {
+			comparison = compareResourcePatterns(pattern, bestPattern)
+			if comparison == 0 && method != "" && isBestMethodSpecific == false {
+				comparison = 1
+			}
+		}
+		if comparison > 0 {
+			bestPattern, bestOperation, isBestMethodSpecific = pattern, operation, method != ""
+		}
+	}
+	if bestOperation != "" {
+		return bestOperation
+	}
+	return RequestMethodToOperation(request.Method)
+}
+
+// quantity returns the operation quantity in the quantity header, or 1 if there is none, it reports false if the header isn't a positive whole number
+func (middleware *HTTPMiddleware) quantity(request *http.Request) (uint, bool) {
+	quantityHeader := middleware.QuantityHeader
+	if quantityHeader == "" {
+		quantityHeader = constants.DefaultQuantityHeader
+	}
+	quantityString := request.Header.Get(quantityHeader)
+	if quantityString == "" {
+		return 1, true
+	}
+	quantity, err := strconv.ParseUint(strings.TrimSpace(quantityString), 10, 0)
+	if err != nil || quantity == 0 {
+		return 0, false
+	}
+	return uint(quantity), true
+}
+
+// setRateLimitHeaders adds the rate limit headers of the request to the response, a request denied by a duration based limit gets the headers of that limit, with Retry-After set to when it resets
+// Permitted requests are already charged, so clients see what's left after them
+func (middleware *HTTPMiddleware) setRateLimitHeaders(responseWriter http.ResponseWriter, request *http.Request, requestData StoreRequestData, decision Decision) {
+	rateLimits, err := middleware.Engine.rateLimits(requestData)
+	if err != nil {
+		logger.Load().LogAttrs(request.Context(), slog.LevelWarn, "rate limits could not be loaded", slog.String("operation", requestData.Operation), slog.String("error", err.Error()))
+		return
+	}
+	now := requestData.now()
+
+	rateLimit, hasRateLimit := tightestRateLimit(rateLimits)
+	deniedLimit, isDeniedByRateLimit := deniedRateLimit(rateLimits, decision)
+	if isDeniedByRateLimit {
+		rateLimit, hasRateLimit = deniedLimit, true
+	}
+	if hasRateLimit == false {
+		return
+	}
+	headers := rateLimit.Headers(now)
+	if isDeniedByRateLimit {
+		headers.Set(constants.HeaderRetryAfter, secondsUntil(rateLimit.Reset, now))
+	}
+	// Retry-After is only meaningful to a client whose request was denied
+	if decision.Allowed == true {
+		headers.Del(constants.HeaderRetryAfter)
+	}
+	for name, values := range headers {
+		responseWriter.Header()[name] = values
+	}
+}
+
+// deniedStatusCode returns 429 Too Many Requests if a duration based limit was exceeded, since the request can be retried once its window resets, else 403 Forbidden
+// Quota, all time and batch limits never reset, so retrying the same request can't succeed, they get 403 Forbidden too
+func deniedStatusCode(decision Decision) int {
+	if _, isWindowed := reasonWindowKeys[decision.Reason]; isWindowed || decision.Reason == constants.ReasonCustomDurationLimitExceeded {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusForbidden
+}
+
+func writeJSONResponse(responseWriter http.ResponseWriter, statusCode int, body any) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(statusCode)
+	json.NewEncoder(responseWriter).Encode(body)
+}
+
+// statusRecorder records the status code the next handler responds with
+// It forwards Flush and Hijack to the original ResponseWriter, so handlers that type assert http.Flusher or http.Hijacker e.g for server-sent events or websocket upgrades keep working, other interfaces are reached through Unwrap with http.ResponseController
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if recorder.status == 0 {
+		recorder.status = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+// Flush sends the buffered response to the client, if the original ResponseWriter can, a response that is flushed before a status code is written responds with 200 OK
+func (recorder *statusRecorder) Flush() {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	if flusher, isFlusher := recorder.ResponseWriter.(http.Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the next handler take over the connection e.g to upgrade it to a websocket, the request is then charged like a request that succeeded
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, isHijacker := recorder.ResponseWriter.(http.Hijacker)
+	if isHijacker == false {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the original ResponseWriter, so http.ResponseController can use it e.g to flush
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
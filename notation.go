@@ -0,0 +1,779 @@
+package permitta
+
+import (
+	"errors"
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors that can be wrapped by a NotationError, use errors.Is to check which kind of problem was found in a notation
+var (
+	ErrEmptyNotation             = errors.New("notation is empty")
+	ErrMalformedOperationSection = errors.New("malformed operation permission section")
+	ErrUnknownSection            = errors.New("unknown section")
+	ErrDuplicateSection          = errors.New("duplicate section")
+	ErrMalformedQuota            = errors.New("malformed quota limit")
+	ErrMalformedTime             = errors.New("malformed time")
+	ErrMalformedLimit            = errors.New("malformed operation limit")
+	ErrMalformedPolicy           = errors.New("malformed policy")
+	ErrDuplicateResource         = errors.New("duplicate resource")
+	ErrMalformedCondition        = errors.New("malformed condition")
+	ErrMalformedSchedule         = errors.New("malformed schedule")
+)
+
+// NotationError is returned by ParseNotation when a notation can't be parsed.
+// It holds enough details to point a user to the exact problem, e.g. when showing the error under a notation input in an admin UI
+type NotationError struct {
+	Err        error  // one of the ErrMalformed... errors above
+	Section    int    // index of the section that has the problem, the operation permission section e.g "cr-de" is 0
+	Token      string // the offending token e.g "minute:abc"
+	Offset     int    // character offset of the offending token in the notation that was passed in
+	Suggestion string // a suggested fix
+	Resource   string // the resource whose notation has the problem, only set by ParsePolicy
+}
+
+func (notationError *NotationError) Error() string {
+	message := fmt.Sprintf("%s in section %d at offset %d", notationError.Err, notationError.Section, notationError.Offset)
+	if notationError.Resource != "" {
+		message = fmt.Sprintf("%s in resource '%s' section %d at offset %d", notationError.Err, notationError.Resource, notationError.Section, notationError.Offset)
+	}
+	if notationError.Token != "" {
+		message = message + fmt.Sprintf(" : '%s'", notationError.Token)
+	}
+	if notationError.Suggestion != "" {
+		message = message + ", " + notationError.Suggestion
+	}
+	return message
+}
+
+func (notationError *NotationError) Unwrap() error {
+	return notationError.Err
+}
+
+// notationSection is a single section of a notation, Offset is the offset of the section in the notation after white spaces have been removed
+type notationSection struct {
+	Value  string
+	Offset int
+}
+
+//TODO add a way to write this permissions in shorthand , both for obscurity and quick writing of permissions
+// Then write a function to intepreter that shorthand, its basically just parsing using strings.split , you might even create your own standard of writing permissions and propose it to a body tasked with standardizing things like this
+// FOllowing the unix permission pattern for each entity, you can do , "crud-","c"{all:0,batch:1,minute:0,hour:5,day:0,week:45,fortnight:0,monthly:0,quarterly:0,yearly:0,customDurations:[per_5_minutes_4,per_3_days_50]|r:....
+
+// NotationToPermission converts a notation string to a permission "object"/struct. Its just a useful "shorthand" way to write permissions without using the struct directly
+// If the notation is malformed, an empty Permission is returned, which denies every operation. Use ParseNotation if you need to know what is wrong with the notation
+//
+// Below is an example of what a notation looks like . Read in the repo documentation for details
+//
+// q=30 standards for QuotaLimit of 30
+//
+//	crud-|q=30|c=month:0,day:100,batch:1,minute:5,hour:20,week:500,fortnight:700,year:10000,quarter:5000,custom:[per_5_minutes_4 & per_3_days_50]|r=..
+func NotationToPermission(notation string) Permission {
+	permission, err := ParseNotation(notation)
+	if err != nil {
+		logNotationError("malformed permission notation", err)
+		return Permission{}
+	}
+
+	return permission
+}
+
+// ParseNotation converts a notation string to a permission "object"/struct, just like NotationToPermission, but returns a *NotationError describing the problem if the notation is malformed
+// White spaces are ignored, and empty sections e.g a trailing "|" are skipped
+func ParseNotation(notation string) (Permission, error) {
+	var finalPermission Permission
+	strippedNotation, offsets := removeAllWhiteSpacesWithOffsets(notation)
+
+	// newNotationError creates the error, and maps the offset in the stripped notation back to the offset in the original notation
+	newNotationError := func(err error, sectionIndex int, token string, strippedOffset int, suggestion string) *NotationError {
+		offset := len(notation)
+		if strippedOffset < len(offsets) {
+			offset = offsets[strippedOffset]
+		}
+		return &NotationError{Err: err, Section: sectionIndex, Token: token, Offset: offset, Suggestion: suggestion}
+	}
+
+	if strippedNotation == "" {
+		return Permission{}, newNotationError(ErrEmptyNotation, 0, "", 0, "start with the operation permission section e.g crude")
+	}
+
+	// first let's split the notation into its different section
+	notationSections := splitNotationSections(strippedNotation)
+	operationPermissionSection := notationSections[0].Value
+
+	// let's check the first section if its properly formed, if it is we can proceed,
+	// it should always be 5 characters long , because it should be like "crude" , which stands for CREATE, READ, UPDATE, DELETE, EXECUTE . , if we don't want to grant permission to any of these operations any of the letters in "crude" can be replaced with a minus sign "-"
+	// But the letter have to ALWAYS follow that order, or be replaced by "-"
+	// A letter can also be prefixed with "!" to explicitly deny the operation e.g cr-!d- denies delete
+	// The letters of registered operations that are not crude operations can follow the crude letters in any order, e.g crudes grants share if "s" is the letter of share, see RegisterOperation
+	// so let's use regex, it's compiled once for the registered operations, see RegisterOperation
+	operationMatches := operationSectionRegex().FindStringSubmatch(operationPermissionSection)
+	if operationMatches == nil {
+		return Permission{}, newNotationError(ErrMalformedOperationSection, 0, operationPermissionSection, notationSections[0].Offset, "the first section must be 5 characters in crude order, with '-' for operations that are not granted and '!' before operations that are denied e.g cr-!d-, optionally followed by the letters of registered operations")
+	}
+
+	// if we got here it means the pattern matched, and we are good to set the permission values for the operations
+	finalPermission.Create = operationMatches[1] == "c"
+	finalPermission.Read = operationMatches[2] == "r"
+	finalPermission.Update = operationMatches[3] == "u"
+	finalPermission.Delete = operationMatches[4] == "d"
+	finalPermission.Execute = operationMatches[5] == "e"
+	finalPermission.DenyCreate = operationMatches[1] == "!c"
+	finalPermission.DenyRead = operationMatches[2] == "!r"
+	finalPermission.DenyUpdate = operationMatches[3] == "!u"
+	finalPermission.DenyDelete = operationMatches[4] == "!d"
+	finalPermission.DenyExecute = operationMatches[5] == "!e"
+
+	if len(operationMatches) > 6 && operationMatches[6] != "" {
+		finalPermission.Operations = make(map[string]OperationPermission)
+		extraOperationsSection := operationMatches[6]
+		extraOperationsOffset := notationSections[0].Offset + len(operationPermissionSection) - len(extraOperationsSection)
+		for letterIndex := 0; letterIndex < len(extraOperationsSection); letterIndex++ {
+			isDenied := extraOperationsSection[letterIndex] == '!'
+			if isDenied {
+				letterIndex++
+			}
+			operation, _ := lookupOperationLetter(extraOperationsSection[letterIndex : letterIndex+1])
+			if _, isDuplicate := finalPermission.Operations[operation.Name]; isDuplicate {
+				return Permission{}, newNotationError(ErrMalformedOperationSection, 0, operation.Letter, extraOperationsOffset+letterIndex, fmt.Sprintf("remove the duplicate '%s'", operation.Letter))
+			}
+			finalPermission.Operations[operation.Name] = OperationPermission{Granted: isDenied == false, Denied: isDenied}
+		}
+	}
+
+	// Let's move to the remaining sections, we can just loop through them , since they have similar syntax
+	// NOTE The remaining sections don't have to be set if I want to let all the limits be unlimited and the batch limit to be 1
+	// the remaining sections is for limits , create limits for example would be defined like :
+	// c=month:0,day:100,batch:1,minute:5,hour:20,week:500,fortnight:700,year:10000,quarter:5000,custom:[per_5_minutes_4,per_3_days_50]
+	// one of the limits section can be the quota limit q=int , if its not set , it assumes quota is unlimited
+	// for other operations "c=" can just be replaced with "r=" or "u=" or "d=" or "e="
+	// The individual limits within each operation limit section can be arranged in any order
+	// If any limit is excluded, its assumed that the value is unlimited , batch limit can never be unlimited, this is why if its not set, it automatically enforced as 1, where corresponding operation permission is granted
+	// Operation Limit sections can be left empty even if the said operation is granted permission, this would imply that batch limit is the default of 1 and all other limits are unlimited
+	// Limit sections for operations that are not granted are ignored
+	seenSections := make(map[string]bool)
+	for i := 1; i < len(notationSections); i++ {
+		currentSection := notationSections[i]
+		if currentSection.Value == "" {
+			continue
+		}
+
+		sectionKey, sectionValue, hasSeparator := strings.Cut(currentSection.Value, "=")
+		if hasSeparator == false || isNotationSectionKeyValid(sectionKey) == false {
+			return Permission{}, newNotationError(ErrUnknownSection, i, currentSection.Value, currentSection.Offset, notationSectionSuggestion(sectionKey))
+		}
+
+		if seenSections[sectionKey] == true {
+			return Permission{}, newNotationError(ErrDuplicateSection, i, currentSection.Value, currentSection.Offset, fmt.Sprintf("merge the '%s=' sections into one", sectionKey))
+		}
+		seenSections[sectionKey] = true
+		valueOffset := currentSection.Offset + len(sectionKey) + 1
+
+		switch sectionKey {
+		case "q":
+			quotaValue, quotaValueErr := stringToPositiveIntegerOrZero(sectionValue)
+			if quotaValueErr != nil {
+				return Permission{}, newNotationError(ErrMalformedQuota, i, sectionValue, valueOffset, "quota must be a whole number e.g q=100, use q=0 for unlimited")
+			}
+			finalPermission.QuotaLimit = quotaValue
+
+		case "start", "end":
+			timeValue, timeValueErr := parseNotationTime(sectionValue)
+			if timeValueErr != nil {
+				return Permission{}, newNotationError(ErrMalformedTime, i, sectionValue, valueOffset, fmt.Sprintf("%s must be a unix timestamp with its unit e.g %s=1735693200s or %s=1735693200000ms , or an RFC 3339 timestamp e.g %s=2025-01-01T01:00:00Z", sectionKey, sectionKey, sectionKey, sectionKey))
+			}
+			if sectionKey == "start" {
+				finalPermission.StartTime = timeValue
+			} else {
+				finalPermission.EndTime = timeValue
+			}
+
+		case "schedule":
+			schedules, schedulesErr := getNotationSchedules(sectionValue)
+			if schedulesErr != nil {
+				return Permission{}, newNotationError(schedulesErr.Err, i, schedulesErr.Token, valueOffset+schedulesErr.Offset, schedulesErr.Suggestion)
+			}
+			finalPermission.Schedules = schedules
+
+		case "if":
+			// white spaces are removed from the notation, but they matter in conditions e.g request.ip in '10.0.0.0/8' , so the condition is taken from the original notation
+			conditionExpression := ""
+			if sectionValue != "" {
+				conditionExpression = notation[offsets[valueOffset] : offsets[valueOffset+len(sectionValue)-1]+1]
+			}
+			if _, conditionErr := ParseCondition(conditionExpression); conditionErr != nil {
+				return Permission{}, newNotationError(ErrMalformedCondition, i, sectionValue, valueOffset, "conditions compare values with ==, !=, <, <=, >, >= or in, and combine them with &&, || and ! e.g if=resource.owner==$uid , wrap conditions that use || in parentheses")
+			}
+			finalPermission.Condition = conditionExpression
+
+		default:
+			// if we got here, it's an operation limit section
+			operationLimit, operationLimitErr := getNotationOperationLimits(sectionValue)
+			if operationLimitErr != nil {
+				// if for any reason there is an error getting operation limit, its very important to not return the permission, else there would be a loop hole, where, users can be granted unlimited access
+				return Permission{}, newNotationError(operationLimitErr.Err, i, operationLimitErr.Token, valueOffset+operationLimitErr.Offset, operationLimitErr.Suggestion)
+			}
+
+			switch sectionKey {
+			case "c":
+				if finalPermission.Create == true {
+					finalPermission.CreateOperationLimits = operationLimit
+				}
+			case "r":
+				if finalPermission.Read == true {
+					finalPermission.ReadOperationLimits = operationLimit
+				}
+			case "u":
+				if finalPermission.Update == true {
+					finalPermission.UpdateOperationLimits = operationLimit
+				}
+			case "d":
+				if finalPermission.Delete == true {
+					finalPermission.DeleteOperationLimits = operationLimit
+				}
+			case "e":
+				if finalPermission.Execute == true {
+					finalPermission.ExecuteOperationLimits = operationLimit
+				}
+			default:
+				operation, _ := lookupOperationLetter(sectionKey)
+				if operationPermission := finalPermission.Operations[operation.Name]; operationPermission.Granted == true {
+					operationPermission.Limits = operationLimit
+					finalPermission.Operations[operation.Name] = operationPermission
+				}
+			}
+		}
+	}
+
+	// set default limits for granted permissions in case they were not set
+	if finalPermission.Create == true {
+		finalPermission.CreateOperationLimits.setDefaultLimits()
+	}
+
+	if finalPermission.Read == true {
+		finalPermission.ReadOperationLimits.setDefaultLimits()
+	}
+
+	if finalPermission.Update == true {
+		finalPermission.UpdateOperationLimits.setDefaultLimits()
+	}
+
+	if finalPermission.Delete == true {
+		finalPermission.DeleteOperationLimits.setDefaultLimits()
+	}
+
+	if finalPermission.Execute == true {
+		finalPermission.ExecuteOperationLimits.setDefaultLimits()
+	}
+
+	for operationName, operationPermission := range finalPermission.Operations {
+		if operationPermission.Granted == true {
+			operationPermission.Limits.setDefaultLimits()
+			finalPermission.Operations[operationName] = operationPermission
+		}
+	}
+
+	return finalPermission, nil
+}
+
+// PermissionToNotation converts a permission "object"/struct back to a notation string. It is the reverse of NotationToPermission
+// The notation is canonical, which means two permissions that are the same always give the same notation :
+// operations are always in crude order followed by registered operations in the order of their letters, sections are always in the order start, end, schedule, q, if, c, r, u, d, e, then registered operations, and limits are always in the order
+// batch, all, minute, hour, day, week, fortnight, month, quarter, year, custom.
+// Only limits that are not the default are included, i.e batch limits of 1, unlimited limits and limits of operations that are not granted are left out
+func PermissionToNotation(permission Permission) string {
+	operationPermissionSection := ""
+	for _, operation := range []struct {
+		letter    string
+		isGranted bool
+		isDenied  bool
+	}{
+		{"c", permission.Create, permission.DenyCreate},
+		{"r", permission.Read, permission.DenyRead},
+		{"u", permission.Update, permission.DenyUpdate},
+		{"d", permission.Delete, permission.DenyDelete},
+		{"e", permission.Execute, permission.DenyExecute},
+	} {
+		operationPermissionSection += operationPermissionLetter(operation.letter, operation.isGranted, operation.isDenied)
+	}
+
+	// registered operations that are not crude operations are written after the crude letters, in the order of their letters
+	// operations that are neither granted nor denied are left out, they have no "-"
+	extraOperationDefinitions := extraOperations()
+	for _, operation := range extraOperationDefinitions {
+		operationPermission := permission.Operations[operation.Name]
+		if operationPermission.Granted == true || operationPermission.Denied == true {
+			operationPermissionSection += operationPermissionLetter(operation.Letter, operationPermission.Granted, operationPermission.Denied)
+		}
+	}
+	notationSections := []string{operationPermissionSection}
+
+	if permission.StartTime.IsZero() == false {
+		notationSections = append(notationSections, "start="+timeToNotation(permission.StartTime))
+	}
+	if permission.EndTime.IsZero() == false {
+		notationSections = append(notationSections, "end="+timeToNotation(permission.EndTime))
+	}
+	if len(permission.Schedules) > 0 {
+		notationSections = append(notationSections, "schedule="+schedulesToNotation(permission.Schedules))
+	}
+	if permission.QuotaLimit != constants.Unlimited {
+		notationSections = append(notationSections, "q="+strconv.FormatUint(uint64(permission.QuotaLimit), 10))
+	}
+	if permission.Condition != "" {
+		notationSections = append(notationSections, "if="+conditionToNotation(permission.Condition))
+	}
+
+	operationLimitSections := []struct {
+		key       string
+		isGranted bool
+		limits    OperationLimit
+	}{
+		{"c", permission.Create && permission.DenyCreate == false, permission.CreateOperationLimits},
+		{"r", permission.Read && permission.DenyRead == false, permission.ReadOperationLimits},
+		{"u", permission.Update && permission.DenyUpdate == false, permission.UpdateOperationLimits},
+		{"d", permission.Delete && permission.DenyDelete == false, permission.DeleteOperationLimits},
+		{"e", permission.Execute && permission.DenyExecute == false, permission.ExecuteOperationLimits},
+	}
+	for _, operation := range extraOperationDefinitions {
+		operationPermission := permission.Operations[operation.Name]
+		operationLimitSections = append(operationLimitSections, struct {
+			key       string
+			isGranted bool
+			limits    OperationLimit
+		}{operation.Letter, operationPermission.Granted && operationPermission.Denied == false, operationPermission.Limits})
+	}
+	for _, operationLimitSection := range operationLimitSections {
+		if operationLimitSection.isGranted == false {
+			continue
+		}
+		if limitsNotation := operationLimitToNotation(operationLimitSection.limits); limitsNotation != "" {
+			notationSections = append(notationSections, operationLimitSection.key+"="+limitsNotation)
+		}
+	}
+
+	return strings.Join(notationSections, constants.NotationSectionSeparator)
+}
+
+// operationPermissionLetter returns how the operation is written in the operation permission section, its letter if it's granted, "!" and its letter if it's denied, or "-"
+// a denied operation is denied even if it's granted, so only the deny is written
+func operationPermissionLetter(letter string, isGranted bool, isDenied bool) string {
+	switch {
+	case isDenied == true:
+		return "!" + letter
+	case isGranted == true:
+		return letter
+	}
+	return "-"
+}
+
+// NormalizeNotation parses the notation and converts it back to its canonical form, see PermissionToNotation.
+// It's useful for normalizing notations before they are stored, so they can be compared or diffed
+func NormalizeNotation(notation string) (string, error) {
+	permission, err := ParseNotation(notation)
+	if err != nil {
+		return "", err
+	}
+	return PermissionToNotation(permission), nil
+}
+
+// operationLimitToNotation converts the limits that are not the default to the value of an operation limit section e.g "batch:2,hour:5"
+func operationLimitToNotation(operationLimit OperationLimit) string {
+	var limits []string
+	limitValues := []struct {
+		key   string
+		value uint
+	}{
+		{constants.NotationOperationAllTimeLimitKey, operationLimit.AllTimeLimit},
+		{constants.NotationOperationMinuteLimitKey, operationLimit.PerMinuteLimit},
+		{constants.NotationOperationHourLimitKey, operationLimit.PerHourLimit},
+		{constants.NotationOperationDayLimitKey, operationLimit.PerDayLimit},
+		{constants.NotationOperationWeekLimitKey, operationLimit.PerWeekLimit},
+		{constants.NotationOperationFortnightLimitKey, operationLimit.PerFortnightLimit},
+		{constants.NotationOperationMonthLimitKey, operationLimit.PerMonthLimit},
+		{constants.NotationOperationQuarterLimitKey, operationLimit.PerQuarterLimit},
+		{constants.NotationOperationYearLimitKey, operationLimit.PerYearLimit},
+	}
+
+	// batch limit of 1 is the default, so it's left out
+	if operationLimit.getBatchLimit() > 1 {
+		limits = append(limits, constants.NotationOperationBatchLimitKey+constants.NotationOperationLimitAndValueSeparator+strconv.FormatUint(uint64(operationLimit.BatchLimit), 10))
+	}
+
+	for _, limitValue := range limitValues {
+		if limitValue.value == constants.Unlimited {
+			continue
+		}
+		limitKey := limitValue.key
+		if operationLimit.isCalendarWindow(limitKey) {
+			limitKey = limitKey + constants.NotationCalendarAlignedSuffix
+		}
+		limits = append(limits, limitKey+constants.NotationOperationLimitAndValueSeparator+strconv.FormatUint(uint64(limitValue.value), 10))
+	}
+
+	if len(operationLimit.CustomDurationsLimit) > 0 {
+		limits = append(limits, constants.NotationOperationCustomLimitKey+constants.NotationOperationLimitAndValueSeparator+
+			constants.NotationCustomLimitValuePrefix+customDurationLimitsToNotation(operationLimit.CustomDurationsLimit)+constants.NotationCustomLimitValueSuffix)
+	}
+
+	if operationLimit.Location != "" {
+		limits = append(limits, constants.NotationOperationTimeZoneKey+constants.NotationOperationLimitAndValueSeparator+operationLimit.Location)
+	}
+
+	if operationLimit.AnchorDay != 0 {
+		limits = append(limits, constants.NotationOperationAnchorDayKey+constants.NotationOperationLimitAndValueSeparator+strconv.FormatUint(uint64(operationLimit.AnchorDay), 10))
+	}
+
+	return strings.Join(limits, constants.NotationOperationLimitsSeparator)
+}
+
+func customDurationLimitsToNotation(customDurationLimits []CustomDurationLimit) string {
+	var customLimitStrings []string
+	for _, customDurationLimit := range customDurationLimits {
+		customLimitStrings = append(customLimitStrings, customDurationLimit.String())
+	}
+	return strings.Join(customLimitStrings, constants.NotationCustomLimitValueListSeparator)
+}
+
+// splitNotationSections splits the notation with the section separator, keeping the offset of each section
+// separators within parentheses or quotes are not split on, so conditions can use || e.g if=(role=='admin'||role=='owner')
+func splitNotationSections(notation string) []notationSection {
+	var sections []notationSection
+	depth := 0
+	var quote byte
+	sectionStart := 0
+	for i := 0; i < len(notation); i++ {
+		switch {
+		case quote != 0:
+			if notation[i] == quote {
+				quote = 0
+			}
+		case notation[i] == '\'' || notation[i] == '"':
+			quote = notation[i]
+		case notation[i] == '(':
+			depth++
+		case notation[i] == ')' && depth > 0:
+			depth--
+		case strings.HasPrefix(notation[i:], constants.NotationSectionSeparator) && depth == 0:
+			sections = append(sections, notationSection{Value: notation[sectionStart:i], Offset: sectionStart})
+			sectionStart = i + len(constants.NotationSectionSeparator)
+		}
+	}
+	return append(sections, notationSection{Value: notation[sectionStart:], Offset: sectionStart})
+}
+
+// conditionToNotation returns how the condition is written in the if= section, conditions that use || outside parentheses are wrapped in parentheses, since | separates sections
+func conditionToNotation(condition string) string {
+	sections := splitNotationSections(condition)
+	if len(sections) > 1 {
+		return "(" + condition + ")"
+	}
+	return condition
+}
+
+func notationSectionKeys() []string {
+	sectionKeys := []string{"q", "start", "end", "schedule", "if", "c", "r", "u", "d", "e"}
+	for _, operation := range extraOperations() {
+		sectionKeys = append(sectionKeys, operation.Letter)
+	}
+	return sectionKeys
+}
+
+func isNotationSectionKeyValid(sectionKey string) bool {
+	for _, validKey := range notationSectionKeys() {
+		if sectionKey == validKey {
+			return true
+		}
+	}
+	return false
+}
+
+func notationSectionSuggestion(sectionKey string) string {
+	if closestKey := closestMatch(sectionKey, notationSectionKeys()); closestKey != "" {
+		return fmt.Sprintf("did you mean '%s='", closestKey)
+	}
+	return "sections after the first one must start with one of " + strings.Join(notationSectionKeys(), "=, ") + "="
+}
+
+func notationLimitKeys() []string {
+	return []string{
+		constants.NotationOperationBatchLimitKey,
+		constants.NotationOperationAllTimeLimitKey,
+		constants.NotationOperationMinuteLimitKey,
+		constants.NotationOperationHourLimitKey,
+		constants.NotationOperationDayLimitKey,
+		constants.NotationOperationWeekLimitKey,
+		constants.NotationOperationFortnightLimitKey,
+		constants.NotationOperationMonthLimitKey,
+		constants.NotationOperationQuarterLimitKey,
+		constants.NotationOperationYearLimitKey,
+		constants.NotationOperationCustomLimitKey,
+		constants.NotationOperationTimeZoneKey,
+		constants.NotationOperationAnchorDayKey,
+	}
+}
+
+// limitValueRegex matches the value of a limit e.g the 20 of hour:20
+var limitValueRegex = regexp.MustCompile(`^\d+$`)
+
+// customLimitRegex matches a custom limit e.g custom:[per_5_minutes_10&per_2_days_90] , the list can be empty, e.g custom:[]
+// there can't be a 0 value after per_ , we should have per_1_minutes_10 at least
+var customLimitRegex = regexp.MustCompile(`^custom:\[((per_[1-9]\d*_[a-zA-Z]+_\d+\&)+|(per_[1-9]\d*_[a-zA-Z]+_\d+){1})+\]$|^custom:\[\]$`)
+
+// getNotationOperationLimitAndValue receives limit data like "week:5" or "batch:3"
+// The offset of the returned error is relative to the limit data
+func getNotationOperationLimitAndValue(limitData string) (string, uint, *NotationError) {
+	limitType, limitValue, hasSeparator := strings.Cut(limitData, constants.NotationOperationLimitAndValueSeparator)
+	if hasSeparator == false {
+		return "", 0, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: "limits must be written as limit:value e.g hour:20"}
+	}
+
+	isLimitTypeValid := false
+	for _, validLimitType := range notationLimitKeys() {
+		if limitType == validLimitType {
+			isLimitTypeValid = true
+		}
+	}
+	if isLimitTypeValid == false {
+		suggestion := "valid limits are " + strings.Join(notationLimitKeys(), ", ")
+		if closestLimitType := closestMatch(limitType, notationLimitKeys()); closestLimitType != "" {
+			suggestion = fmt.Sprintf("did you mean '%s'", closestLimitType)
+		}
+		return "", 0, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: suggestion}
+	}
+
+	// let's check if the limit value is properly formed
+	// however, it forces batch , to be >=1 to be valid , all other limits can be 0 to denote unlimited
+	if limitValueRegex.MatchString(limitValue) == false {
+		return "", 0, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: fmt.Sprintf("%s must be a whole number, use 0 for unlimited", limitType)}
+	}
+
+	limitValueUintInit, limitValueErr := strconv.ParseUint(limitValue, 10, 64)
+	if limitValueErr != nil {
+		// conversion/parsing was not successful
+		return "", 0, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: fmt.Sprintf("%s is too large", limitType)}
+	}
+	// if we get to this point it means conversion was successful
+	limitValueUint := uint(limitValueUintInit)
+
+	if limitType == constants.NotationOperationBatchLimitKey && limitValueUint < 1 {
+		return "", 0, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: "batch limit can't be unlimited, it must be at least 1"}
+	}
+
+	// if we got to this point , we have validated the limitData to be correct
+	return limitType, limitValueUint, nil
+}
+
+// getNotationOperationCustomLimitValue receives limit data like "custom:[per_5_minutes_10&per_2_month_90]"
+func getNotationOperationCustomLimitValue(limitData string) ([]CustomDurationLimit, *NotationError) {
+	var customLimitList []CustomDurationLimit
+
+	if customLimitRegex.MatchString(limitData) == false {
+		return nil, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: "custom limits must be written as custom:[per_<count>_<duration>_<limit>] and separated with & e.g custom:[per_5_minutes_10&per_2_days_90]"}
+	}
+	// split the limit data since we have verified that its valid
+	_, limitValue, _ := strings.Cut(limitData, constants.NotationOperationLimitAndValueSeparator)
+
+	// remove the value prefix and suffix to denote a list
+	limitValue = strings.TrimPrefix(limitValue, constants.NotationCustomLimitValuePrefix)
+	limitValue = strings.TrimSuffix(limitValue, constants.NotationCustomLimitValueSuffix)
+	if limitValue == "" {
+		return customLimitList, nil
+	}
+
+	for _, customLimitString := range strings.Split(limitValue, constants.NotationCustomLimitValueListSeparator) {
+		customLimit, customLimitErr := parseCustomDurationLimit(customLimitString)
+		if customLimitErr != nil {
+			return nil, &NotationError{Err: ErrMalformedLimit, Token: limitData, Suggestion: customLimitErr.Error()}
+		}
+		customLimitList = append(customLimitList, customLimit)
+	}
+
+	return customLimitList, nil
+}
+
+// getNotationOperationLimits receives the value of an operation limit section e.g "batch:2,hour:5" and returns the OperationLimit
+// The offset of the returned error is relative to the operationLimitsString
+func getNotationOperationLimits(operationLimitsString string) (OperationLimit, *NotationError) {
+	var currentOperationLimit OperationLimit
+	seenLimits := make(map[string]bool)
+
+	// loop through the limits
+	// if any of the limits or its value is invalid, return error
+	offset := 0
+	for _, currentLimitData := range strings.Split(operationLimitsString, constants.NotationOperationLimitsSeparator) {
+		currentOffset := offset
+		offset = offset + len(currentLimitData) + len(constants.NotationOperationLimitsSeparator)
+		// allow a trailing separator e.g batch:2,
+		if currentLimitData == "" {
+			continue
+		}
+
+		currentLimitType, currentLimitString, _ := strings.Cut(currentLimitData, constants.NotationOperationLimitAndValueSeparator)
+		baseLimitType, isCalendarAligned := strings.CutSuffix(currentLimitType, constants.NotationCalendarAlignedSuffix)
+		if seenLimits[baseLimitType] == true {
+			return OperationLimit{}, &NotationError{Err: ErrMalformedLimit, Token: currentLimitData, Offset: currentOffset, Suggestion: fmt.Sprintf("'%s' is set more than once", baseLimitType)}
+		}
+		seenLimits[baseLimitType] = true
+
+		if currentLimitType == constants.NotationOperationCustomLimitKey {
+			customLimitSlice, customLimitErr := getNotationOperationCustomLimitValue(currentLimitData)
+			if customLimitErr != nil {
+				customLimitErr.Offset = customLimitErr.Offset + currentOffset
+				return OperationLimit{}, customLimitErr
+			}
+			currentOperationLimit.CustomDurationsLimit = customLimitSlice
+			continue
+		}
+
+		// time zone calendar windows are aligned in e.g tz:Europe/Paris
+		if currentLimitType == constants.NotationOperationTimeZoneKey {
+			if _, locationErr := time.LoadLocation(currentLimitString); currentLimitString == "" || locationErr != nil {
+				return OperationLimit{}, &NotationError{Err: ErrMalformedLimit, Token: currentLimitData, Offset: currentOffset, Suggestion: "tz must be an IANA time zone name e.g tz:Europe/Paris"}
+			}
+			currentOperationLimit.Location = currentLimitString
+			continue
+		}
+
+		// billing cycle day of the month calendar windows start on e.g anchor:15
+		if currentLimitType == constants.NotationOperationAnchorDayKey {
+			anchorDay, anchorDayErr := stringToPositiveIntegerOrZero(currentLimitString)
+			if anchorDayErr != nil || anchorDay < 1 || anchorDay > 31 {
+				return OperationLimit{}, &NotationError{Err: ErrMalformedLimit, Token: currentLimitData, Offset: currentOffset, Suggestion: "anchor must be a day of the month between 1 and 31 e.g anchor:15"}
+			}
+			currentOperationLimit.AnchorDay = anchorDay
+			continue
+		}
+
+		// calendar aligned limits e.g month@cal:1000
+		if isCalendarAligned == true && slices.Contains(calendarWindowKeys, baseLimitType) == false {
+			return OperationLimit{}, &NotationError{Err: ErrMalformedLimit, Token: currentLimitData, Offset: currentOffset, Suggestion: fmt.Sprintf("only %s limits can be aligned to the calendar", strings.Join(calendarWindowKeys, ", "))}
+		}
+
+		// for other limits
+		_, currentLimitValue, currentLimitErr := getNotationOperationLimitAndValue(baseLimitType + constants.NotationOperationLimitAndValueSeparator + currentLimitString)
+		if currentLimitErr != nil {
+			currentLimitErr.Token = currentLimitData
+			currentLimitErr.Offset = currentLimitErr.Offset + currentOffset
+			return OperationLimit{}, currentLimitErr
+		}
+		currentOperationLimit.setNotationLimit(baseLimitType, currentLimitValue)
+		if isCalendarAligned == true && currentLimitValue != constants.Unlimited {
+			currentOperationLimit.CalendarWindows = append(currentOperationLimit.CalendarWindows, baseLimitType)
+		}
+	}
+
+	// keep calendar windows in a stable order, so they can be compared
+	slices.SortFunc(currentOperationLimit.CalendarWindows, func(a string, b string) int {
+		return slices.Index(calendarWindowKeys, a) - slices.Index(calendarWindowKeys, b)
+	})
+
+	return currentOperationLimit, nil
+}
+
+// setNotationLimit sets the limit that corresponds to the notation limit key e.g "hour" sets PerHourLimit
+func (operationLimit *OperationLimit) setNotationLimit(limitType string, limitValue uint) {
+	switch limitType {
+	case constants.NotationOperationBatchLimitKey:
+		operationLimit.BatchLimit = limitValue
+		operationLimit.BatchLimit = operationLimit.getBatchLimit() //forces the default limit to be 1 , if this value is 0, because batch limit can't be 0
+	case constants.NotationOperationAllTimeLimitKey:
+		operationLimit.AllTimeLimit = limitValue
+	case constants.NotationOperationMinuteLimitKey:
+		operationLimit.PerMinuteLimit = limitValue
+	case constants.NotationOperationHourLimitKey:
+		operationLimit.PerHourLimit = limitValue
+	case constants.NotationOperationDayLimitKey:
+		operationLimit.PerDayLimit = limitValue
+	case constants.NotationOperationWeekLimitKey:
+		operationLimit.PerWeekLimit = limitValue
+	case constants.NotationOperationFortnightLimitKey:
+		operationLimit.PerFortnightLimit = limitValue
+	case constants.NotationOperationMonthLimitKey:
+		operationLimit.PerMonthLimit = limitValue
+	case constants.NotationOperationQuarterLimitKey:
+		operationLimit.PerQuarterLimit = limitValue
+	case constants.NotationOperationYearLimitKey:
+		operationLimit.PerYearLimit = limitValue
+	}
+}
+
+// notationLimit returns the limit that corresponds to the notation limit key e.g "hour" returns PerHourLimit, it's the opposite of setNotationLimit
+func (operationLimit OperationLimit) notationLimit(limitType string) uint {
+	switch limitType {
+	case constants.NotationOperationBatchLimitKey:
+		return operationLimit.getBatchLimit()
+	case constants.NotationOperationAllTimeLimitKey:
+		return operationLimit.AllTimeLimit
+	case constants.NotationOperationMinuteLimitKey:
+		return operationLimit.PerMinuteLimit
+	case constants.NotationOperationHourLimitKey:
+		return operationLimit.PerHourLimit
+	case constants.NotationOperationDayLimitKey:
+		return operationLimit.PerDayLimit
+	case constants.NotationOperationWeekLimitKey:
+		return operationLimit.PerWeekLimit
+	case constants.NotationOperationFortnightLimitKey:
+		return operationLimit.PerFortnightLimit
+	case constants.NotationOperationMonthLimitKey:
+		return operationLimit.PerMonthLimit
+	case constants.NotationOperationQuarterLimitKey:
+		return operationLimit.PerQuarterLimit
+	case constants.NotationOperationYearLimitKey:
+		return operationLimit.PerYearLimit
+	}
+	return constants.Unlimited
+}
+
+// removeAllWhiteSpacesWithOffsets works like removeAllWhiteSpaces, but also returns the offset of every remaining character in the original string
+func removeAllWhiteSpacesWithOffsets(s string) (string, []int) {
+	var stripped strings.Builder
+	var offsets []int
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\n' || s[i] == '\r' || s[i] == '\t' {
+			continue
+		}
+		stripped.WriteByte(s[i])
+		offsets = append(offsets, i)
+	}
+	return stripped.String(), offsets
+}
+
+// closestMatch returns the option that is closest to s, if it's close enough to be a likely typo, else it returns an empty string
+func closestMatch(s string, options []string) string {
+	closest := ""
+	closestDistance := 3
+	for _, option := range options {
+		distance := levenshteinDistance(strings.ToLower(s), option)
+		if distance < closestDistance {
+			closest = option
+			closestDistance = distance
+		}
+	}
+	return closest
+}
+
+func levenshteinDistance(a string, b string) int {
+	previousRow := make([]int, len(b)+1)
+	currentRow := make([]int, len(b)+1)
+	for j := range previousRow {
+		previousRow[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		currentRow[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			currentRow[j] = min(previousRow[j]+1, currentRow[j-1]+1, previousRow[j-1]+cost)
+		}
+		previousRow, currentRow = currentRow, previousRow
+	}
+	return previousRow[len(b)]
+}
@@ -0,0 +1,234 @@
+package permitta
+
+import (
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// OperationDefinition describes an operation that can be permitted, e.g the crude operations, or a domain verb like share, export, approve or publish registered with RegisterOperation
+type OperationDefinition struct {
+	Name string // e.g "share"
+	// Letter is the one letter code of the operation in notation e.g "s" , it's used in the operation permission section e.g cruds and for the limit section of the operation e.g s=batch:5
+	Letter string
+	// QuotaEffect is how the operation changes the QuotaUsage, constants.QuotaEffectNone, constants.QuotaEffectIncrease like create, or constants.QuotaEffectDecrease like delete
+	// The quota limit is only checked for operations that increase the quota usage
+	QuotaEffect int
+}
+
+// OperationPermission is the permission of a registered operation that is not one of the crude operations, see Permission.Operations
+type OperationPermission struct {
+	Granted bool           `json:"granted"`
+	Denied  bool           `json:"denied,omitempty"` // explicitly denies the operation, see Permission.DenyCreate
+	Limits  OperationLimit `json:"limits"`
+}
+
+// operationNameRegex is used to validate the names of registered operations
+var operationNameRegex = regexp.MustCompile(`^[a-z][a-z_]*$`)
+
+// crudeOperations are the operations that are always registered, in crude order
+var crudeOperations = []OperationDefinition{
+	{Name: constants.OperationCreate, Letter: "c", QuotaEffect: constants.QuotaEffectIncrease},
+	{Name: constants.OperationRead, Letter: "r", QuotaEffect: constants.QuotaEffectNone},
+	{Name: constants.OperationUpdate, Letter: "u", QuotaEffect: constants.QuotaEffectNone},
+	{Name: constants.OperationDelete, Letter: "d", QuotaEffect: constants.QuotaEffectDecrease},
+	{Name: constants.OperationExecute, Letter: "e", QuotaEffect: constants.QuotaEffectNone},
+}
+
+// operations is the registry of the operations that can be permitted
+var operations = struct {
+	sync.RWMutex
+	byName   map[string]OperationDefinition
+	byLetter map[string]OperationDefinition
+	extra    []OperationDefinition // the registered operations that are not crude operations, sorted by letter
+	// sectionRegex matches the operation permission section of a notation e.g cr-!d- , with the letters of the registered operations, it's compiled again whenever an operation is registered
+	sectionRegex *regexp.Regexp
+}{
+	byName:       make(map[string]OperationDefinition),
+	byLetter:     make(map[string]OperationDefinition),
+	sectionRegex: compileOperationSectionRegex(nil),
+}
+
+func init() {
+	for _, operation := range crudeOperations {
+		operations.byName[operation.Name] = operation
+		operations.byLetter[operation.Letter] = operation
+	}
+}
+
+// RegisterOperation adds an operation e.g OperationDefinition{Name: "share", Letter: "s"} to the operations that can be permitted, it's meant to be called at startup, registering the same definition again does nothing
+// The name must be lowercase letters or underscores, and the letter must be a lowercase letter that is not used by another operation, or by the quota section "q"
+func RegisterOperation(operation OperationDefinition) error {
+	if operationNameRegex.MatchString(operation.Name) == false {
+		return fmt.Errorf("invalid operation name '%s', it must be lowercase letters or underscores", operation.Name)
+	}
+	if len(operation.Letter) != 1 || operation.Letter[0] < 'a' || operation.Letter[0] > 'z' || operation.Letter == "q" {
+		return fmt.Errorf("invalid letter '%s' for operation %s, it must be one lowercase letter other than 'q'", operation.Letter, operation.Name)
+	}
+	if operation.QuotaEffect != constants.QuotaEffectNone && operation.QuotaEffect != constants.QuotaEffectIncrease && operation.QuotaEffect != constants.QuotaEffectDecrease {
+		return fmt.Errorf("invalid quota effect %d for operation %s", operation.QuotaEffect, operation.Name)
+	}
+
+	operations.Lock()
+	defer operations.Unlock()
+	if existingOperation, isNameUsed := operations.byName[operation.Name]; isNameUsed {
+		// registering the same definition again does nothing, like RegisterEntityType
+		if existingOperation == operation {
+			return nil
+		}
+		return fmt.Errorf("operation %s is already registered", operation.Name)
+	}
+	if existingOperation, isLetterUsed := operations.byLetter[operation.Letter]; isLetterUsed {
+		return fmt.Errorf("letter '%s' is already used by operation %s", operation.Letter, existingOperation.Name)
+	}
+
+	operations.byName[operation.Name] = operation
+	operations.byLetter[operation.Letter] = operation
+	operations.extra = append(operations.extra, operation)
+	slices.SortFunc(operations.extra, func(a, b OperationDefinition) int {
+		return strings.Compare(a.Letter, b.Letter)
+	})
+	operations.sectionRegex = compileOperationSectionRegex(operations.extra)
+	return nil
+}
+
+// compileOperationSectionRegex compiles the regex of the operation permission section, the letters of the registered operations that are not crude operations can follow the crude letters in any order, each optionally prefixed with "!"
+func compileOperationSectionRegex(extraOperations []OperationDefinition) *regexp.Regexp {
+	extraOperationLetters := ""
+	for _, operation := range extraOperations {
+		extraOperationLetters += operation.Letter
+	}
+	extraOperationsPattern := ""
+	if extraOperationLetters != "" {
+		extraOperationsPattern = "((?:!?[" + extraOperationLetters + "])*)"
+	}
+	return regexp.MustCompile(`^([c-]|!c)([r-]|!r)([u-]|!u)([d-]|!d)([e-]|!e)` + extraOperationsPattern + `$`)
+}
+
+// operationSectionRegex returns the regex of the operation permission section for the registered operations, see compileOperationSectionRegex
+func operationSectionRegex() *regexp.Regexp {
+	operations.RLock()
+	defer operations.RUnlock()
+	return operations.sectionRegex
+}
+
+// LookupOperation returns the definition of a registered operation
+func LookupOperation(name string) (OperationDefinition, bool) {
+	operations.RLock()
+	defer operations.RUnlock()
+	operation, isRegistered := operations.byName[name]
+	return operation, isRegistered
+}
+
+// lookupOperationLetter returns the definition of the registered operation with the notation letter
+func lookupOperationLetter(letter string) (OperationDefinition, bool) {
+	operations.RLock()
+	defer operations.RUnlock()
+	operation, isRegistered := operations.byLetter[letter]
+	return operation, isRegistered
+}
+
+// extraOperations returns the registered operations that are not crude operations, sorted by letter
+func extraOperations() []OperationDefinition {
+	operations.RLock()
+	defer operations.RUnlock()
+	return slices.Clone(operations.extra)
+}
+
+// isCrudeOperation reports if the operation is one of create, read, update, delete and execute, which have their own fields in Permission and PermissionUsage
+func isCrudeOperation(operation string) bool {
+	return slices.ContainsFunc(crudeOperations, func(crudeOperation OperationDefinition) bool {
+		return crudeOperation.Name == operation
+	})
+}
+
+// operationQuotaEffect returns how the operation changes the QuotaUsage, see OperationDefinition.QuotaEffect
+func operationQuotaEffect(operation string) int {
+	operationDefinition, _ := LookupOperation(operation)
+	return operationDefinition.QuotaEffect
+}
+
+// isOperationGranted reports if the permission grants the operation, it doesn't consider explicit denies, see isOperationDenied
+func isOperationGranted(operation string, permission Permission) bool {
+	switch operation {
+	case constants.OperationCreate:
+		return permission.Create
+	case constants.OperationRead:
+		return permission.Read
+	case constants.OperationUpdate:
+		return permission.Update
+	case constants.OperationDelete:
+		return permission.Delete
+	case constants.OperationExecute:
+		return permission.Execute
+	}
+	return permission.Operations[operation].Granted
+}
+
+// isOperationDenied reports if the permission explicitly denies the operation
+func isOperationDenied(operation string, permission Permission) bool {
+	switch operation {
+	case constants.OperationCreate:
+		return permission.DenyCreate
+	case constants.OperationRead:
+		return permission.DenyRead
+	case constants.OperationUpdate:
+		return permission.DenyUpdate
+	case constants.OperationDelete:
+		return permission.DenyDelete
+	case constants.OperationExecute:
+		return permission.DenyExecute
+	}
+	return permission.Operations[operation].Denied
+}
+
+// getOperationUsage returns the usage of the operation as it's stored, unlike GetOperationUsages it's not sanitized
+func getOperationUsage(operation string, usage PermissionUsage) OperationUsage {
+	switch operation {
+	case constants.OperationCreate:
+		return usage.CreateOperationUsages
+	case constants.OperationRead:
+		return usage.ReadOperationUsages
+	case constants.OperationUpdate:
+		return usage.UpdateOperationUsages
+	case constants.OperationDelete:
+		return usage.DeleteOperationUsages
+	case constants.OperationExecute:
+		return usage.ExecuteOperationUsages
+	}
+	operationUsage := usage.OperationUsages[operation]
+	if usage.SlidingWindow == true {
+		operationUsage.SlidingWindow = true
+	}
+	return operationUsage
+}
+
+// setOperationUsage sets the usage of the operation, OperationUsages is copied before it's changed, since the caller may share it
+func setOperationUsage(operation string, usage *PermissionUsage, operationUsage OperationUsage) {
+	switch operation {
+	case constants.OperationCreate:
+		usage.CreateOperationUsages = operationUsage
+	case constants.OperationRead:
+		usage.ReadOperationUsages = operationUsage
+	case constants.OperationUpdate:
+		usage.UpdateOperationUsages = operationUsage
+	case constants.OperationDelete:
+		usage.DeleteOperationUsages = operationUsage
+	case constants.OperationExecute:
+		usage.ExecuteOperationUsages = operationUsage
+	default:
+		operationUsages := maps.Clone(usage.OperationUsages)
+		if operationUsages == nil {
+			operationUsages = make(map[string]OperationUsage)
+		}
+		if usage.SlidingWindow == true {
+			operationUsage.SlidingWindow = true
+		}
+		operationUsages[operation] = operationUsage
+		usage.OperationUsages = operationUsages
+	}
+}
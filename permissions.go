@@ -5,7 +5,7 @@ import (
 	"fmt"
 	constants "github.com/limitlessdonald/permitta/constants"
 	"reflect"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,26 +28,49 @@ type Permission struct {
 	Update     bool `json:"update"`
 	Delete     bool `json:"delete"`
 	Execute    bool `json:"execute"`
+	// DenyCreate, DenyRead, DenyUpdate, DenyDelete and DenyExecute explicitly deny an operation, which is stronger than not granting it e.g a user can deny an operation their role grants
+	// If an operation is both granted and denied, it's denied. How explicit denies of different entities are combined depends on PermissionRequestData.CombiningAlgorithm
+	DenyCreate  bool `json:"denyCreate,omitempty"`
+	DenyRead    bool `json:"denyRead,omitempty"`
+	DenyUpdate  bool `json:"denyUpdate,omitempty"`
+	DenyDelete  bool `json:"denyDelete,omitempty"`
+	DenyExecute bool `json:"denyExecute,omitempty"`
+
+	// Schedules are recurring windows e.g from Monday to Friday, 08:00 to 18:00, the permission is only in effect within one of them, and at any time if there are none, see Schedule
+	Schedules []Schedule `json:"schedules,omitempty"`
 
 	CreateOperationLimits  OperationLimit `json:"createOperationLimits"`
 	ReadOperationLimits    OperationLimit `json:"readOperationLimits"`
 	UpdateOperationLimits  OperationLimit `json:"updateOperationLimits"`
 	DeleteOperationLimits  OperationLimit `json:"deleteOperationLimits"`
 	ExecuteOperationLimits OperationLimit `json:"executeOperationLimits"`
+
+	// Operations holds the permission of registered operations that are not crude operations, keyed by operation name e.g "share", see RegisterOperation
+	Operations map[string]OperationPermission `json:"operations,omitempty"`
+
+	// Condition is an expression that must be true for the permission to grant anything e.g resource.owner == subject.id , it's evaluated with PermissionRequestData.Context, see ParseCondition
+	// If it's false, the permission doesn't apply and operations are denied with constants.ReasonConditionNotMet. If it can't be evaluated e.g it uses a variable that is not in the context, operations are denied with constants.ReasonConditionError
+	Condition string `json:"condition,omitempty"`
 }
 
 type OperationLimit struct {
-	BatchLimit           uint     `json:"batchLimit"`   // Can be used to limit how many of an item can be deleted at once, or at a time, for example limiting a user to adding 5 files at once . If this value is 5, the user won't be able to delete more than 5 items at once. Batch can't be 0 which denotes unlimited, it has to be 1 or above, the default value if not set won't be 0, but 1
-	AllTimeLimit         uint     `json:"allTimeLimit"` // Can be used to control how many of an item can be created all Time
-	PerMinuteLimit       uint     `json:"perMinuteLimit"`
-	PerHourLimit         uint     `json:"perHourLimit"`
-	PerDayLimit          uint     `json:"perDayLimit"`
-	PerWeekLimit         uint     `json:"perWeekLimit"`
-	PerFortnightLimit    uint     `json:"perFortnightLimit"` //to limit items that can be deleted every two weeks
-	PerMonthLimit        uint     `json:"perMonthLimit"`     // Limit for every 30 days from FirstDeleteTime  //todo, does it make sense to use FirstDeleteTime or LastDeleteTime
-	PerQuarterLimit      uint     `json:"perQuarterLimit"`   // 3 months, 90 days
-	PerYearLimit         uint     `json:"perYearLimit"`
-	CustomDurationsLimit []string `json:"customDurationsLimit"`
+	BatchLimit           uint                  `json:"batchLimit"`   // Can be used to limit how many of an item can be deleted at once, or at a time, for example limiting a user to adding 5 files at once . If this value is 5, the user won't be able to delete more than 5 items at once. Batch can't be 0 which denotes unlimited, it has to be 1 or above, the default value if not set won't be 0, but 1
+	AllTimeLimit         uint                  `json:"allTimeLimit"` // Can be used to control how many of an item can be created all Time
+	PerMinuteLimit       uint                  `json:"perMinuteLimit"`
+	PerHourLimit         uint                  `json:"perHourLimit"`
+	PerDayLimit          uint                  `json:"perDayLimit"`
+	PerWeekLimit         uint                  `json:"perWeekLimit"`
+	PerFortnightLimit    uint                  `json:"perFortnightLimit"` //to limit items that can be deleted every two weeks
+	PerMonthLimit        uint                  `json:"perMonthLimit"`     // Limit for every 30 days from FirstDeleteTime  //todo, does it make sense to use FirstDeleteTime or LastDeleteTime
+	PerQuarterLimit      uint                  `json:"perQuarterLimit"`   // 3 months, 90 days
+	PerYearLimit         uint                  `json:"perYearLimit"`
+	CustomDurationsLimit []CustomDurationLimit `json:"customDurationsLimit"` // e.g 67 operations every 32 seconds, stored in json as strings like "per_32_seconds_67"
+
+	// CalendarWindows holds the notation limit keys e.g "month" of the limits that reset at calendar boundaries, e.g on the 1st of every month, instead of rolling from the last operation time
+	// minute, hour, day, week (starting on Monday), month, quarter and year limits can be aligned to the calendar
+	CalendarWindows []string `json:"calendarWindows,omitempty"`
+	Location        string   `json:"location,omitempty"`  // IANA time zone name e.g "Europe/Paris" calendar windows are aligned in, UTC if empty
+	AnchorDay       uint     `json:"anchorDay,omitempty"` // billing cycle day of the month, monthly, quarterly and yearly calendar windows start on, the 1st if 0
 }
 
 // getBatchLimit is useful for setting the default batch limit to 1 if its 0, because batch limit can't be unlimited
@@ -67,19 +90,23 @@ func (operationLimit *OperationLimit) setDefaultLimits() {
 }
 
 type OperationUsage struct {
-	FirstTime                    time.Time `json:"firstTime"`
-	LastTime                     time.Time `json:"lastTime"`
-	LastQuantity                 uint      `json:"lastQuantity"`
-	AllTime                      uint      `json:"allTime"`
-	WithinTheLastMinute          uint      `json:"withinTheLastMinute"`
-	WithinTheLastHour            uint      `json:"withinTheLastHour"`
-	WithinTheLastDay             uint      `json:"withinTheLastDay"`
-	WithinTheLastWeek            uint      `json:"withinTheLastWeek"`
-	WithinTheLastFortnight       uint      `json:"withinTheLastFortnight"`
-	WithinTheLastMonth           uint      `json:"withinTheLastMonth"`
-	WithinTheLastQuarter         uint      `json:"withinTheLastQuarter"`
-	WithinTheLastYear            uint      `json:"withinTheLastYear"`
-	WithinTheLastCustomDurations []string  `json:"withinTheLastCustomDurations"`
+	FirstTime                    time.Time            `json:"firstTime"`
+	LastTime                     time.Time            `json:"lastTime"`
+	LastQuantity                 uint                 `json:"lastQuantity"`
+	AllTime                      uint                 `json:"allTime"`
+	WithinTheLastMinute          uint                 `json:"withinTheLastMinute"`
+	WithinTheLastHour            uint                 `json:"withinTheLastHour"`
+	WithinTheLastDay             uint                 `json:"withinTheLastDay"`
+	WithinTheLastWeek            uint                 `json:"withinTheLastWeek"`
+	WithinTheLastFortnight       uint                 `json:"withinTheLastFortnight"`
+	WithinTheLastMonth           uint                 `json:"withinTheLastMonth"`
+	WithinTheLastQuarter         uint                 `json:"withinTheLastQuarter"`
+	WithinTheLastYear            uint                 `json:"withinTheLastYear"`
+	WithinTheLastCustomDurations CustomDurationUsages `json:"withinTheLastCustomDurations"`
+
+	// SlidingWindow turns on the accurate sliding window mode, see OperationUsage.EnableSlidingWindows
+	SlidingWindow        bool                            `json:"slidingWindow,omitempty"`
+	SlidingWindowBuckets map[string]SlidingWindowBuckets `json:"slidingWindowBuckets,omitempty"` // keyed by the notation limit key e.g "hour", or CustomDurationLimit.Key() for custom durations
 }
 
 // sanitizeDurationUsage is a setter to  "sanitize" value of the usage durations
@@ -88,8 +115,20 @@ type OperationUsage struct {
 // Take this case scenario , I have a limit of 5 files per minute , if I created/used 5 files within a minute, 2 days ago and the usage has not been updated since then and I have not created any file since 2 days
 // the usage record would definitely still be 5, and I won't be allowed access , so we want to check LastTime and compare it with operation request time, which is time.Now() , because the usage listed here, may have "expired" and we are no longer in the window of that duration
 // in this specific case of "WithinMinute", if a minute has exceeded we need to reset the WithinTheLastXDuration usage
-func (operationUsage *OperationUsage) sanitizeDurationUsage() {
-	durationDiff := time.Now().Sub(operationUsage.LastTime)
+// now is the operation request time, it's passed in so the same time is used for every check of a request, see PermissionRequestData.Clock
+//
+// In sliding window mode, the usages are computed from the sliding window buckets instead, so they hold exactly what happened within each trailing window
+// Usages of windows in operationLimits.CalendarWindows are only reset when a calendar boundary has passed since the LastTime
+func (operationUsage *OperationUsage) sanitizeDurationUsage(operationLimits OperationLimit, now time.Time) {
+	unsanitizedUsage := *operationUsage
+	defer operationUsage.sanitizeCalendarWindows(unsanitizedUsage, operationLimits, now)
+
+	if operationUsage.SlidingWindow == true && len(operationUsage.SlidingWindowBuckets) > 0 {
+		operationUsage.applySlidingWindows(now)
+		return
+	}
+
+	durationDiff := now.Sub(operationUsage.LastTime)
 	// let's start with within the last minute
 
 	// if a minute has passed since the lastTime, reset the usage
@@ -125,7 +164,7 @@ func (operationUsage *OperationUsage) sanitizeDurationUsage() {
 		operationUsage.WithinTheLastYear = 0
 	}
 
-	//todo custom durations  operationUsage  sanitization
+	operationUsage.WithinTheLastCustomDurations = sanitizeCustomDurationUsages(operationUsage.WithinTheLastCustomDurations, durationDiff)
 
 }
 
@@ -136,6 +175,9 @@ type PermissionUsage struct {
 	UpdateOperationUsages  OperationUsage
 	DeleteOperationUsages  OperationUsage
 	ExecuteOperationUsages OperationUsage
+	OperationUsages        map[string]OperationUsage `json:"operationUsages,omitempty"` // usage of registered operations that are not crude operations, keyed by operation name
+	// SlidingWindow is set by PermissionUsage.EnableSlidingWindows, so the usages of registered operations that aren't in OperationUsages yet are in sliding window mode too, once they are added
+	SlidingWindow bool `json:"slidingWindow,omitempty"`
 }
 
 // PermissionRequestData is a struct that holds data concerning the permission request . It includes things like users,roles,groups,operation(constants.OperationCreate|constants.OperationRead....) etc. necessary to help get permission status
@@ -147,6 +189,21 @@ type PermissionRequestData struct {
 	DomainEntityPermissions Permission
 	OrgEntityPermissions    Permission //Organization EntityPermissions
 	EntityPermissionOrder   string     // the flow in which the permission should take e.g org->domain->group->role->user //default order is org->
+	// Entities holds the permission and usage of entities of any registered type, see RegisterEntityType. If an entity type is in Entities, the entity field above e.g UserEntityPermissions is ignored for it
+	// If EntityPermissionOrder is empty, the entities are checked in the order they are in Entities
+	Entities []Entity
+	// CombiningRules holds how the decisions of multiple entities of the same type e.g several roles are combined, keyed by entity type
+	// The rule is any of constants.CombiningRuleAllOf, constants.CombiningRuleAnyOf or constants.CombiningRuleFirstApplicable, constants.CombiningRuleAllOf is used for entity types that are not in it
+	CombiningRules map[string]string
+	// Resource is the name of the resource the operation is performed on e.g files, it's used to get the permission and usage of entities that have a Policy, see Entity.Policy
+	Resource string
+	// CombiningAlgorithm holds how the decisions of the entity types in the EntityPermissionOrder are combined, it's any of
+	// constants.CombiningAlgorithmStrictHierarchy (default), constants.CombiningAlgorithmDenyOverrides or constants.CombiningAlgorithmPermitOverrides
+	CombiningAlgorithm string
+	// Clock tells the time the permissions are checked at, the real time is used if it's nil, see FakeClock
+	Clock Clock
+	// Context holds the attributes the Condition of each permission is evaluated with e.g {"subject": {"id": "42", "mfa": true}, "resource": {"owner": "42"}, "request": {"ip": "10.1.2.3"}}
+	Context map[string]any
 }
 
 // PermissionWithUsageRequestData to hold permission data and also check permission against usage and limits, so if operationQuantity + usage exceeds limit, deny access, but if its less or equal to grant access, hope you get the gist
@@ -160,326 +217,312 @@ type PermissionWithUsageRequestData struct {
 	OrgEntityUsage    PermissionUsage
 }
 
-func IsOperationPermitted(permissionRequestData PermissionRequestData) bool {
-	operation := permissionRequestData.Operation
-	permissionOrder := getEntityPermissionOrder(permissionRequestData.EntityPermissionOrder)
-	var permissions Permission
+// Decision is the result of a permission check. When an operation is denied, it describes which entity in the EntityPermissionOrder denied it and why
+// For limit related denials, Limit, Usage and Quantity hold the values that were compared, so the caller can give useful feedback to its own users
+type Decision struct {
+	Allowed  bool   `json:"allowed"`
+	Entity   string `json:"entity,omitempty"`   // the entity that denied the operation e.g constants.EntityOrg
+	Reason   string `json:"reason,omitempty"`   // why the operation was denied e.g constants.ReasonBatchLimitExceeded
+	Limit    uint   `json:"limit,omitempty"`    // the value of the limit that was exceeded
+	Usage    uint   `json:"usage,omitempty"`    // the current usage for the limit that was exceeded
+	Quantity uint   `json:"quantity,omitempty"` // the operation quantity that was requested
+	Window   string `json:"window,omitempty"`   // the custom duration, for constants.ReasonCustomDurationLimitExceeded e.g "32s"
+	// NextOpen is when the next schedule window of the permission opens, for constants.ReasonOutsideSchedule , it's nil for every other decision, so it's left out of the json
+	NextOpen *time.Time `json:"nextOpen,omitempty"`
+}
 
-	// only allow CRUDE(Create, Read, Update, Delete,Execute) operations
-	if isOperationValid(operation) == false {
-		fmt.Println("Invalid operation")
-		return false
+// String returns a human friendly description of the decision
+func (decision Decision) String() string {
+	if decision.Allowed == true {
+		return "operation permitted"
 	}
 
-	// if the EntityPermissionOrder and all the entity permissions are empty, but a operation is provided, we can just assume that we are checking permission for a user entity , this enables simple permission checks without writing too much code
-
-	// if at this point permissionOrder is empty , it means invalid entities were used
-	if len(permissionOrder) < 1 {
-		fmt.Println("Entity permission order is invalid")
+	message := "operation denied"
+	if decision.Entity != "" {
+		message = message + " by " + decision.Entity + " entity"
+	}
+	if decision.Reason != "" {
+		message = message + " : " + decision.Reason
+	}
+	if decision.Limit != 0 {
+		message = message + fmt.Sprintf(" (limit %d, usage %d, quantity %d)", decision.Limit, decision.Usage, decision.Quantity)
+	}
+	if decision.NextOpen != nil {
+		message = message + " (opens at " + decision.NextOpen.Format(time.RFC3339) + ")"
 	}
 
-	if len(permissionOrder) > 0 {
-		//loop through the split order and check permission for each entity as arranged in the order
-		for i := 0; i < len(permissionOrder); i++ {
-			currentEntity := permissionOrder[i]
-
-			permissions = getEntityPermission(currentEntity, permissionRequestData)
+	return message
+}
 
-			isCurrentEntityOperationPermitted := IsEntityOperationPermitted(operation, permissions)
-			if isCurrentEntityOperationPermitted == false {
+func deniedDecision(entity string, reason string) Decision {
+	return Decision{Entity: entity, Reason: reason}
+}
 
-				return false
-			}
+func limitExceededDecision(entity string, reason string, limit uint, usage uint, quantity uint) Decision {
+	return Decision{Entity: entity, Reason: reason, Limit: limit, Usage: usage, Quantity: quantity}
+}
 
-			// if all checks passed up till this point , that means permission is granted for this entity , so continue to the next entity,
-			// but if the entity we just ran check for is the last entity, then it means permission is granted , else continue to next entity
-			if i == len(permissionOrder)-1 {
-				// this is the last entity in the order
-				// this means all checks in the last entity went well if we got to this point
-				return true
+// IsOperationPermitted checks if the operation is permitted for every entity in the PermissionRequestData.EntityPermissionOrder
+// It is a thin wrapper around CheckOperation, use CheckOperation if you need to know why an operation was denied
+func IsOperationPermitted(permissionRequestData PermissionRequestData) bool {
+	return CheckOperation(permissionRequestData).Allowed
+}
 
-			} else {
-				// this means current entity checks went well, but we are not in the last entity in the order yet, so let's move to the next entity to check if limits are not exceeded
-				continue
-			}
+// CheckOperation checks if the operation is permitted for every entity in the PermissionRequestData.EntityPermissionOrder, and returns a Decision describing the result
+func CheckOperation(permissionRequestData PermissionRequestData) Decision {
+	operation := permissionRequestData.Operation
 
-		}
+	// only allow CRUDE(Create, Read, Update, Delete,Execute) operations
+	if isOperationValid(operation) == false {
+		decision := deniedDecision("", constants.ReasonInvalidOperation)
+		logDecision(operation, decision)
+		return decision
 	}
 
-	return false
+	// if the EntityPermissionOrder and all the entity permissions are empty, but a operation is provided, we can just assume that we are checking permission for a user entity , this enables simple permission checks without writing too much code
+
+	now := permissionRequestData.now()
+	decision, _ := checkEntityLevels(PermissionWithUsageRequestData{PermissionRequestData: permissionRequestData}, now, func(entity Entity) Decision {
+		return checkEntityOperation(operation, entity.Permission, now)
+	})
+	logDecision(operation, decision)
+	return decision
 }
 
 //todo [LATER] optimise this function , its looping through the permissions twice
 
 // IsOperationPermittedWithUsage is a function to check if operation is permitted, then it checks the usage following the PermissionRequestData.EntityPermissionOrder
-// It loops through each entity in the order and checks permission against request usage + operationQuantity for each OperationLimit
+// It is a thin wrapper around CheckOperationWithUsage, use CheckOperationWithUsage if you need to know why an operation was denied
 func IsOperationPermittedWithUsage(requestData PermissionWithUsageRequestData) bool {
-	operationQuantity := requestData.OperationQuantity
-	var operationLimits OperationLimit
-	var operationUsage OperationUsage
-	var entityPermissions Permission
-	var entityUsage PermissionUsage
+	return CheckOperationWithUsage(requestData).Allowed
+}
 
-	permissionOrder := getEntityPermissionOrder(requestData.EntityPermissionOrder)
+// CheckOperationWithUsage is a function to check if operation is permitted, then it checks the usage following the PermissionRequestData.EntityPermissionOrder
+// It loops through each entity in the order and checks permission against request usage + operationQuantity for each OperationLimit
+// The returned Decision holds the entity that denied the operation, the check that failed, and the limit, usage and quantity that were compared
+func CheckOperationWithUsage(requestData PermissionWithUsageRequestData) Decision {
+	decision, _ := checkOperationWithUsage(requestData, requestData.now())
+	return decision
+}
 
+// checkOperationWithUsage is CheckOperationWithUsage at the time now, it also returns the entities that granted the operation, which are the entities whose usage should be updated
+func checkOperationWithUsage(requestData PermissionWithUsageRequestData, now time.Time) (Decision, []Entity) {
 	// Loop through all the usage according to the entity order
 	// compare each operation quantity + usage , if the addition is more than its appropriate limit deny access
 	// for example, if I am doing a creating 5 files batch , it loops through all the entity's and the limit, it first checks the "batch" limit, if the limit for "batch" is less or equal to 5 continue,
 	// following the order, within that same order, it checks all other limits against the usage, if the usage + operation quantity exceeds the corresponding limit, deny access
+	decision, grantingEntities := checkEntityLevels(requestData, now, func(entity Entity) Decision {
+		return checkEntityOperationWithUsage(requestData.Operation, requestData.OperationQuantity, entity, now)
+	})
+	if decision.Allowed == true {
+		decision.Quantity = requestData.OperationQuantity
+	}
+	logDecision(requestData.Operation, decision)
+	return decision, grantingEntities
+}
 
-	if len(permissionOrder) > 0 {
-		for i := 0; i < len(permissionOrder); i++ {
-			currentEntity := permissionOrder[i]
-			// if any of the entity is invalid at any point decline permission
-			if isEntityValid(currentEntity) == false {
-				fmt.Printf("Invalid entity : %s", currentEntity)
-				return false
-			}
-
-			// Get current entity permission
-			entityPermissions = getEntityPermission(currentEntity, requestData.PermissionRequestData)
-
-			// we want to ensure that the startTime of the permission is NOW or greater, if it's before NOW, don't grant permission
-			// in simpler terms this means we are attempting to get permission for something before the time its permitted
-			// also ensure start time is not empty
-			if entityPermissions.StartTime.Before(time.Now()) && entityPermissions.StartTime.IsZero() == false {
-				return false
-			}
-
-			// in the same vein if the permission has expired, this means if now is greater than EndTime
-			// also ensure endTime is not empty
-			if time.Now().After(entityPermissions.EndTime) && entityPermissions.EndTime.IsZero() == false {
-				return false
-			}
-
-			// first we check current operation is permitted for this entity, before moving to its limits
-			isCurrentEntityOperationPermitted := IsEntityOperationPermitted(requestData.Operation, entityPermissions)
-			if isCurrentEntityOperationPermitted == false {
-
-				fmt.Printf("%s %s", currentEntity, requestData.Operation)
-				fmt.Print(entityPermissions)
-				return false
-			}
-			//todo test scenario and implications of what happens if one of the entity permissions is not set at all, meaning its "empty"
-			// I think if it is, it should not be put in the order at all, so by default , if its empty all the limit checks would pass, except the batchLimit, which has to be at least 1
-			// SO this would force the users to either set the fields for the entity, or remove it completely from the order
-
-			// Get entity usage
-			entityUsage = getEntityPermissionUsage(currentEntity, requestData)
-			if requestData.Operation == constants.OperationCreate {
-				operationLimits = entityPermissions.CreateOperationLimits
-				operationUsage = entityUsage.CreateOperationUsages
-			}
-			if requestData.Operation == constants.OperationRead {
-				operationLimits = entityPermissions.ReadOperationLimits
-				operationUsage = entityUsage.ReadOperationUsages
-			}
-			if requestData.Operation == constants.OperationUpdate {
-				operationLimits = entityPermissions.UpdateOperationLimits
-				operationUsage = entityUsage.UpdateOperationUsages
-			}
-
-			if requestData.Operation == constants.OperationDelete {
-				operationLimits = entityPermissions.DeleteOperationLimits
-				operationUsage = entityUsage.DeleteOperationUsages
-			}
-
-			if requestData.Operation == constants.OperationExecute {
-				operationLimits = entityPermissions.ExecuteOperationLimits
-				operationUsage = entityUsage.ExecuteOperationUsages
-			}
-			// Now let's get values of the various fields we need for the current operation we are checking permission for
-
-			// Let's start with limits
-			quotaLimit := entityPermissions.QuotaLimit
-			allTimeLimit := operationLimits.AllTimeLimit
-			batchLimit := operationLimits.getBatchLimit()
-			perMinuteLimit := operationLimits.PerMinuteLimit
-			perHourLimit := operationLimits.PerHourLimit
-			perDayLimit := operationLimits.PerDayLimit
-			perWeekLimit := operationLimits.PerWeekLimit
-			perFortnightLimit := operationLimits.PerFortnightLimit
-			perMonthLimit := operationLimits.PerMonthLimit
-			perQuarterLimit := operationLimits.PerQuarterLimit
-			perYearLimit := operationLimits.PerYearLimit
-			//customDurationsLimit:=operationLimits.CustomDurationsLimit
-
-			// NOTE THIS IS IMPORTANT DON'T REMOVE ELSE YOU MAY HAVE UNEXPECTED BEHAVIOUR - first let's sanitize usage
-			operationUsage.sanitizeDurationUsage()
-			// Let's get usage values
-			quotaUsage := entityUsage.QuotaUsage
-			allTimeUsage := operationUsage.AllTime
-			usageWithinMinute := operationUsage.WithinTheLastMinute
-			usageWithinHour := operationUsage.WithinTheLastHour
-			usageWithinDay := operationUsage.WithinTheLastDay
-			usageWithinWeek := operationUsage.WithinTheLastWeek
-			usageWithinFortnight := operationUsage.WithinTheLastFortnight
-			usageWithinMonth := operationUsage.WithinTheLastMonth
-			usageWithinQuarter := operationUsage.WithinTheLastQuarter
-			usageWithinYear := operationUsage.WithinTheLastYear
-			//usageWithinCustomDurations:=operationUsage.WithinTheLastCustomDurations
-
-			// special error message for batch value, because it can't be 0, it needs to be at least 1, this is to protect the user of permitta, forcing them to set a batch limit
-			if batchLimit < 1 {
-				fmt.Printf("%sOperationLimits.BatchLimit value for %s entity has to be at least 1  \n", firstLetterToUppercase(requestData.Operation), currentEntity)
-				return false
-			}
-
-			// if any of the limit values is less than 0, deny permission, because that's not normal, I have taken precaution to prevent this, but just in case there is a scenario, I didn't consider that made invalid value slip through
-			if quotaLimit < 0 ||
-				allTimeLimit < 0 ||
-				perMinuteLimit < 0 ||
-				perHourLimit < 0 ||
-				perDayLimit < 0 ||
-				perWeekLimit < 0 ||
-				perFortnightLimit < 0 ||
-				perMonthLimit < 0 ||
-				perQuarterLimit < 0 ||
-				perYearLimit < 0 {
-				fmt.Printf("Invalid limit value \n Check all your %s entity permission limit values to ensure they are all valid, none of them should be less than 0 \n", currentEntity)
-				return false
-			}
+// checkEntityOperationWithUsage checks the operation quantity + usage of a single entity against its limits at the time now
+func checkEntityOperationWithUsage(operation string, operationQuantity uint, entity Entity, now time.Time) Decision {
+	currentEntity := entity.Key()
+	entityPermissions := entity.Permission
+	var operationLimits OperationLimit
+	var operationUsage OperationUsage
 
-			if quotaUsage < 0 ||
-				allTimeUsage < 0 ||
-				usageWithinMinute < 0 ||
-				usageWithinHour < 0 ||
-				usageWithinDay < 0 ||
-				usageWithinWeek < 0 ||
-				usageWithinFortnight < 0 ||
-				usageWithinMonth < 0 ||
-				usageWithinQuarter < 0 ||
-				usageWithinYear < 0 {
-				fmt.Printf("Invalid usage value \n Check all your %s entity permission usage values to ensure they are all valid, none of them should be less than 0 \n", currentEntity)
-				return false
-			}
+	// first we check current operation is permitted for this entity, and that the permission is in effect, before moving to its limits
+	currentEntityDecision := checkEntityOperation(operation, entityPermissions, now)
+	if currentEntityDecision.Allowed == false {
+		currentEntityDecision.Entity = currentEntity
+		return currentEntityDecision
+	}
+	//todo test scenario and implications of what happens if one of the entity permissions is not set at all, meaning its "empty"
+	// I think if it is, it should not be put in the order at all, so by default , if its empty all the limit checks would pass, except the batchLimit, which has to be at least 1
+	// SO this would force the users to either set the fields for the entity, or remove it completely from the order
+
+	// Get entity usage
+	entityUsage := entity.Usage
+	operationLimits = GetOperationLimits(operation, entityPermissions)
+	operationUsage = getOperationUsage(operation, entityUsage)
+	// Now let's get values of the various fields we need for the current operation we are checking permission for
+
+	// Let's start with limits
+	quotaLimit := entityPermissions.QuotaLimit
+	allTimeLimit := operationLimits.AllTimeLimit
+	batchLimit := operationLimits.getBatchLimit()
+	perMinuteLimit := operationLimits.PerMinuteLimit
+	perHourLimit := operationLimits.PerHourLimit
+	perDayLimit := operationLimits.PerDayLimit
+	perWeekLimit := operationLimits.PerWeekLimit
+	perFortnightLimit := operationLimits.PerFortnightLimit
+	perMonthLimit := operationLimits.PerMonthLimit
+	perQuarterLimit := operationLimits.PerQuarterLimit
+	perYearLimit := operationLimits.PerYearLimit
+	customDurationsLimit := operationLimits.CustomDurationsLimit
 
-			// TODO Document that batch limit default value is automatically assumed, or enforced as 1, not unlimited, to prevent abuse
-			// TODO CONTD - where users try to perform too many operations at once
+	// NOTE THIS IS IMPORTANT DON'T REMOVE ELSE YOU MAY HAVE UNEXPECTED BEHAVIOUR - first let's sanitize usage
+	operationUsage.sanitizeDurationUsage(operationLimits, now)
+	// Let's get usage values
+	quotaUsage := entityUsage.QuotaUsage
+	allTimeUsage := operationUsage.AllTime
+	usageWithinMinute := operationUsage.WithinTheLastMinute
+	usageWithinHour := operationUsage.WithinTheLastHour
+	usageWithinDay := operationUsage.WithinTheLastDay
+	usageWithinWeek := operationUsage.WithinTheLastWeek
+	usageWithinFortnight := operationUsage.WithinTheLastFortnight
+	usageWithinMonth := operationUsage.WithinTheLastMonth
+	usageWithinQuarter := operationUsage.WithinTheLastQuarter
+	usageWithinYear := operationUsage.WithinTheLastYear
+	usageWithinCustomDurations := operationUsage.WithinTheLastCustomDurations
 
-			// if BatchLimit
-			// First check ^BatchLimit is not exceeded , if its exceeded deny permission, there is no need to check the next order
-			// Also if fore some reason batchLimit is -1 , this is not a valid value, so deny permission
-			// batchLimit is not like other limits where 0 denotes unlimited, this forces any permitta user to set a strict batch limit value
-			if operationQuantity > batchLimit {
+	// special error message for batch value, because it can't be 0, it needs to be at least 1, this is to protect the user of permitta, forcing them to set a batch limit
+	if batchLimit < 1 {
+		return deniedDecision(currentEntity, constants.ReasonInvalidLimit)
+	}
 
-				fmt.Printf("Batch Limit exceeded for entity:%s and operation:%s \n", currentEntity, requestData.Operation)
-				return false
-			}
+	// if any of the limit values is less than 0, deny permission, because that's not normal, I have taken precaution to prevent this, but just in case there is a scenario, I didn't consider that made invalid value slip through
+	if quotaLimit < 0 ||
+		allTimeLimit < 0 ||
+		perMinuteLimit < 0 ||
+		perHourLimit < 0 ||
+		perDayLimit < 0 ||
+		perWeekLimit < 0 ||
+		perFortnightLimit < 0 ||
+		perMonthLimit < 0 ||
+		perQuarterLimit < 0 ||
+		perYearLimit < 0 {
+		return deniedDecision(currentEntity, constants.ReasonInvalidLimit)
+	}
 
-			//Check Quota Limit first , and only check Quota limit, when we are performing a create operation/permission request
+	if quotaUsage < 0 ||
+		allTimeUsage < 0 ||
+		usageWithinMinute < 0 ||
+		usageWithinHour < 0 ||
+		usageWithinDay < 0 ||
+		usageWithinWeek < 0 ||
+		usageWithinFortnight < 0 ||
+		usageWithinMonth < 0 ||
+		usageWithinQuarter < 0 ||
+		usageWithinYear < 0 {
+		return deniedDecision(currentEntity, constants.ReasonInvalidUsage)
+	}
 
-			if (requestData.Operation == constants.OperationCreate) && (operationQuantity+quotaUsage > quotaLimit) && (quotaLimit != constants.Unlimited) {
+	// TODO Document that batch limit default value is automatically assumed, or enforced as 1, not unlimited, to prevent abuse
+	// TODO CONTD - where users try to perform too many operations at once
 
-				return false
-			}
+	// if BatchLimit
+	// First check ^BatchLimit is not exceeded , if its exceeded deny permission, there is no need to check the next order
+	// Also if fore some reason batchLimit is -1 , this is not a valid value, so deny permission
+	// batchLimit is not like other limits where 0 denotes unlimited, this forces any permitta user to set a strict batch limit value
+	if operationQuantity > batchLimit {
+		return limitExceededDecision(currentEntity, constants.ReasonBatchLimitExceeded, batchLimit, 0, operationQuantity)
+	}
 
-			// Next let's check all time limit for current entity, and deny access if exceeded
-			// to do that , we ensure operation quantity + all time usage doesn't exceed all time limit , and the all-time limit value isn't unlimited =0
-			if (operationQuantity+allTimeUsage > allTimeLimit) && allTimeLimit != constants.Unlimited {
-				return false
-			}
+	//Check Quota Limit first , and only check Quota limit, when we are performing a create operation/permission request, or any operation that increases the quota usage
 
-			// next check per minute limit
-			if (operationQuantity+usageWithinMinute > perMinuteLimit) && perMinuteLimit != constants.Unlimited {
-				return false
-			}
+	if (operationQuotaEffect(operation) == constants.QuotaEffectIncrease) && (operationQuantity+quotaUsage > quotaLimit) && (quotaLimit != constants.Unlimited) {
 
-			// next check per hour limit
-			if (operationQuantity+usageWithinHour > perHourLimit) && perHourLimit != constants.Unlimited {
-				return false
-			}
+		return limitExceededDecision(currentEntity, constants.ReasonQuotaLimitExceeded, quotaLimit, quotaUsage, operationQuantity)
+	}
 
-			// next check per day limit
-			if (operationQuantity+usageWithinDay > perDayLimit) && perDayLimit != constants.Unlimited {
-				return false
-			}
+	// Next let's check all time limit for current entity, and deny access if exceeded
+	// to do that , we ensure operation quantity + all time usage doesn't exceed all time limit , and the all-time limit value isn't unlimited =0
+	if (operationQuantity+allTimeUsage > allTimeLimit) && allTimeLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonAllTimeLimitExceeded, allTimeLimit, allTimeUsage, operationQuantity)
+	}
+
+	// next check per minute limit
+	if (operationQuantity+usageWithinMinute > perMinuteLimit) && perMinuteLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonMinuteLimitExceeded, perMinuteLimit, usageWithinMinute, operationQuantity)
+	}
 
-			// next check per week limit
-			if (operationQuantity+usageWithinWeek > perWeekLimit) && perWeekLimit != constants.Unlimited {
-				return false
-			}
+	// next check per hour limit
+	if (operationQuantity+usageWithinHour > perHourLimit) && perHourLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonHourLimitExceeded, perHourLimit, usageWithinHour, operationQuantity)
+	}
 
-			// next check per fortnight limit
-			if (operationQuantity+usageWithinFortnight > perFortnightLimit) && perFortnightLimit != constants.Unlimited {
-				return false
-			}
+	// next check per day limit
+	if (operationQuantity+usageWithinDay > perDayLimit) && perDayLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonDayLimitExceeded, perDayLimit, usageWithinDay, operationQuantity)
+	}
 
-			// next check per month limit
-			if (operationQuantity+usageWithinMonth > perMonthLimit) && perMonthLimit != constants.Unlimited {
-				return false
-			}
+	// next check per week limit
+	if (operationQuantity+usageWithinWeek > perWeekLimit) && perWeekLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonWeekLimitExceeded, perWeekLimit, usageWithinWeek, operationQuantity)
+	}
 
-			// next check per quarter limit
-			if (operationQuantity+usageWithinQuarter > perQuarterLimit) && perQuarterLimit != constants.Unlimited {
-				return false
-			}
+	// next check per fortnight limit
+	if (operationQuantity+usageWithinFortnight > perFortnightLimit) && perFortnightLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonFortnightLimitExceeded, perFortnightLimit, usageWithinFortnight, operationQuantity)
+	}
 
-			// next check per year limit
-			if (operationQuantity+usageWithinYear > perYearLimit) && perYearLimit != constants.Unlimited {
-				return false
-			}
+	// next check per month limit
+	if (operationQuantity+usageWithinMonth > perMonthLimit) && perMonthLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonMonthLimitExceeded, perMonthLimit, usageWithinMonth, operationQuantity)
+	}
 
-			// todo come and add custom durations limit check
+	// next check per quarter limit
+	if (operationQuantity+usageWithinQuarter > perQuarterLimit) && perQuarterLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonQuarterLimitExceeded, perQuarterLimit, usageWithinQuarter, operationQuantity)
+	}
 
-			// if all checks passed up till this point , that means permission is granted for this entity , so continue to the next entity,
-			// but if the entity we just ran check for is the last entity, then it means permission is granted , else continue to next entity
-			if i == len(permissionOrder)-1 {
-				// this is the last entity in the order
-				// this means all checks in the last entity went well if we got to this point
-				return true
+	// next check per year limit
+	if (operationQuantity+usageWithinYear > perYearLimit) && perYearLimit != constants.Unlimited {
+		return limitExceededDecision(currentEntity, constants.ReasonYearLimitExceeded, perYearLimit, usageWithinYear, operationQuantity)
+	}
 
-			} else {
-				// this means current entity checks went well, but we are not in the last entity in the order yet, so let's move to the next entity to check if limits are not exceeded
-				continue
-			}
+	// next check custom durations limits
+	for _, customDurationLimit := range customDurationsLimit {
+		usageWithinCustomDuration := usageWithinCustomDurations[customDurationLimit.Key()]
+		if (operationQuantity+usageWithinCustomDuration > customDurationLimit.Max) && customDurationLimit.Max != constants.Unlimited {
+			decision := limitExceededDecision(currentEntity, constants.ReasonCustomDurationLimitExceeded, customDurationLimit.Max, usageWithinCustomDuration, operationQuantity)
+			decision.Window = customDurationLimit.Key()
+			return decision
 		}
 	}
 
-	return false
+	return Decision{Allowed: true, Quantity: operationQuantity}
 }
 
+// IsEntityOperationPermitted checks if the operation is permitted for a single entity's permissions, without considering usage
+// It is a thin wrapper around CheckEntityOperation
 func IsEntityOperationPermitted(operation string, entityPermissions Permission) bool {
-	// ensure the operation is valid
-	if isOperationValid(operation) == false {
-		return false
-	}
-
-	// we want to ensure that the startTime of the permission is NOW or greater, if it's before NOW, don't grant permission
-	// in simpler terms this means we are attempting to get permission for something before the time its permitted
-	// also ensure start time is not empty
-	if time.Now().Before(entityPermissions.StartTime) && (entityPermissions.StartTime.IsZero() == false) {
-
-		return false
-	}
+	return CheckEntityOperation(operation, entityPermissions).Allowed
+}
 
-	// in the same vein if the permission has expired, this means if now is greater than EndTime
-	// also ensure endTime is not empty
-	if time.Now().After(entityPermissions.EndTime) && (entityPermissions.EndTime.IsZero() == false) {
-		return false
-	}
+// CheckEntityOperation checks if the operation is permitted for a single entity's permissions, without considering usage, and returns a Decision describing the result
+// The Entity field of the returned Decision is left empty, since the permissions are not tied to any entity here
+func CheckEntityOperation(operation string, entityPermissions Permission) Decision {
+	return CheckEntityOperationAt(operation, entityPermissions, time.Now())
+}
 
-	if operation == constants.OperationCreate {
-		return entityPermissions.Create
-	}
+// CheckEntityOperationAt is CheckEntityOperation at the time now instead of the real time, e.g to check a permission as of a past time
+func CheckEntityOperationAt(operation string, entityPermissions Permission, now time.Time) Decision {
+	decision := checkEntityOperation(operation, entityPermissions, now)
+	logDecision(operation, decision)
+	return decision
+}
 
-	if operation == constants.OperationRead {
-		return entityPermissions.Read
+// checkEntityOperation is CheckEntityOperationAt without logging, it's used for every entity of a request, so only the decision of the whole request is logged
+func checkEntityOperation(operation string, entityPermissions Permission, now time.Time) Decision {
+	// ensure the operation is valid
+	if isOperationValid(operation) == false {
+		return deniedDecision("", constants.ReasonInvalidOperation)
 	}
 
-	if operation == constants.OperationUpdate {
-		return entityPermissions.Update
+	// the permission must be in effect, i.e between its start and end times, and within its schedules
+	if validityDecision := checkValidity(entityPermissions, now); validityDecision.Allowed == false {
+		return validityDecision
 	}
 
-	if operation == constants.OperationDelete {
-		return entityPermissions.Delete
+	// an explicit deny always wins over a grant of the same entity
+	if isOperationDenied(operation, entityPermissions) == true {
+		return deniedDecision("", constants.ReasonExplicitlyDenied)
 	}
 
-	if operation == constants.OperationExecute {
-		return entityPermissions.Execute
+	if isOperationGranted(operation, entityPermissions) == false {
+		return deniedDecision("", constants.ReasonOperationNotGranted)
 	}
 
-	return false
+	return Decision{Allowed: true}
 }
 
 func GetOperationLimits(operation string, permission Permission) OperationLimit {
@@ -500,10 +543,15 @@ func GetOperationLimits(operation string, permission Permission) OperationLimit
 		return permission.ExecuteOperationLimits
 	}
 
-	return OperationLimit{}
+	return permission.Operations[operation].Limits
 }
 
 func GetOperationUsages(operation string, permissionUsage PermissionUsage) OperationUsage {
+	return GetOperationUsagesAt(operation, permissionUsage, time.Now())
+}
+
+// GetOperationUsagesAt is GetOperationUsages with the usage sanitized at the time now instead of the real time
+func GetOperationUsagesAt(operation string, permissionUsage PermissionUsage, now time.Time) OperationUsage {
 	var operationUsage OperationUsage
 	if operation == constants.OperationCreate {
 		operationUsage = permissionUsage.CreateOperationUsages
@@ -522,8 +570,12 @@ func GetOperationUsages(operation string, permissionUsage PermissionUsage) Opera
 		operationUsage = permissionUsage.ExecuteOperationUsages
 	}
 
+	if isCrudeOperation(operation) == false {
+		operationUsage = permissionUsage.OperationUsages[operation]
+	}
+
 	// sanitize operationUsage
-	operationUsage.sanitizeDurationUsage()
+	operationUsage.sanitizeDurationUsage(OperationLimit{}, now)
 
 	return operationUsage
 }
@@ -550,17 +602,11 @@ func GetOperationLimitsHumanFriendly(operation string, permission Permission) ma
 	return m
 
 }
-func isOperationValid(operation string) bool {
-	// ensure the operation is correct
-	if operation != constants.OperationCreate &&
-		operation != constants.OperationRead &&
-		operation != constants.OperationUpdate &&
-		operation != constants.OperationDelete &&
-		operation != constants.OperationExecute {
-		return false
-	}
 
-	return true
+// isOperationValid reports if the operation is registered, see RegisterOperation
+func isOperationValid(operation string) bool {
+	_, isRegistered := LookupOperation(operation)
+	return isRegistered
 }
 
 func firstLetterToUppercase(s string) string {
@@ -568,9 +614,20 @@ func firstLetterToUppercase(s string) string {
 
 }
 
-func getEntityPermissionOrder(permissionOrder string) []string {
+func getEntityPermissionOrder(permissionRequestData PermissionRequestData) []string {
 	var finalOrder []string
-	permissionOrder = strings.ReplaceAll(permissionOrder, " ", "")
+	permissionOrder := strings.ReplaceAll(permissionRequestData.EntityPermissionOrder, " ", "")
+
+	// if there is no order but there are entities, the entity types are checked in the order they are first seen in, each type once, since all the entities of a type are checked together
+	// entity types that aren't registered are kept in the order, so checkEntityLevels denies the operation with constants.ReasonInvalidEntity instead of skipping them
+	if permissionOrder == "" && len(permissionRequestData.Entities) > 0 {
+		for _, entity := range permissionRequestData.Entities {
+			if slices.Contains(finalOrder, entity.Type) == false {
+				finalOrder = append(finalOrder, entity.Type)
+			}
+		}
+		return finalOrder
+	}
 
 	// if permission is granted in one entity / order level, go to the next , if all is granted and the loop is at the last point and the last one is granted, grant permission else, deny permission
 	//if permissionOrder is empty use default
@@ -581,9 +638,7 @@ func getEntityPermissionOrder(permissionOrder string) []string {
 	}
 	// for scenario where we want to check permission for just one entity and there is no separator , just a single word denoting the entity
 	if strings.Contains(permissionOrder, constants.OrderSeparator) == false {
-		if isEntityValid(permissionOrder) {
-			return []string{permissionOrder}
-		}
+		return []string{permissionOrder}
 	}
 
 	// for other scenarios where the separator is included
@@ -591,12 +646,9 @@ func getEntityPermissionOrder(permissionOrder string) []string {
 		splitOrder := strings.Split(permissionOrder, constants.OrderSeparator)
 		if len(splitOrder) > 0 {
 
-			// loop through the orders in the slice and if current entity is valid append it to the final order
+			// loop through the orders in the slice and append every entity to the final order, even if it's invalid, so a typo e.g user->grop denies the operation instead of skipping the entity
 			for i := 0; i < len(splitOrder); i++ {
-
-				if isEntityValid(splitOrder[i]) == true {
-					finalOrder = append(finalOrder, splitOrder[i])
-				}
+				finalOrder = append(finalOrder, splitOrder[i])
 			}
 
 		}
@@ -607,6 +659,10 @@ func getEntityPermissionOrder(permissionOrder string) []string {
 }
 
 func getEntityPermission(entityName string, permissionRequestData PermissionRequestData) Permission {
+	if entityIndex := findEntity(permissionRequestData.Entities, entityName); entityIndex != -1 {
+		return permissionRequestData.Entities[entityIndex].Permission
+	}
+
 	var permissions Permission
 	switch entityName {
 	case constants.EntityOrg:
@@ -633,6 +689,10 @@ func getEntityPermission(entityName string, permissionRequestData PermissionRequ
 }
 
 func getEntityPermissionUsage(entityName string, usageRequestData PermissionWithUsageRequestData) PermissionUsage {
+	if entityIndex := findEntity(usageRequestData.Entities, entityName); entityIndex != -1 {
+		return usageRequestData.Entities[entityIndex].Usage
+	}
+
 	var usage PermissionUsage
 	switch entityName {
 	case constants.EntityOrg:
@@ -658,564 +718,49 @@ func getEntityPermissionUsage(entityName string, usageRequestData PermissionWith
 	return usage
 }
 
-func isEntityValid(entityName string) bool {
-	// ensure the operation is correct
-	if entityName != constants.EntityOrg &&
-		entityName != constants.EntityDomain &&
-		entityName != constants.EntityGroup &&
-		entityName != constants.EntityRole &&
-		entityName != constants.EntityUser {
-		return false
-	}
-
-	return true
-}
-
-func replaceLastOccurrence(s, old, new string) string {
-	index := strings.LastIndex(s, old)
-	if index == -1 {
-		return s
-	}
-	return s[:index] + new + s[index+len(old):]
-}
-
-// sanitizeNotation is a function that "cleans up " notations and remove unnecessary sections , it doesn't validate, it only cleans up
-func sanitizeNotation(notation string) string {
-	// Clean up space first
-	notation = strings.ReplaceAll(notation, " ", "")
-	// clean up new line and tab
-	notation = strings.ReplaceAll(notation, "\n", "")
-	notation = strings.ReplaceAll(notation, "\t", "")
-
-	// if there is any empty section remove that section , to be more specific, if there is any invalid limit section remove it.
-	// I know I said we won't do validation here, but we kind of already are
-	if strings.Contains(notation, constants.NotationSectionSeparator) == true {
-		notationSections := strings.Split(notation, constants.NotationSectionSeparator)
-		newNotation := ""
-		for i := 0; i < len(notationSections); i++ {
-			currentSectionString := notationSections[i]
-			//rebuild the notation , only add section if it starts with a valid section prefix
-			if strings.HasPrefix(currentSectionString, "c") || //for first section that could be something like "cr-de"
-				strings.HasPrefix(currentSectionString, "-") || // for something like "-r---"
-				strings.HasPrefix(currentSectionString, "q=") || // for quotaLimit
-				strings.HasPrefix(currentSectionString, "start=") || // for quotaLimit
-				strings.HasPrefix(currentSectionString, "end=") || // for quotaLimit
-				strings.HasPrefix(currentSectionString, "c=") || // for limit section
-				strings.HasPrefix(currentSectionString, "r=") || // for limit section
-				strings.HasPrefix(currentSectionString, "u=") || // for limit section
-				strings.HasPrefix(currentSectionString, "d=") || // for limit section
-				strings.HasPrefix(currentSectionString, "e=") {
-
-				// for the section to be added, it also needs to meet certain criteria
-				// the length of the string has to be at least 5 characters long , e.g "crud-" and "c=all:5" both are 5 or more characters
-				// if it's not last index add separator
-				// q= quota section could be less than 5 characters long , e.g q=1, so we would add condition for that , for quota, it has to be greater or equal to 3 characters
-				if (len([]rune(currentSectionString)) >= 5 && strings.HasPrefix(currentSectionString, "q=") == false) ||
-					(strings.HasPrefix(currentSectionString, "q=") && len([]rune(currentSectionString)) >= 3) {
-					if i != len(notationSections)-1 {
-						newNotation = newNotation + currentSectionString + constants.NotationSectionSeparator
-					} else {
-						newNotation = newNotation + currentSectionString
-					}
-				}
-			}
-
-		}
-
-		notation = newNotation
-	}
-
-	// let's check if we have one section separator, if we do, this means most like we have something like cr-de| , it's ok and preferable to have it just like cr-de without the separator, so let's clean that up
-	// it won't be high-tech, if there is one separator, just remove it, especially when it's at the end
-	// it needs to be the scenario where it's at the end , because we could have one separator and have something like this cr-de|c=batch:2 in this case, we don't want to remove the section separator
-	// But we could also have cr-de|c=batch:2| , so this means, we don't want to check if there is just one separator, we just want to remove the separator if its the last string
-	if strings.HasSuffix(notation, constants.NotationSectionSeparator) == true {
-		notation = replaceLastOccurrence(notation, constants.NotationSectionSeparator, "")
-	}
-
-	return notation
-}
-
-//TODO add a way to write this permissions in shorthand , both for obscurity and quick writing of permissions
-// Then write a function to intepreter that shorthand, its basically just parsing using strings.split , you might even create your own standard of writing permissions and propose it to a body tasked with standardizing things like this
-// FOllowing the unix permission pattern for each entity, you can do , "crud-","c"{all:0,batch:1,minute:0,hour:5,day:0,week:45,fortnight:0,monthly:0,quarterly:0,yearly:0,customDurations:[per_5_minutes_4,per_3_days_50]|r:....
-
-// NotationToPermission converts a notation string to a permission "object"/struct. Its just a useful "shorthand" way to write permissions without using the struct directly
-//
-// Below is an example of what a notation looks like . Read in the repo documentation for details
-//
-// q=30 standards for QuotaLimit of 30
-//
-//	crud-|q=30|c=month:0,day:100,batch:1,minute:5,hour:20,week:500,fortnight:700,year:10000,quarter:5000,custom:[per_5_minutes_4 & per_3_days_50]|r=..
-func NotationToPermission(notation string) Permission {
-	var finalPermission Permission
-	// just in case there is space in the string, let's trim space, but there shouldn't be space
-	notation = sanitizeNotation(notation)
-	includeThisOperationLimit := false
-	var currentLimitSection string
-	var notationSections []string
-	var operationPermissionSection string //for the first section like cr-de
-	// first let's split the notation into its different section
-	if strings.Contains(notation, constants.NotationSectionSeparator) {
-
-		notationSections = strings.Split(notation, constants.NotationSectionSeparator)
-		operationPermissionSection = notationSections[0]
-		// There should always be at most 6 sections , and at least one section e.g. cr-de| this implies create, read, delete, execute is allowed and all its limits are unlimited, except batch limits which is set to 1 by default
-		if len(notationSections) < 1 || len(notationSections) > 6 {
-			fmt.Println("Malformed permission notation")
-			return Permission{}
-		}
-	} else {
-		// the notation doesn't contain the separator, so we assume it's just the operationPermissionSection without the limits section
-		operationPermissionSection = notation
-	}
-
-	// if we got here, it means the notation is properly formed so far
-	// let's check the first section if its properly formed, if it is we can proceed,
-	// it should always be 5 characters long , because it should be like "crude" , which stands for CREATE, READ, UPDATE, DELETE, EXECUTE . , if we don't want to grant permission to any of these operations any of the letters in "crude" can be replaced with a minus sign "-"
-	// But the letter have to ALWAYS follow that order, or be replaced by "-"
-	// so let's use regex
-	firstSectionPattern := regexp.MustCompile(`^([c-][r-][u-][d-][e-])$`)
-	if firstSectionPattern.MatchString(operationPermissionSection) == false {
-		fmt.Println("Malformed permission notation")
-		return Permission{}
-	}
-
-	// if we got here it means the pattern matched, and we are good to set the permission values for the operations
-	for i, operationPermissionInit := range operationPermissionSection {
-
-		if i == 0 {
-			if string(operationPermissionInit) == "c" {
-				finalPermission.Create = true
-				// set default limits
-
-			}
-		}
-
-		if i == 1 {
-			if string(operationPermissionInit) == "r" {
-				finalPermission.Read = true
-
-			}
-		}
-
-		if i == 2 {
-			if string(operationPermissionInit) == "u" {
-				finalPermission.Update = true
-
-			}
-		}
-
-		if i == 3 {
-			if string(operationPermissionInit) == "d" {
-				finalPermission.Delete = true
-
-			}
-		}
-
-		if i == 4 {
-			if string(operationPermissionInit) == "e" {
-				finalPermission.Execute = true
-			}
-		}
-
-	}
-
-	//NOTE document this :
-
-	// Let's move to the remaining sections, we can just loop through them , since they have similar syntax
-	// NOTE The remaining sections don't have to be set if I want to let all the limits be unlimited and the batch limit to be 1
-	// the remaining sections is for limits , create limits for example would be defined like :
-	// c=month:0,day:100,batch:1,minute:5,hour:20,week:500,fortnight:700,year:10000,quarter:5000,custom:[per_5_minutes_4,per_3_days_50]
-	// one of the limits section can be the quota limit q=int , if its not set , it assumes quota is unlimited
-	// for other operations "c=" can just be replaced with "r=" or "u=" or "d=" or "e="
-	// Just like the operation permission section similarly the proceeding sections should also follow an order
-	// e.g c-ude|q=5|c=....|r=...|u=...|d=...|e=...
-	// Its required that in each operation limit section, at least the batch limit should be set (else its pegged at 1 by default)
-	// The individual limits within each operation limit section can be arranged in any order
-	// If any limit is excluded, its assumed that the value is unlimited , batch limit can never be unlimited, this is why if its not set, it automatically enforced as 1, where corresponding operation permission is granted
-	// Let's start the loop , we would be starting the loop from index 1, since index 0 is the operation permissions which we have already handled
-	// Operation Limit sections can be left empty even if the said operation is granted permission, this would imply that batch limit is the default of 1 and all other limits are unlimited
-	// for example if you have crud-| implies create, read, update and delete permission is granted, and all its limits are unlimited and all its batch limit is set to 1
-	// only run this loop if limits are set this means the notationSections is greater than 1
-
-	if len(notationSections) > 1 {
-
-		for i := 1; i < len(notationSections); i++ {
-			//reset include operation limit
-			includeThisOperationLimit = false
-			currentLimitSection = ""
-			// Let's check if current section is properly formed, this isn't a perfect test for a properly formed operation limit section , but it would do for now
-			// todo improve this
-
-			// if its Quota Limit section
-			if strings.HasPrefix(notationSections[i], "q=") == true {
-				// Quota section split
-				quotaSectionSplit := strings.Split(notationSections[i], "=")
-				quotaValue, quotaValueErr := stringToPositiveIntegerOrZero(quotaSectionSplit[1])
-				if quotaValueErr != nil {
-					fmt.Println("Malformed quota limit in notation")
-					finalPermission = Permission{}
-					return finalPermission
-				} else {
-					finalPermission.QuotaLimit = quotaValue
-				}
-
-			}
-			if strings.HasPrefix(notationSections[i], "start=") == true {
-
-				startTimeSectionSplit := strings.Split(notationSections[i], "=")
-				startTimeValue, startTimeValueErr := stringToPositiveIntegerOrZero(startTimeSectionSplit[1])
-
-				if startTimeValueErr != nil {
-					fmt.Println("Malformed start time in notation")
-					finalPermission = Permission{}
-					return finalPermission
-				} else {
-					finalPermission.StartTime = time.Unix(int64(startTimeValue), 0)
-				}
-			}
-
-			if strings.HasPrefix(notationSections[i], "end=") == true {
-				endTimeSectionSplit := strings.Split(notationSections[i], "=")
-				endTimeValue, endTimeValueErr := stringToPositiveIntegerOrZero(endTimeSectionSplit[1])
-				if endTimeValueErr != nil {
-					fmt.Println("Malformed start time in notation")
-					finalPermission = Permission{}
-					return finalPermission
-				} else {
-					finalPermission.EndTime = time.Unix(int64(endTimeValue), 0)
-				}
-			}
-
-			if strings.HasPrefix(notationSections[i], "c=") == true && finalPermission.Create == true {
-				includeThisOperationLimit = true
-				currentLimitSection = constants.OperationCreate
-
-			}
-
-			if strings.HasPrefix(notationSections[i], "r=") == true && finalPermission.Read == true {
-				includeThisOperationLimit = true
-				currentLimitSection = constants.OperationRead
-
-			}
-
-			if strings.HasPrefix(notationSections[i], "u=") == true && finalPermission.Update == true {
-				includeThisOperationLimit = true
-				currentLimitSection = constants.OperationUpdate
-
-			}
-
-			if strings.HasPrefix(notationSections[i], "d=") == true && finalPermission.Delete == true {
-				includeThisOperationLimit = true
-				currentLimitSection = constants.OperationDelete
-
-			}
-
-			if strings.HasPrefix(notationSections[i], "e=") == true && finalPermission.Execute == true {
-				includeThisOperationLimit = true
-				currentLimitSection = constants.OperationExecute
-
-			}
-
-			if includeThisOperationLimit == true {
-				//split and loop through the current operation limit to add
-				// first split the operation key from the limit list
-				splitOperationLimitSection := strings.Split(notationSections[i], "=")
-				// now let's split the limits itself , and assign the limits where they are available, and return the new updated limits
-				operationLimit, operationLimitErr := getNotationOperationLimits(splitOperationLimitSection[1]) //todo handle error here
-				// if for any reason there is an error getting operation limit, its very important to set original operation permission to false, else there would be a loop hole, where, users can be granted unlimited access, so set final permission to empty
-				if operationLimitErr != nil {
-					finalPermission = Permission{}
-					return finalPermission
-				}
-				switch currentLimitSection {
-				// for scenarios where
-				case constants.OperationCreate:
-
-					finalPermission.CreateOperationLimits = operationLimit
-
-					break
-				case constants.OperationRead:
-					finalPermission.ReadOperationLimits = operationLimit
-
-					break
-				case constants.OperationUpdate:
-					finalPermission.UpdateOperationLimits = operationLimit
-
-					break
-				case constants.OperationDelete:
-					finalPermission.DeleteOperationLimits = operationLimit
-					break
-				case constants.OperationExecute:
-					finalPermission.ExecuteOperationLimits = operationLimit
-					break
-
-				}
-
-			}
-
-		}
-	}
-
-	// set default limits for granted permissions in case they were not set
-	//todo improve this
-	if finalPermission.Create == true {
-		finalPermission.CreateOperationLimits.setDefaultLimits()
-	}
-
-	if finalPermission.Read == true {
-		finalPermission.ReadOperationLimits.setDefaultLimits()
-
-	}
-
-	if finalPermission.Update == true {
-		finalPermission.UpdateOperationLimits.setDefaultLimits()
-
-	}
-
-	if finalPermission.Delete == true {
-
-		finalPermission.DeleteOperationLimits.setDefaultLimits()
-	}
-
-	if finalPermission.Execute == true {
-		finalPermission.ExecuteOperationLimits.setDefaultLimits()
-	}
-	return finalPermission
-
-}
-
-// getNotationOperationLimitAndValue receives limit data like "week:5" or "batch:3"
-func getNotationOperationLimitAndValue(limitData string) (string, uint, bool) {
-
-	limitData = strings.ReplaceAll(limitData, " ", "")
-	// let's check if the limit data is properly formed
-	// if it doesn't contain the string that separates limitType from value, then its not valid
-	// let's use regex for this
-	//  pattern ensures that the right pattern is followed limit:uint
-	// however, it forces batch , to be >=1 to be valid , all other limits can be 0 to denote unlimited
-	regexPattern := `^(batch:[1-9]\d*)$|(all|minute|hour|day|week|fortnight|month|quarter|year)(:\d+)$`
-	regex := regexp.MustCompile(regexPattern)
-	if regex.MatchString(limitData) == false {
-		return "", 0, false
-	}
-	// split the limit data since we have verified that its valid
-	splitLimitData := strings.Split(limitData, constants.NotationOperationLimitAndValueSeparator)
-	limitType := splitLimitData[0]
-	limitValue := splitLimitData[1]
-
-	// Best regex so far for the custom limit
-	//	custom:\[(?:per_\d+_?[a-z]+_\d+(?:&|$))+\]
-
-	// Da accurate one !!! ANd I did it myself, AI did the one above, I was closer than AI
-	//	^(custom:\[)((per_\d+_[a-z]+_\d+\&)+|(per_\d+_[a-z]+_\d+){1})+(\])$
-	// This one adds option for the custom limit to be empty
-	//	^(custom:\[)((per_\d+_[a-z]+_\d+\&)+|(per_\d+_[a-z]+_\d+){1})+(\])$|custom:\[\]$
-	// Even improved more
-	// ^custom:\[((per_\d+_[a-z]+_\d+\&)+|(per_\d+_[a-z]+_\d+){1})+\]$|^custom:\[\]$
-
-	// The regexes above allow 0 value after per_ we should have per_0_minutes_10 for example, it should be at least per_1
-	//Improved AND TESTED
-	//	^custom:\[((per_[1-9]\d*_[a-z]+_\d+\&)+|(per_[1-9]\d*_[a-z]+_\d+){1})+\]$|^custom:\[\]$
-
-	//todo create tool where you can write regex and see the syntax clearly , like breaking new line, like in a nested if statement, or even a if statement kind of flow
-
-	limitValueUintInit, limitValueErr := strconv.ParseUint(limitValue, 10, 64)
-	if limitValueErr != nil {
-		// conversion/parsing was not successful
-		return "", 0, false
-	}
-	// if we get to this point it means conversion was successful
-	limitValueUint := uint(limitValueUintInit)
-
-	// if we got to this point , regex has validated the limitData to be correct
-	// we also successfully converted the limitValue to uint
-	return limitType, limitValueUint, true
-
-}
-
-// getNotationOperationCustomLimitValue receives limit data like "custom:[per_5_minutes_10&per_2_month_90]"
-func getNotationOperationCustomLimitValue(limitData string) ([]string, bool) {
-	var customLimitList []string
-
-	regexPattern := `^custom:\[((per_[1-9]\d*_[a-z]+_\d+\&)+|(per_[1-9]\d*_[a-z]+_\d+){1})+\]$|^custom:\[\]$`
-	regex := regexp.MustCompile(regexPattern)
-	if regex.MatchString(limitData) == false {
-		return []string{}, false
-	}
-	// split the limit data since we have verified that its valid
-	splitLimitData := strings.Split(limitData, constants.NotationOperationLimitAndValueSeparator)
-	//limitType :=splitLimitData[0]
-	limitValue := splitLimitData[1]
-
-	// remove the value prefix and suffix to denote a list
-	limitValue = strings.ReplaceAll(limitValue, constants.NotationCustomLimitValuePrefix, "")
-	limitValue = strings.ReplaceAll(limitValue, constants.NotationCustomLimitValueSuffix, "")
-	// check if it contains separator
-	if strings.Contains(limitValue, constants.NotationCustomLimitValueListSeparator) == false {
-		// Since its false , most likely, we have just one custom limit, so lets, just push it
-		//todo comeback when you have written validator for the main OperationLimit.CustomDurationsLimit, use the same validator here, since the syntax for the full custom and notation custom limts are the same
-		customLimitList = append(customLimitList, limitValue)
-	}
-
-	if strings.Contains(limitValue, constants.NotationCustomLimitValueListSeparator) == true {
-		// Since it's true, we potentially have at least two custom limits in the list, so let's split and iterate
-		splitCustomLimits := strings.Split(limitValue, constants.NotationCustomLimitValueListSeparator)
-		if len(splitCustomLimits) > 0 {
-			for i := 0; i < len(splitCustomLimits); i++ {
-				currentCustomLimit := splitCustomLimits[i]
-				//todo validate value here, regex has already validated the structure, but we need to validate
-				customLimitList = append(customLimitList, currentCustomLimit)
-			}
-		}
-		//todo comeback when you have written validator for the main OperationLimit.CustomDurationsLimit, use the same validator here, since the syntax for the full custom and notation custom limts are the same
-		customLimitList = append(customLimitList, limitValue)
+// setEntityPermissionUsage sets the usage of the entity in the request data, it's the opposite of getEntityPermissionUsage
+// Entities is copied before it's changed, since the caller may share it with other requests
+func setEntityPermissionUsage(entityName string, usageRequestData *PermissionWithUsageRequestData, usage PermissionUsage) {
+	if entityIndex := findEntity(usageRequestData.Entities, entityName); entityIndex != -1 {
+		usageRequestData.Entities = slices.Clone(usageRequestData.Entities)
+		usageRequestData.Entities[entityIndex].Usage = usage
+		return
 	}
 
-	return customLimitList, true
-
-}
-
-func getCustomLimitsNotationValues(customLimitValue string) []string {
-	// if it doesn't start with "[" or does not end with "]" its invalid
-	if strings.HasPrefix(customLimitValue, constants.NotationCustomLimitValuePrefix) == false || strings.HasSuffix(customLimitValue, constants.NotationCustomLimitValueSuffix) == false {
-		return []string{}
+	switch entityName {
+	case constants.EntityOrg:
+		usageRequestData.OrgEntityUsage = usage
+	case constants.EntityDomain:
+		usageRequestData.DomainEntityUsage = usage
+	case constants.EntityGroup:
+		usageRequestData.GroupEntityUsage = usage
+	case constants.EntityRole:
+		usageRequestData.RoleEntityUsage = usage
+	case constants.EntityUser:
+		usageRequestData.UserEntityUsage = usage
+	default:
+		usageRequestData.Entities = append(slices.Clone(usageRequestData.Entities), Entity{Type: entityName, Usage: usage})
 	}
-	// if we got here its formed properly so far.
-	// let's see if it contains at list one list separator , if it doesn't we assume
-	//todo come and finish custom limit
-
-	return []string{}
 }
 
-func getNotationOperationLimits(operationLimitsString string) (OperationLimit, error) {
-	var currentOperationLimit OperationLimit
-
-	//trim spaces
-	operationLimitsString = strings.ReplaceAll(operationLimitsString, " ", "")
-	// for scenario where there is just for one limit and there is no separator , just potentially one limit, which has to by design be required to be the batch limit
-	if strings.Contains(operationLimitsString, constants.NotationOperationLimitsSeparator) == false {
-		// now we check the string if it at least has the format limit:value e.g batch:3,
-		// so it has to at least contain ":", and then when split , should be at least a len of 2
-		// we also need to make sure that we don't have more than one ":", this is to ensure that users always separate the limits with comma
-		if strings.Contains(operationLimitsString, constants.NotationOperationLimitAndValueSeparator) == true && strings.Count(operationLimitsString, constants.NotationOperationLimitAndValueSeparator) == 1 {
-
-			splitSingleLimit := strings.Split(operationLimitsString, constants.NotationOperationLimitAndValueSeparator)
-			// the len has to be at exactly 2, else it's not valid
-			if len(splitSingleLimit) == 2 {
-				// Now that we are here, if we have gotten to this point it means there is only one valid limit for this operation Limit,
-				// add a  comma to the end of the operationLimitsString , to ensure that the split below defined in splitLimits works, since this currently appears to be a likely valid limit
-				operationLimitsString = operationLimitsString + constants.NotationOperationLimitsSeparator
-			}
-		} else {
-			fmt.Println("malformed notation operation limits, check that its properly formed, and has the required limits")
-			return currentOperationLimit, fmt.Errorf("malformed notation operation limits, check that its properly formed, and has the required limits")
-		}
-
-	}
-
-	// for other scenarios where the separator is included, possibly indicating multiple limits
-	if strings.Contains(operationLimitsString, constants.NotationOperationLimitsSeparator) == true {
-		splitLimits := strings.Split(operationLimitsString, constants.NotationOperationLimitsSeparator)
-		if len(splitLimits) > 0 {
-
-			// loop through the limits in the slice
-			// if any of the limits or its value is invalid, return error
-			for i := 0; i < len(splitLimits); i++ {
-				currentLimitData := splitLimits[i]
-				//ensure the length of the limit data is not less than 5 chars , e.g all:5 is valid because its 5 characters
-				if len([]rune(currentLimitData)) >= 5 {
-					// check if current limit data contains the right seprator is
-					// if its not custom limit
-					if strings.Contains(currentLimitData, constants.NotationOperationCustomLimitKey) == true {
-						customLimitSlice, isCustomLimitValid := getNotationOperationCustomLimitValue(currentLimitData)
-						if isCustomLimitValid {
-							currentOperationLimit.CustomDurationsLimit = customLimitSlice
-						} else {
-							fmt.Println("malformed notation operation limits, check that the custom limits are properly formed")
-						}
-					} else {
-						// for other limits
-						currentLimitType, currentLimitValue, isCurrentLimitDataValid := getNotationOperationLimitAndValue(currentLimitData)
-
-						if isCurrentLimitDataValid == true { // set batch limit
-							if currentLimitType == constants.NotationOperationBatchLimitKey {
-								currentOperationLimit.BatchLimit = currentLimitValue
-								currentOperationLimit.BatchLimit = currentOperationLimit.getBatchLimit() //forces the default limit to be 1 , if this value is 0, because batch limit can't be 0
-							}
-
-							// set all time limit
-							if currentLimitType == constants.NotationOperationAllTimeLimitKey {
-								currentOperationLimit.AllTimeLimit = currentLimitValue
-							}
-							// set all minute limit
-							if currentLimitType == constants.NotationOperationMinuteLimitKey {
-								currentOperationLimit.PerMinuteLimit = currentLimitValue
-							}
-							// set all hour limit
-							if currentLimitType == constants.NotationOperationHourLimitKey {
-								currentOperationLimit.PerHourLimit = currentLimitValue
-							}
-							// set all day limit
-							if currentLimitType == constants.NotationOperationDayLimitKey {
-								currentOperationLimit.PerDayLimit = currentLimitValue
-							}
-							// set all week limit
-							if currentLimitType == constants.NotationOperationWeekLimitKey {
-								currentOperationLimit.PerWeekLimit = currentLimitValue
-							}
-
-							// set all fortnight limit
-							if currentLimitType == constants.NotationOperationFortnightLimitKey {
-								currentOperationLimit.PerFortnightLimit = currentLimitValue
-							}
-
-							// set all month limit
-							if currentLimitType == constants.NotationOperationMonthLimitKey {
-								currentOperationLimit.PerMonthLimit = currentLimitValue
-							}
-
-							// set all quarter limit
-							if currentLimitType == constants.NotationOperationQuarterLimitKey {
-								currentOperationLimit.PerQuarterLimit = currentLimitValue
-							}
-
-							// set all year limit
-							if currentLimitType == constants.NotationOperationYearLimitKey {
-								currentOperationLimit.PerYearLimit = currentLimitValue
-							}
-						} else {
-							// unknown limit, so return error
-							fmt.Printf("malformed notation operation limits, '%s' \n", currentLimitData)
-							return currentOperationLimit, fmt.Errorf("malformed notation operation limits, '%s' \n", currentLimitData)
-						}
-
-					}
-				}
-			}
-
-		}
-		return currentOperationLimit, nil
-	}
-
-	return currentOperationLimit, fmt.Errorf("unknown error") //todo come back and improve this error message
-
+// isEntityValid reports if the entity type is registered, see RegisterEntityType
+func isEntityValid(entityName string) bool {
+	return IsEntityTypeRegistered(entityName)
 }
 
 // RequestMethodToOperation receives a valid HTTP request method and converts it to an operation, using the standard REST conventions of :
 //
-// POST => create , GET => read , PUT => update , DELETE => delete ,
-// todo add "execute operation"
+// POST => create , GET, HEAD and OPTIONS => read , PUT and PATCH => update , DELETE => delete ,
+// There is no method for execute, use HTTPMiddleware.Routes to map routes like POST /run to execute
 func RequestMethodToOperation(method string) string {
 	method = strings.ToUpper(method)
 	if method == "POST" {
 		return constants.OperationCreate
 	}
-	if method == "GET" {
+	if method == "GET" || method == "HEAD" || method == "OPTIONS" {
 		return constants.OperationRead
 	}
-	if method == "PUT" {
+	if method == "PUT" || method == "PATCH" {
 		return constants.OperationUpdate
 	}
 
@@ -1256,51 +801,39 @@ type UpdateUsageData struct {
 	Operation                     string
 	OperationQuantity             uint
 	OperationTime                 time.Time
+	OperationLimits               OperationLimit // the limits of the operation, the custom durations in OperationLimits.CustomDurationsLimit are tracked in the usage, and OperationLimits.CalendarWindows are reset at calendar boundaries
 }
 
 func UpdateUsage(updateUsageData UpdateUsageData, usage PermissionUsage) PermissionUsage {
-	var operationUsage OperationUsage
-
-	// for create operation
-	if updateUsageData.Operation == constants.OperationCreate {
-		operationUsage = usage.CreateOperationUsages
-		//increase quota usage by one since we are creating a "resource"
-		usage.QuotaUsage = usage.QuotaUsage + updateUsageData.OperationQuantity
+	// usage of operations that are not registered is never tracked
+	if isOperationValid(updateUsageData.Operation) == false {
+		return usage
 	}
 
-	if updateUsageData.Operation == constants.OperationRead {
-		operationUsage = usage.ReadOperationUsages
-	}
-
-	if updateUsageData.Operation == constants.OperationUpdate {
-		operationUsage = usage.UpdateOperationUsages
-	}
+	operationUsage := getOperationUsage(updateUsageData.Operation, usage)
 
-	if updateUsageData.Operation == constants.OperationDelete {
-		operationUsage = usage.DeleteOperationUsages
+	switch operationQuotaEffect(updateUsageData.Operation) {
+	case constants.QuotaEffectIncrease:
+		//increase quota usage by one since we are creating a "resource"
+		usage.QuotaUsage = usage.QuotaUsage + updateUsageData.OperationQuantity
+	case constants.QuotaEffectDecrease:
 		// let's reduce the QuotaUsage by operationQuantity since the Quota has reduced as a result of delete
 		// don't reduce it if DoNotReduceQuotaUsageOnDelete is true
 		if updateUsageData.DoNotReduceQuotaUsageOnDelete == false {
-			quotaUsageAfterDelete := usage.QuotaUsage - updateUsageData.OperationQuantity
 			// let's ensure it's not less than 0 , if it is assign 0
 			// normally, this shouldn't happen, but if for some reason it does, set it at 0
-			if quotaUsageAfterDelete < 0 {
-				quotaUsageAfterDelete = 0
+			if updateUsageData.OperationQuantity > usage.QuotaUsage {
+				usage.QuotaUsage = 0
+			} else {
+				usage.QuotaUsage = usage.QuotaUsage - updateUsageData.OperationQuantity
 			}
-			usage.QuotaUsage = quotaUsageAfterDelete
 		}
-
-	}
-
-	if updateUsageData.Operation == constants.OperationExecute {
-		operationUsage = usage.ExecuteOperationUsages
 	}
 
 	//Let's reduce all the operation usage where necessary if duration has passed from the LastTime
 	// What does this mean? for example, if the lastTime we updated a file was 2:55pm and the current time is 3:56pm , this means 1 hour and 1 minute has passed .
 	// This means more than an hour and minute has passed, so we need to reset OperationUsage.WithinTheLastMinute and OperationUsage.WithinTheLastHour and set those values to current operationQuantity value
 	// But if the current time is 3:01 pm , this means  6 minutes has passed and we only need to reset WithinTheLastMinute and increment every other duration limit including WithinTheLastHour
-	// todo remember to do same for custom duration, leaving it put for now because its a bit more complex
 
 	// let's first update firstTime if this is the first time we are updating the usage
 	if operationUsage.FirstTime.IsZero() {
@@ -1308,6 +841,7 @@ func UpdateUsage(updateUsageData UpdateUsageData, usage PermissionUsage) Permiss
 	}
 
 	durationFromLastTime := updateUsageData.OperationTime.Sub(operationUsage.LastTime)
+	previousOperationUsage := operationUsage
 
 	// update last quantity
 	operationUsage.LastQuantity = updateUsageData.OperationQuantity
@@ -1401,28 +935,131 @@ func UpdateUsage(updateUsageData UpdateUsageData, usage PermissionUsage) Permiss
 		operationUsage.WithinTheLastYear = updateUsageData.OperationQuantity
 	}
 
-	// todo custom durations
+	// update within the last custom durations
+	operationUsage.WithinTheLastCustomDurations = updateCustomDurationUsages(operationUsage.WithinTheLastCustomDurations, updateUsageData.OperationLimits.CustomDurationsLimit, updateUsageData.OperationQuantity, durationFromLastTime)
+
+	// in sliding window mode, record the operation in the sliding window buckets, this also sets the within the last durations usages above to their accurate values
+	if operationUsage.SlidingWindow == true {
+		operationUsage.updateSlidingWindows(updateUsageData.OperationLimits.CustomDurationsLimit, updateUsageData.OperationQuantity, updateUsageData.OperationTime)
+	}
+
+	// calendar windows are only reset when a calendar boundary has passed since the last time
+	operationUsage.updateCalendarWindows(previousOperationUsage, updateUsageData.OperationLimits, updateUsageData.OperationQuantity, updateUsageData.OperationTime)
 
 	// update lastTime always
 	operationUsage.LastTime = updateUsageData.OperationTime
 
-	switch updateUsageData.Operation {
-	case constants.OperationCreate:
-		usage.CreateOperationUsages = operationUsage
-		break
-	case constants.OperationRead:
-		usage.ReadOperationUsages = operationUsage
-		break
-	case constants.OperationUpdate:
-		usage.UpdateOperationUsages = operationUsage
-		break
-	case constants.OperationDelete:
-		usage.DeleteOperationUsages = operationUsage
-		break
-	case constants.OperationExecute:
-		usage.ExecuteOperationUsages = operationUsage
-		break
+	setOperationUsage(updateUsageData.Operation, &usage, operationUsage)
+	return usage
+
+}
+
+// refundUsage takes an operation that was charged with UpdateUsage back out of the usage, e.g because it failed after it was permitted
+// The quantity is taken out of every usage it was added to, the quota change is reversed, and LastTime and FirstTime are left as they are. Usages never go below 0
+func refundUsage(updateUsageData UpdateUsageData, usage PermissionUsage) PermissionUsage {
+	if isOperationValid(updateUsageData.Operation) == false {
+		return usage
 	}
+
+	operationUsage := getOperationUsage(updateUsageData.Operation, usage)
+	quantity := updateUsageData.OperationQuantity
+
+	switch operationQuotaEffect(updateUsageData.Operation) {
+	case constants.QuotaEffectIncrease:
+		usage.QuotaUsage = remainingWithin(usage.QuotaUsage, quantity)
+	case constants.QuotaEffectDecrease:
+		if updateUsageData.DoNotReduceQuotaUsageOnDelete == false {
+			usage.QuotaUsage = usage.QuotaUsage + quantity
+		}
+	}
+
+	previousOperationUsage := operationUsage
+	operationUsage.AllTime = remainingWithin(operationUsage.AllTime, quantity)
+	if operationUsage.SlidingWindow == true && len(operationUsage.SlidingWindowBuckets) > 0 {
+		refundedBuckets := make(map[string]SlidingWindowBuckets)
+		for key, buckets := range operationUsage.SlidingWindowBuckets {
+			refundedBuckets[key] = buckets.subtract(updateUsageData.OperationTime, quantity)
+		}
+		operationUsage.SlidingWindowBuckets = refundedBuckets
+		operationUsage.applySlidingWindows(updateUsageData.OperationTime)
+	} else {
+		for limitKey := range slidingWindowDurations {
+			if usageWithin := operationUsage.withinTheLast(limitKey); usageWithin != nil {
+				*usageWithin = remainingWithin(*usageWithin, quantity)
+			}
+		}
+		if operationUsage.WithinTheLastCustomDurations != nil {
+			customDurationUsages := make(CustomDurationUsages)
+			for key, customDurationUsage := range operationUsage.WithinTheLastCustomDurations {
+				customDurationUsages[key] = remainingWithin(customDurationUsage, quantity)
+			}
+			operationUsage.WithinTheLastCustomDurations = customDurationUsages
+		}
+	}
+
+	// calendar windows aren't counted by the sliding window buckets, so they are refunded from what they were
+	for _, limitKey := range updateUsageData.OperationLimits.CalendarWindows {
+		if usageWithin := operationUsage.withinTheLast(limitKey); usageWithin != nil {
+			*usageWithin = remainingWithin(*previousOperationUsage.withinTheLast(limitKey), quantity)
+		}
+	}
+
+	setOperationUsage(updateUsageData.Operation, &usage, operationUsage)
 	return usage
+}
+
+// UpdatedUsages holds the new usage of every entity in the EntityPermissionOrder after an operation is consumed, keyed by Entity.Key() e.g constants.EntityUser or role:auditor
+type UpdatedUsages map[string]PermissionUsage
+
+// ResourceUsages holds the new usage of every entity in the EntityPermissionOrder after an operation is consumed, keyed by the UsageKey of the entity,
+// whose Resource is the resource name or pattern of the entity's Policy that matched the requested resource, see Policy.Match , or the requested resource for entities without a policy
+// It's what ConsumeResource returns, so the usage can be written back to the right entry of the PolicyUsage without matching the resource again
+type ResourceUsages map[UsageKey]PermissionUsage
+
+// Consume checks if the operation is permitted with usage, just like CheckOperationWithUsage, and only if it is, it returns the new usage of exactly the entities in the EntityPermissionOrder, updated with UpdateUsage
+// This replaces calling IsOperationPermittedWithUsage, then UpdateUsage for every entity, so no entity is forgotten, and entities that are not in the order are not updated
+// When there are multiple entities of the same type, only the entities that granted the operation are updated, see PermissionRequestData.CombiningRules
+// operationTime is the time the operation is performed, usually time.Now(), the operation is also checked at that time. If the operation is denied, UpdatedUsages is nil
+// For entities with a Policy, use ConsumeResource to know which resource of the policy the usage belongs to
+func Consume(requestData PermissionWithUsageRequestData, operationTime time.Time) (Decision, UpdatedUsages) {
+	decision, resourceUsages := ConsumeResource(requestData, operationTime)
+	if decision.Allowed == false {
+		return decision, nil
+	}
+
+	updatedUsages := make(UpdatedUsages)
+	for usageKey, usage := range resourceUsages {
+		updatedUsages[Entity{Type: usageKey.EntityType, ID: usageKey.EntityID}.Key()] = usage
+	}
+	return decision, updatedUsages
+}
+
+// ConsumeResource is Consume, with the new usages keyed by UsageKey, so the resource name or pattern of the Policy of each entity that matched the requested resource is returned with its usage, see ResourceUsages
+//
+//	decision, resourceUsages := permitta.ConsumeResource(requestData, time.Now())
+//	for usageKey, usage := range resourceUsages {
+//		userPolicyUsage[usageKey.Resource] = usage // e.g "/projects/*/reports/**"
+//	}
+func ConsumeResource(requestData PermissionWithUsageRequestData, operationTime time.Time) (Decision, ResourceUsages) {
+	decision, grantingEntities := checkOperationWithUsage(requestData, operationTime)
+	if decision.Allowed == false {
+		return decision, nil
+	}
+
+	resourceUsages := make(ResourceUsages)
+	for _, entity := range grantingEntities {
+		usageKey := UsageKey{EntityType: entity.Type, EntityID: entity.ID, Resource: entity.usageResource(requestData.Resource)}
+		if _, isUpdated := resourceUsages[usageKey]; isUpdated {
+			continue
+		}
+		updateUsageData := UpdateUsageData{
+			Operation:         requestData.Operation,
+			OperationQuantity: requestData.OperationQuantity,
+			OperationTime:     operationTime,
+			OperationLimits:   GetOperationLimits(requestData.Operation, entity.Permission),
+		}
+		resourceUsages[usageKey] = UpdateUsage(updateUsageData, entity.Usage)
+	}
 
+	return decision, resourceUsages
 }
@@ -1,10 +1,24 @@
 package permitta
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	constants "github.com/limitlessdonald/permitta/constants"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -172,11 +186,14 @@ func TestIsEntityOperationPermitted(t *testing.T) {
 	//m|min|mins|minute|minutes|
 	notation := "-rude|start=1752817851|end=1752821969|q=5|r=year:56"
 	permission := NotationToPermission(notation)
-	isOperationPermitted := IsEntityOperationPermitted(constants.OperationRead, permission)
+	isOperationPermitted := CheckEntityOperationAt(constants.OperationRead, permission, time.Unix(1752819000, 0)).Allowed
 	fmt.Printf("%+v\n", permission)
 	if isOperationPermitted == false {
 		t.Errorf("Simple permission check faileds")
 	}
+	if IsEntityOperationPermitted(constants.OperationRead, permission) == true {
+		t.Errorf("Expected expired permission to be denied")
+	}
 }
 
 func TestPlayground(t *testing.T) {
@@ -189,3 +206,1797 @@ func TestPlayground(t *testing.T) {
 
 	fmt.Println(string(jsonBytes))
 }
+
+func TestCheckOperationWithUsage(t *testing.T) {
+	permissionRequestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			UserEntityPermissions: NotationToPermission("crude|c=batch:5,hour:10"),
+			OrgEntityPermissions:  NotationToPermission("crude|q=20|c=batch:5"),
+			EntityPermissionOrder: "org->user",
+		},
+		OperationQuantity: 3,
+		UserEntityUsage: PermissionUsage{
+			CreateOperationUsages: OperationUsage{
+				LastTime:          time.Now(),
+				WithinTheLastHour: 8,
+			},
+		},
+	}
+
+	decision := CheckOperationWithUsage(permissionRequestData)
+	if decision.Allowed == true {
+		t.Fatalf("Expected hour limit to deny operation, got %s", decision)
+	}
+	if decision.Entity != constants.EntityUser || decision.Reason != constants.ReasonHourLimitExceeded {
+		t.Errorf("Expected user %s, got %s %s", constants.ReasonHourLimitExceeded, decision.Entity, decision.Reason)
+	}
+	if decision.Limit != 10 || decision.Usage != 8 || decision.Quantity != 3 {
+		t.Errorf("Expected limit 10, usage 8, quantity 3, got %+v", decision)
+	}
+
+	permissionRequestData.OperationQuantity = 2
+	decision = CheckOperationWithUsage(permissionRequestData)
+	if decision.Allowed == false {
+		t.Errorf("Expected operation to be permitted, got %s", decision)
+	}
+
+	permissionRequestData.OrgEntityPermissions = NotationToPermission("-rude")
+	decision = CheckOperationWithUsage(permissionRequestData)
+	if decision.Entity != constants.EntityOrg || decision.Reason != constants.ReasonOperationNotGranted {
+		t.Errorf("Expected org %s, got %s", constants.ReasonOperationNotGranted, decision)
+	}
+}
+
+func TestParseNotation(t *testing.T) {
+	permission, err := ParseNotation("cr-d-| q=5 |c=batch:2,hour:10|d=all:3,")
+	if err != nil {
+		t.Fatalf("Expected notation to be parsed, got %s", err)
+	}
+	if permission.QuotaLimit != 5 || permission.CreateOperationLimits.BatchLimit != 2 || permission.CreateOperationLimits.PerHourLimit != 10 || permission.DeleteOperationLimits.AllTimeLimit != 3 {
+		t.Errorf("Unexpected permission %+v", permission)
+	}
+
+	malformedNotations := []struct {
+		notation string
+		err      error
+		section  int
+		token    string
+		offset   int
+	}{
+		{"", ErrEmptyNotation, 0, "", 0},
+		{"cred-", ErrMalformedOperationSection, 0, "cred-", 0},
+		{"cr-de|c=batch:2,minute:abc", ErrMalformedLimit, 1, "minute:abc", 16},
+		{"cr-de|c=batch:2, minutes:5", ErrMalformedLimit, 1, "minutes:5", 17},
+		{"cr-de|c=batch:0", ErrMalformedLimit, 1, "batch:0", 8},
+		{"cr-de|q=5|quota=5", ErrUnknownSection, 2, "quota=5", 10},
+		{"cr-de|q=5|q=6", ErrDuplicateSection, 2, "q=6", 10},
+		{"cr-de|q=five", ErrMalformedQuota, 1, "five", 8},
+	}
+
+	for _, malformedNotation := range malformedNotations {
+		_, err := ParseNotation(malformedNotation.notation)
+		var notationError *NotationError
+		if errors.As(err, &notationError) == false {
+			t.Errorf("Expected NotationError for %q, got %v", malformedNotation.notation, err)
+			continue
+		}
+		if errors.Is(err, malformedNotation.err) == false || notationError.Section != malformedNotation.section || notationError.Token != malformedNotation.token || notationError.Offset != malformedNotation.offset {
+			t.Errorf("Unexpected error for %q : %+v", malformedNotation.notation, notationError)
+		}
+		if malformedNotation.err != ErrEmptyNotation && notationError.Suggestion == "" {
+			t.Errorf("Expected a suggestion for %q", malformedNotation.notation)
+		}
+	}
+}
+
+func TestPermissionToNotation(t *testing.T) {
+	notations := map[string]string{
+		"crude":                               "crude",
+		"cr-d-|c=batch:1":                     "cr-d-",
+		" -r--e | q=0 | r=year:56,batch:3|e=": "-r--e|r=batch:3,year:56",
+		"cr-d-|q=5|r=all:100000,quarter:80000|c=fortnight:30,hour:103,minute:3,all:100,batch:2|start=1735693200|end=1767229200|u=year:10000": "cr-d-|start=2025-01-01T01:00:00Z|end=2026-01-01T01:00:00Z|q=5|c=batch:2,all:100,minute:3,hour:103,fortnight:30|r=all:100000,quarter:80000",
+		"crud-|u=custom:[per_32_seconds_67&per_9_weeks_1200],month:5000":                                                                     "crud-|u=month:5000,custom:[per_32_seconds_67&per_9_weeks_1200]",
+	}
+
+	for notation, expectedNotation := range notations {
+		normalizedNotation, err := NormalizeNotation(notation)
+		if err != nil {
+			t.Errorf("Expected %q to be normalized, got %s", notation, err)
+			continue
+		}
+		if normalizedNotation != expectedNotation {
+			t.Errorf("Expected %q got %q", expectedNotation, normalizedNotation)
+		}
+
+		// the canonical notation should round trip exactly
+		permission := NotationToPermission(notation)
+		roundTripPermission := NotationToPermission(PermissionToNotation(permission))
+		if reflect.DeepEqual(permission, roundTripPermission) == false {
+			t.Errorf("Expected %+v got %+v", permission, roundTripPermission)
+		}
+	}
+}
+
+func TestCustomDurationLimits(t *testing.T) {
+	permission, err := ParseNotation("crude|c=batch:5,custom:[per_32_seconds_3 & per_9_weeks_1200 & per_1_M_40]")
+	if err != nil {
+		t.Fatalf("Expected notation to be parsed, got %s", err)
+	}
+	expectedCustomDurationsLimit := []CustomDurationLimit{
+		{Every: 32 * time.Second, Max: 3},
+		{Every: 9 * constants.TimeDurationWeek, Max: 1200},
+		{Every: constants.TimeDurationMonth, Max: 40},
+	}
+	if reflect.DeepEqual(permission.CreateOperationLimits.CustomDurationsLimit, expectedCustomDurationsLimit) == false {
+		t.Fatalf("Unexpected custom durations limit %v", permission.CreateOperationLimits.CustomDurationsLimit)
+	}
+
+	// custom durations are stored as strings in json
+	jsonBytes, _ := json.Marshal(permission.CreateOperationLimits)
+	var operationLimit OperationLimit
+	if err := json.Unmarshal(jsonBytes, &operationLimit); err != nil || reflect.DeepEqual(operationLimit, permission.CreateOperationLimits) == false {
+		t.Errorf("Expected custom durations limit to round trip through json, got %s %v", jsonBytes, err)
+	}
+
+	if _, err := ParseNotation("crude|c=custom:[per_2_fortnights_5]"); errors.Is(err, ErrMalformedLimit) == false {
+		t.Errorf("Expected unknown unit to be rejected, got %v", err)
+	}
+
+	usage := UpdateUsage(UpdateUsageData{
+		Operation:         constants.OperationCreate,
+		OperationQuantity: 2,
+		OperationTime:     time.Now(),
+		OperationLimits:   permission.CreateOperationLimits,
+	}, PermissionUsage{})
+	if usage.CreateOperationUsages.WithinTheLastCustomDurations["32s"] != 2 {
+		t.Fatalf("Expected custom duration usage to be updated, got %v", usage.CreateOperationUsages.WithinTheLastCustomDurations)
+	}
+
+	permissionRequestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			UserEntityPermissions: permission,
+			EntityPermissionOrder: constants.EntityUser,
+		},
+		OperationQuantity: 2,
+		UserEntityUsage:   usage,
+	}
+	decision := CheckOperationWithUsage(permissionRequestData)
+	if decision.Allowed == true || decision.Reason != constants.ReasonCustomDurationLimitExceeded || decision.Window != "32s" {
+		t.Errorf("Expected custom duration limit to deny operation, got %+v", decision)
+	}
+
+	// once the custom duration has passed, the usage is no longer counted
+	permissionRequestData.UserEntityUsage.CreateOperationUsages.LastTime = time.Now().Add(-33 * time.Second)
+	decision = CheckOperationWithUsage(permissionRequestData)
+	if decision.Allowed == false {
+		t.Errorf("Expected operation to be permitted, got %s", decision)
+	}
+}
+
+func TestSlidingWindowUsage(t *testing.T) {
+	permission := NotationToPermission("crude|r=hour:3")
+	now := time.Now()
+	lastTouchUsage := PermissionUsage{}
+	slidingWindowUsage := PermissionUsage{}
+	slidingWindowUsage.EnableSlidingWindows()
+
+	// one read every 59 minutes
+	for _, minutesAgo := range []int{177, 118, 59, 0} {
+		updateUsageData := UpdateUsageData{
+			Operation:         constants.OperationRead,
+			OperationQuantity: 1,
+			OperationTime:     now.Add(-time.Duration(minutesAgo) * time.Minute),
+		}
+		lastTouchUsage = UpdateUsage(updateUsageData, lastTouchUsage)
+		slidingWindowUsage = UpdateUsage(updateUsageData, slidingWindowUsage)
+	}
+
+	if lastTouchUsage.ReadOperationUsages.WithinTheLastHour != 4 {
+		t.Errorf("Expected last touch usage within the last hour to be 4, got %d", lastTouchUsage.ReadOperationUsages.WithinTheLastHour)
+	}
+	if slidingWindowUsage.ReadOperationUsages.WithinTheLastHour != 2 || slidingWindowUsage.ReadOperationUsages.WithinTheLastDay != 4 {
+		t.Errorf("Expected sliding window usage within the last hour to be 2 and day to be 4, got %d and %d", slidingWindowUsage.ReadOperationUsages.WithinTheLastHour, slidingWindowUsage.ReadOperationUsages.WithinTheLastDay)
+	}
+
+	// sliding windows survive being stored as json
+	jsonBytes, _ := json.Marshal(slidingWindowUsage)
+	var storedUsage PermissionUsage
+	if err := json.Unmarshal(jsonBytes, &storedUsage); err != nil {
+		t.Fatal(err)
+	}
+
+	permissionRequestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationRead,
+			UserEntityPermissions: permission,
+			EntityPermissionOrder: constants.EntityUser,
+		},
+		OperationQuantity: 1,
+		UserEntityUsage:   lastTouchUsage,
+	}
+	if decision := CheckOperationWithUsage(permissionRequestData); decision.Reason != constants.ReasonHourLimitExceeded {
+		t.Errorf("Expected last touch usage to deny operation, got %s", decision)
+	}
+
+	permissionRequestData.UserEntityUsage = storedUsage
+	if decision := CheckOperationWithUsage(permissionRequestData); decision.Allowed == false {
+		t.Errorf("Expected sliding window usage to permit operation, got %s", decision)
+	}
+}
+
+func TestCalendarWindows(t *testing.T) {
+	notation := "crude|c=month@cal:1000,day:5,tz:America/New_York,anchor:15"
+	permission, err := ParseNotation(notation)
+	if err != nil {
+		t.Fatalf("Expected notation to be parsed, got %s", err)
+	}
+	createOperationLimits := permission.CreateOperationLimits
+	if reflect.DeepEqual(createOperationLimits.CalendarWindows, []string{constants.NotationOperationMonthLimitKey}) == false || createOperationLimits.Location != "America/New_York" || createOperationLimits.AnchorDay != 15 {
+		t.Fatalf("Unexpected operation limits %+v", createOperationLimits)
+	}
+	if normalizedNotation, _ := NormalizeNotation(notation); normalizedNotation != "crude|c=day:5,month@cal:1000,tz:America/New_York,anchor:15" {
+		t.Errorf("Unexpected normalized notation %s", normalizedNotation)
+	}
+	if _, err := ParseNotation("crude|c=fortnight@cal:5"); errors.Is(err, ErrMalformedLimit) == false {
+		t.Errorf("Expected fortnight calendar window to be rejected, got %v", err)
+	}
+
+	newYork := createOperationLimits.location()
+	windowStarts := []struct {
+		limitKey    string
+		t           time.Time
+		anchorDay   uint
+		windowStart time.Time
+	}{
+		{constants.NotationOperationMonthLimitKey, time.Date(2026, time.March, 10, 12, 0, 0, 0, newYork), 15, time.Date(2026, time.February, 15, 0, 0, 0, 0, newYork)},
+		{constants.NotationOperationMonthLimitKey, time.Date(2026, time.March, 20, 12, 0, 0, 0, newYork), 31, time.Date(2026, time.February, 28, 0, 0, 0, 0, newYork)},
+		{constants.NotationOperationQuarterLimitKey, time.Date(2026, time.May, 20, 12, 0, 0, 0, newYork), 0, time.Date(2026, time.April, 1, 0, 0, 0, 0, newYork)},
+		{constants.NotationOperationWeekLimitKey, time.Date(2026, time.October, 18, 12, 0, 0, 0, newYork), 0, time.Date(2026, time.October, 12, 0, 0, 0, 0, newYork)},
+		{constants.NotationOperationYearLimitKey, time.Date(2026, time.January, 10, 12, 0, 0, 0, newYork), 15, time.Date(2025, time.January, 15, 0, 0, 0, 0, newYork)},
+	}
+	for _, windowStart := range windowStarts {
+		if calculatedWindowStart := calendarWindowStart(windowStart.limitKey, windowStart.t, newYork, windowStart.anchorDay); calculatedWindowStart.Equal(windowStart.windowStart) == false {
+			t.Errorf("Expected %s window of %s to start at %s, got %s", windowStart.limitKey, windowStart.t, windowStart.windowStart, calculatedWindowStart)
+		}
+	}
+
+	// usage resets on the 1st of the month, even though less than 30 days have passed
+	monthlyLimits := NotationToPermission("crude|c=month@cal:10").CreateOperationLimits
+	usage := PermissionUsage{CreateOperationUsages: OperationUsage{
+		LastTime:           time.Date(2026, time.January, 31, 23, 0, 0, 0, time.UTC),
+		WithinTheLastMonth: 10,
+	}}
+	usage = UpdateUsage(UpdateUsageData{
+		Operation:         constants.OperationCreate,
+		OperationQuantity: 1,
+		OperationTime:     time.Date(2026, time.February, 1, 1, 0, 0, 0, time.UTC),
+		OperationLimits:   monthlyLimits,
+	}, usage)
+	if usage.CreateOperationUsages.WithinTheLastMonth != 1 {
+		t.Errorf("Expected calendar month usage to be reset, got %d", usage.CreateOperationUsages.WithinTheLastMonth)
+	}
+
+	permissionRequestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			UserEntityPermissions: NotationToPermission("crude|c=month@cal:10"),
+			EntityPermissionOrder: constants.EntityUser,
+		},
+		OperationQuantity: 1,
+		UserEntityUsage: PermissionUsage{CreateOperationUsages: OperationUsage{
+			LastTime:           calendarWindowStart(constants.NotationOperationMonthLimitKey, time.Now(), time.UTC, 0).Add(-time.Minute),
+			WithinTheLastMonth: 10,
+		}},
+	}
+	if decision := CheckOperationWithUsage(permissionRequestData); decision.Allowed == false {
+		t.Errorf("Expected calendar month usage from last month to be ignored, got %s", decision)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	permissionRequestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			UserEntityPermissions: NotationToPermission("crude|c=batch:2,hour:3"),
+			RoleEntityPermissions: NotationToPermission("crude|c=batch:2"),
+			OrgEntityPermissions:  NotationToPermission("crude|c=batch:2|q=10"),
+			EntityPermissionOrder: "org->user",
+		},
+		OperationQuantity: 2,
+		OrgEntityUsage:    PermissionUsage{QuotaUsage: 4},
+	}
+
+	operationTime := time.Now()
+	decision, updatedUsages := Consume(permissionRequestData, operationTime)
+	if decision.Allowed == false {
+		t.Fatalf("Expected operation to be permitted, got %s", decision)
+	}
+	if len(updatedUsages) != 2 {
+		t.Fatalf("Expected usages of only org and user to be updated, got %v", updatedUsages)
+	}
+	if updatedUsages[constants.EntityOrg].QuotaUsage != 6 || updatedUsages[constants.EntityUser].CreateOperationUsages.WithinTheLastHour != 2 || updatedUsages[constants.EntityUser].CreateOperationUsages.LastTime.Equal(operationTime) == false {
+		t.Errorf("Unexpected updated usages %+v", updatedUsages)
+	}
+
+	permissionRequestData.OrgEntityUsage = updatedUsages[constants.EntityOrg]
+	permissionRequestData.UserEntityUsage = updatedUsages[constants.EntityUser]
+	decision, updatedUsages = Consume(permissionRequestData, operationTime)
+	if decision.Reason != constants.ReasonHourLimitExceeded || updatedUsages != nil {
+		t.Errorf("Expected hour limit to deny operation without updating usages, got %s %v", decision, updatedUsages)
+	}
+}
+
+func TestUsageStores(t *testing.T) {
+	key := UsageKey{EntityType: constants.EntityUser, EntityID: "42", Resource: "files"}
+	filePath := t.TempDir() + "/usages.jsonl"
+	fileUsageStore, err := OpenFileUsageStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for storeName, usageStore := range map[string]UsageStore{"memory": NewMemoryUsageStore(), "file": fileUsageStore} {
+		usage, version, err := usageStore.Get(key)
+		if err != nil || version != 0 || usage.QuotaUsage != 0 {
+			t.Errorf("%s: expected empty usage with version 0, got %+v %d %v", storeName, usage, version, err)
+		}
+		if err := usageStore.Put(key, PermissionUsage{QuotaUsage: 1}); err != nil {
+			t.Fatalf("%s: %v", storeName, err)
+		}
+		if isSaved, err := usageStore.CompareAndSwap(key, 0, PermissionUsage{QuotaUsage: 5}); isSaved || err != nil {
+			t.Errorf("%s: expected compare and swap with an old version to fail, got %v %v", storeName, isSaved, err)
+		}
+		if isSaved, err := usageStore.CompareAndSwap(key, 1, PermissionUsage{QuotaUsage: 2}); isSaved == false || err != nil {
+			t.Errorf("%s: expected compare and swap with the current version to succeed, got %v %v", storeName, isSaved, err)
+		}
+		usage, version, _ = usageStore.Get(key)
+		if usage.QuotaUsage != 2 || version != 2 {
+			t.Errorf("%s: expected usage 2 with version 2, got %d %d", storeName, usage.QuotaUsage, version)
+		}
+	}
+
+	if err := fileUsageStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopenedFileUsageStore, err := OpenFileUsageStore(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopenedFileUsageStore.Close()
+	usage, version, _ := reopenedFileUsageStore.Get(key)
+	if usage.QuotaUsage != 2 || version != 2 {
+		t.Errorf("Expected reopened file store to replay usage 2 with version 2, got %d %d", usage.QuotaUsage, version)
+	}
+	reopenedFileUsageStore.Close()
+
+	// a line torn by a crash at the end of the file is removed, while an invalid line in the middle of it is corruption
+	tornLine := `{"entityType":"user","entityId":"42","resource":"files","version":9,"usage":{"Quota`
+	os.WriteFile(filePath, append(mustReadFile(t, filePath), tornLine...), 0o644)
+	tornFileUsageStore, err := OpenFileUsageStore(filePath)
+	if err != nil {
+		t.Fatalf("Expected a torn last line to be ignored, got %v", err)
+	}
+	if err := tornFileUsageStore.Put(key, PermissionUsage{QuotaUsage: 3}); err != nil {
+		t.Fatal(err)
+	}
+	tornFileUsageStore.Close()
+	if lines := strings.Split(strings.TrimSpace(string(mustReadFile(t, filePath))), "\n"); len(lines) != 3 || strings.Contains(string(mustReadFile(t, filePath)), tornLine) {
+		t.Errorf("Expected the torn line to be replaced by the next usage, got %q", lines)
+	}
+	os.WriteFile(filePath, append([]byte(tornLine+"\n"), mustReadFile(t, filePath)...), 0o644)
+	if _, err := OpenFileUsageStore(filePath); err == nil || strings.Contains(err.Error(), "line 1") == false {
+		t.Errorf("Expected an invalid first line to be an error, got %v", err)
+	}
+
+	// the file is compacted to the latest version of every usage once it has enough old versions
+	compactedFilePath := t.TempDir() + "/usages.jsonl"
+	compactedFileUsageStore, err := OpenFileUsageStore(compactedFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= constants.FileUsageStoreCompactionThreshold; i++ {
+		compactedFileUsageStore.Put(UsageKey{EntityType: constants.EntityUser, EntityID: strconv.Itoa(i % 2)}, PermissionUsage{QuotaUsage: uint(i)})
+	}
+	compactedFileUsageStore.Close()
+	if lines := strings.Split(strings.TrimSpace(string(mustReadFile(t, compactedFilePath))), "\n"); len(lines) != 2 {
+		t.Errorf("Expected the file to be compacted to 2 usages, got %d lines", len(lines))
+	}
+	compactedFileUsageStore, _ = OpenFileUsageStore(compactedFilePath)
+	defer compactedFileUsageStore.Close()
+	if usage, version, _ := compactedFileUsageStore.Get(UsageKey{EntityType: constants.EntityUser, EntityID: "0"}); usage.QuotaUsage != constants.FileUsageStoreCompactionThreshold || version != constants.FileUsageStoreCompactionThreshold/2 {
+		t.Errorf("Expected the compacted file to keep the latest usage and version, got %d %d", usage.QuotaUsage, version)
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestEngineConsume(t *testing.T) {
+	engine := NewEngine(NewMemoryUsageStore())
+	requestData := StoreRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			UserEntityPermissions: NotationToPermission("crude|c=batch:1,hour:150"),
+			OrgEntityPermissions:  NotationToPermission("crude|q=100|c=batch:1"),
+			EntityPermissionOrder: "org->user",
+		},
+		OperationQuantity: 1,
+		EntityIDs:         EntityIDs{constants.EntityOrg: "acme", constants.EntityUser: "42"},
+	}
+
+	var waitGroup sync.WaitGroup
+	var allowedCount atomic.Int64
+	for i := 0; i < 120; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			decision, err := engine.Consume(requestData, time.Now())
+			if err != nil {
+				t.Error(err)
+			}
+			if decision.Allowed {
+				allowedCount.Add(1)
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	orgUsage, _, _ := engine.Store.Get(UsageKey{EntityType: constants.EntityOrg, EntityID: "acme"})
+	userUsage, _, _ := engine.Store.Get(UsageKey{EntityType: constants.EntityUser, EntityID: "42"})
+	if allowedCount.Load() != 100 || orgUsage.QuotaUsage != 100 || userUsage.CreateOperationUsages.WithinTheLastHour != 100 {
+		t.Errorf("Expected exactly 100 operations to be permitted and counted, got %d permitted, org quota usage %d, user hour usage %d", allowedCount.Load(), orgUsage.QuotaUsage, userUsage.CreateOperationUsages.WithinTheLastHour)
+	}
+
+	if _, err := engine.Check(StoreRequestData{PermissionRequestData: requestData.PermissionRequestData}); err == nil {
+		t.Errorf("Expected an error when entity IDs are missing")
+	}
+
+	// if saving the usage of the user fails after the usage of the org is saved, the org is refunded
+	failingStore := &failingUsageStore{UsageStore: NewMemoryUsageStore(), failingWrite: 2}
+	engine = NewEngine(failingStore)
+	if _, err := engine.Consume(requestData, time.Now()); errors.Is(err, errUsageStoreWrite) == false {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+	orgUsage, _, _ = engine.Store.Get(UsageKey{EntityType: constants.EntityOrg, EntityID: "acme"})
+	userUsage, _, _ = engine.Store.Get(UsageKey{EntityType: constants.EntityUser, EntityID: "42"})
+	if orgUsage.QuotaUsage != 0 || orgUsage.CreateOperationUsages.AllTime != 0 || userUsage.CreateOperationUsages.AllTime != 0 {
+		t.Errorf("Expected nothing to be charged, got org quota usage %d, org all time usage %d, user all time usage %d", orgUsage.QuotaUsage, orgUsage.CreateOperationUsages.AllTime, userUsage.CreateOperationUsages.AllTime)
+	}
+}
+
+var errUsageStoreWrite = errors.New("usage store write failed")
+
+// failingUsageStore is a UsageStore whose CompareAndSwap fails with errUsageStoreWrite on the write numbered failingWrite, counting from 1
+type failingUsageStore struct {
+	UsageStore
+	writeCount   int
+	failingWrite int
+}
+
+func (store *failingUsageStore) CompareAndSwap(key UsageKey, version uint64, usage PermissionUsage) (bool, error) {
+	store.writeCount++
+	if store.writeCount == store.failingWrite {
+		return false, errUsageStoreWrite
+	}
+	return store.UsageStore.CompareAndSwap(key, version, usage)
+}
+
+// fakeSQLDriver is a database/sql driver that understands only the queries of SQLUsageStore, it keeps rows in memory
+type fakeSQLDriver struct {
+	mutex   sync.Mutex
+	rows    map[string][2]driver.Value // version and usage_data keyed by entity_type:entity_id:resource
+	queries []string
+	// isUpdateIgnored makes every UPDATE report no row affected, like a row that keeps being changed by someone else
+	isUpdateIgnored bool
+}
+
+type fakeSQLConn struct{ sqlDriver *fakeSQLDriver }
+
+type fakeSQLStmt struct {
+	sqlDriver *fakeSQLDriver
+	query     string
+}
+
+type fakeSQLRows struct {
+	values [][]driver.Value
+}
+
+func (sqlDriver *fakeSQLDriver) Open(string) (driver.Conn, error) { return fakeSQLConn{sqlDriver}, nil }
+func (sqlDriver *fakeSQLDriver) Connect(context.Context) (driver.Conn, error) {
+	return fakeSQLConn{sqlDriver}, nil
+}
+func (sqlDriver *fakeSQLDriver) Driver() driver.Driver { return sqlDriver }
+func (conn fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{conn.sqlDriver, query}, nil
+}
+func (conn fakeSQLConn) Close() error { return nil }
+func (conn fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+func (stmt fakeSQLStmt) Close() error       { return nil }
+func (stmt fakeSQLStmt) NumInput() int      { return -1 }
+func (rows *fakeSQLRows) Columns() []string { return []string{"version", "usage_data"} }
+func (rows *fakeSQLRows) Close() error      { return nil }
+func (rows *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+func (stmt fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	stmt.sqlDriver.mutex.Lock()
+	defer stmt.sqlDriver.mutex.Unlock()
+	stmt.sqlDriver.queries = append(stmt.sqlDriver.queries, stmt.query)
+
+	switch {
+	case strings.HasPrefix(stmt.query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(stmt.query, "INSERT"):
+		key := fmt.Sprint(args[0], ":", args[1], ":", args[2])
+		if _, isFound := stmt.sqlDriver.rows[key]; isFound {
+			return nil, errors.New("duplicate key")
+		}
+		stmt.sqlDriver.rows[key] = [2]driver.Value{args[3], args[4]}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(stmt.query, "UPDATE"):
+		key := fmt.Sprint(args[2], ":", args[3], ":", args[4])
+		row, isFound := stmt.sqlDriver.rows[key]
+		if isFound == false || row[0] != args[5] || stmt.sqlDriver.isUpdateIgnored {
+			return driver.RowsAffected(0), nil
+		}
+		stmt.sqlDriver.rows[key] = [2]driver.Value{args[0], args[1]}
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unexpected query %s", stmt.query)
+}
+
+func (stmt fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	stmt.sqlDriver.mutex.Lock()
+	defer stmt.sqlDriver.mutex.Unlock()
+	stmt.sqlDriver.queries = append(stmt.sqlDriver.queries, stmt.query)
+
+	row, isFound := stmt.sqlDriver.rows[fmt.Sprint(args[0], ":", args[1], ":", args[2])]
+	if isFound == false {
+		return &fakeSQLRows{}, nil
+	}
+	return &fakeSQLRows{values: [][]driver.Value{row[:]}}, nil
+}
+
+func TestSQLUsageStore(t *testing.T) {
+	sqlDriver := &fakeSQLDriver{rows: make(map[string][2]driver.Value)}
+	db := sql.OpenDB(sqlDriver)
+	defer db.Close()
+
+	if _, err := NewSQLUsageStore(db, "usages; DROP TABLE users", constants.SQLPlaceholderQuestionMark); err == nil {
+		t.Errorf("Expected invalid table name to be rejected")
+	}
+	sqlUsageStore, err := NewSQLUsageStore(db, "", constants.SQLPlaceholderDollar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two engines, like two instances of an app, share the same table
+	firstEngine := NewEngine(sqlUsageStore)
+	secondEngine := NewEngine(sqlUsageStore)
+	firstEngine.MaxRetries, secondEngine.MaxRetries = 1000, 1000
+	requestData := StoreRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			UserEntityPermissions: NotationToPermission("crude|c=batch:1"),
+			OrgEntityPermissions:  NotationToPermission("crude|q=1000|c=batch:1"),
+			EntityPermissionOrder: "org->user",
+		},
+		OperationQuantity: 1,
+		EntityIDs:         EntityIDs{constants.EntityOrg: "acme", constants.EntityUser: "42"},
+		Resource:          "files",
+	}
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, engine := range []*Engine{firstEngine, secondEngine} {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				if _, err := engine.Consume(requestData, time.Now()); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+	}
+	waitGroup.Wait()
+
+	orgUsage, version, err := sqlUsageStore.Get(UsageKey{EntityType: constants.EntityOrg, EntityID: "acme", Resource: "files"})
+	if err != nil || orgUsage.QuotaUsage != 100 || version != 100 {
+		t.Errorf("Expected no increment to be lost, got quota usage %d with version %d %v", orgUsage.QuotaUsage, version, err)
+	}
+	if slices.ContainsFunc(sqlDriver.queries, func(query string) bool {
+		return strings.HasPrefix(query, "UPDATE") && strings.Contains(query, "version = $6")
+	}) == false {
+		t.Errorf("Expected dollar placeholders in queries, got %v", sqlDriver.queries[len(sqlDriver.queries)-1])
+	}
+
+	// Put gives up if the row never gets updated, instead of retrying forever
+	sqlDriver.mutex.Lock()
+	sqlDriver.isUpdateIgnored = true
+	sqlDriver.mutex.Unlock()
+	if err := sqlUsageStore.Put(UsageKey{EntityType: constants.EntityOrg, EntityID: "acme", Resource: "files"}, orgUsage); errors.Is(err, ErrUsageConflict) == false {
+		t.Errorf("Expected a usage conflict, got %v", err)
+	}
+}
+
+func TestCustomEntityHierarchy(t *testing.T) {
+	for _, entityType := range []string{"workspace", "project"} {
+		if err := RegisterEntityType(entityType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterEntityType("work->space"); err == nil {
+		t.Errorf("Expected entity type with the order separator to be rejected")
+	}
+
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation: constants.OperationCreate,
+			Entities: []Entity{
+				{Type: "workspace", Permission: NotationToPermission("crude|q=10|c=batch:5"), Usage: PermissionUsage{QuotaUsage: 9}},
+				{Type: "project", Permission: NotationToPermission("crud-|c=batch:5")},
+				{Type: constants.EntityUser, Permission: NotationToPermission("crude|c=batch:5")},
+			},
+		},
+		OperationQuantity: 1,
+	}
+
+	decision, updatedUsages := Consume(requestData, time.Now())
+	if decision.Allowed == false || len(updatedUsages) != 3 || updatedUsages["workspace"].QuotaUsage != 10 {
+		t.Errorf("Expected operation to be permitted and usage of the 3 entities to be updated, got %s %v", decision, updatedUsages)
+	}
+
+	requestData.OperationQuantity = 2
+	decision = CheckOperationWithUsage(requestData)
+	if decision.Entity != "workspace" || decision.Reason != constants.ReasonQuotaLimitExceeded {
+		t.Errorf("Expected workspace quota to deny operation, got %s", decision)
+	}
+
+	requestData.Operation = constants.OperationExecute
+	requestData.EntityPermissionOrder = "project->user"
+	decision = CheckOperationWithUsage(requestData)
+	if decision.Entity != "project" || decision.Reason != constants.ReasonOperationNotGranted {
+		t.Errorf("Expected project to deny execute operation, got %s", decision)
+	}
+
+	// unregistered entity types in the order deny the operation, so a typo fails closed instead of skipping the entity
+	requestData.EntityPermissionOrder = "team->user"
+	requestData.OperationQuantity = 1
+	if decision := CheckOperationWithUsage(requestData); decision.Entity != "team" || decision.Reason != constants.ReasonInvalidEntity {
+		t.Errorf("Expected unregistered entity type to deny operation, got %s", decision)
+	}
+	deleteRequestData := PermissionRequestData{Operation: constants.OperationDelete, EntityPermissionOrder: "user->grop", UserEntityPermissions: NotationToPermission("crude"), GroupEntityPermissions: NotationToPermission("cru-e")}
+	if decision := CheckOperation(deleteRequestData); decision.Entity != "grop" || decision.Reason != constants.ReasonInvalidEntity {
+		t.Errorf("Expected misspelled entity type to deny operation, got %s", decision)
+	}
+	deleteRequestData.EntityPermissionOrder = ""
+	deleteRequestData.Entities = []Entity{{Type: constants.EntityUser, Permission: NotationToPermission("crude")}, {Type: "team", Permission: NotationToPermission("crude")}}
+	if decision := CheckOperation(deleteRequestData); decision.Entity != "team" || decision.Reason != constants.ReasonInvalidEntity {
+		t.Errorf("Expected unregistered entity type in Entities to deny operation, got %s", decision)
+	}
+}
+
+func TestCombiningRules(t *testing.T) {
+	auditor := Entity{Type: constants.EntityRole, ID: "auditor", Permission: NotationToPermission("-r---|r=batch:5,hour:10"), Usage: PermissionUsage{ReadOperationUsages: OperationUsage{WithinTheLastHour: 10, LastTime: time.Now()}}}
+	budgetViewer := Entity{Type: constants.EntityRole, ID: "budget-viewer", Permission: NotationToPermission("-r---|r=batch:5,hour:100")}
+	editor := Entity{Type: constants.EntityRole, ID: "editor", Permission: NotationToPermission("cru--|r=batch:5")}
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationRead,
+			EntityPermissionOrder: "role->user",
+			UserEntityPermissions: NotationToPermission("crude|r=batch:5"),
+			Entities:              []Entity{auditor, budgetViewer},
+		},
+		OperationQuantity: 1,
+	}
+
+	// all-of is the default, so the auditor's exhausted hour limit denies the operation
+	decision := CheckOperationWithUsage(requestData)
+	if decision.Entity != "role:auditor" || decision.Reason != constants.ReasonHourLimitExceeded {
+		t.Errorf("Expected auditor role to deny operation, got %s", decision)
+	}
+
+	requestData.CombiningRules = map[string]string{constants.EntityRole: constants.CombiningRuleAnyOf}
+	decision, updatedUsages := Consume(requestData, time.Now())
+	if decision.Allowed == false {
+		t.Fatalf("Expected budget viewer role to permit operation, got %s", decision)
+	}
+	if _, isAuditorCharged := updatedUsages["role:auditor"]; isAuditorCharged || updatedUsages["role:budget-viewer"].ReadOperationUsages.WithinTheLastHour != 1 || len(updatedUsages) != 2 {
+		t.Errorf("Expected only the budget viewer role and the user to be charged, got %v", updatedUsages)
+	}
+
+	// first-applicable skips roles that don't grant the operation, and the first that does decides
+	requestData.CombiningRules[constants.EntityRole] = constants.CombiningRuleFirstApplicable
+	requestData.Operation = constants.OperationCreate
+	requestData.Entities = []Entity{auditor, editor, budgetViewer}
+	decision, updatedUsages = Consume(requestData, time.Now())
+	if decision.Allowed == false || len(updatedUsages) != 2 || updatedUsages["role:editor"].CreateOperationUsages.AllTime != 1 {
+		t.Errorf("Expected editor role to permit and be charged, got %s %v", decision, updatedUsages)
+	}
+	requestData.Operation = constants.OperationDelete
+	if decision := CheckOperationWithUsage(requestData); decision.Entity != "role:auditor" || decision.Reason != constants.ReasonOperationNotGranted {
+		t.Errorf("Expected delete operation to be denied by the first role, got %s", decision)
+	}
+
+	requestData.CombiningRules[constants.EntityRole] = "most-of"
+	if decision := CheckOperation(requestData.PermissionRequestData); decision.Reason != constants.ReasonInvalidCombiningRule {
+		t.Errorf("Expected invalid combining rule to deny operation, got %s", decision)
+	}
+
+	// without an order, the order is the entity types in the order they are first seen in, each type once, so its entities are checked once
+	entitiesRequestData := PermissionRequestData{Entities: []Entity{editor, {Type: constants.EntityUser, ID: "42"}, auditor}}
+	if order := getEntityPermissionOrder(entitiesRequestData); slices.Equal(order, []string{constants.EntityRole, constants.EntityUser}) == false {
+		t.Errorf("Expected the order role->user, got %v", order)
+	}
+}
+
+func TestExplicitDeny(t *testing.T) {
+	permission, err := ParseNotation("cr-!d-|c=batch:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permission.Create == false || permission.Delete == true || permission.DenyDelete == false || permission.DenyRead == true {
+		t.Errorf("Unexpected permission %+v", permission)
+	}
+	if notation := PermissionToNotation(permission); notation != "cr-!d-|c=batch:2" {
+		t.Errorf("Expected notation cr-!d-|c=batch:2, got %s", notation)
+	}
+	if _, err := ParseNotation("cr-d!-"); errors.Is(err, ErrMalformedOperationSection) == false {
+		t.Errorf("Expected '!' after a letter to be rejected, got %v", err)
+	}
+
+	requestData := PermissionRequestData{
+		Operation:             constants.OperationDelete,
+		OrgEntityPermissions:  NotationToPermission("crude"),
+		RoleEntityPermissions: NotationToPermission("crude|c=batch:50"),
+		UserEntityPermissions: NotationToPermission("cru!d-"),
+		EntityPermissionOrder: "org->role->user",
+	}
+	combiningAlgorithms := []struct {
+		combiningAlgorithm string
+		operation          string
+		isAllowed          bool
+		reason             string
+	}{
+		{constants.CombiningAlgorithmStrictHierarchy, constants.OperationDelete, false, constants.ReasonExplicitlyDenied},
+		{constants.CombiningAlgorithmStrictHierarchy, constants.OperationExecute, false, constants.ReasonOperationNotGranted},
+		{constants.CombiningAlgorithmDenyOverrides, constants.OperationDelete, false, constants.ReasonExplicitlyDenied},
+		{constants.CombiningAlgorithmDenyOverrides, constants.OperationExecute, true, ""},
+		{constants.CombiningAlgorithmPermitOverrides, constants.OperationDelete, true, ""},
+		{"first-wins", constants.OperationRead, false, constants.ReasonInvalidCombiningAlgorithm},
+	}
+	for _, testCase := range combiningAlgorithms {
+		requestData.CombiningAlgorithm = testCase.combiningAlgorithm
+		requestData.Operation = testCase.operation
+		decision := CheckOperation(requestData)
+		if decision.Allowed != testCase.isAllowed || decision.Reason != testCase.reason {
+			t.Errorf("%s %s: expected allowed %v with reason %q, got %s", testCase.combiningAlgorithm, testCase.operation, testCase.isAllowed, testCase.reason, decision)
+		}
+	}
+
+	// with deny-overrides, a role that explicitly denies wins over another role that grants, whatever the combining rule is
+	requestData.CombiningAlgorithm = constants.CombiningAlgorithmDenyOverrides
+	requestData.Operation = constants.OperationCreate
+	requestData.CombiningRules = map[string]string{constants.EntityRole: constants.CombiningRuleAnyOf}
+	requestData.Entities = []Entity{
+		{Type: constants.EntityRole, ID: "editor", Permission: NotationToPermission("crude")},
+		{Type: constants.EntityRole, ID: "suspended", Permission: NotationToPermission("!c----")},
+	}
+	if decision := CheckOperation(requestData); decision.Entity != "role:suspended" || decision.Reason != constants.ReasonExplicitlyDenied {
+		t.Errorf("Expected suspended role to deny operation, got %s", decision)
+	}
+
+	// a conditional deny applies when its condition is met, and can't be bypassed by leaving the variable it uses out of the context
+	requestData.Entities[1].Permission = NotationToPermission("!c----|if=request.network=='public'")
+	requestData.Context = map[string]any{"request": map[string]any{"network": "internal"}}
+	if IsOperationPermitted(requestData) == false {
+		t.Errorf("Expected the deny to not apply from the internal network")
+	}
+	requestData.Context = map[string]any{"request": map[string]any{"network": "public"}}
+	if decision := CheckOperation(requestData); decision.Entity != "role:suspended" || decision.Reason != constants.ReasonExplicitlyDenied {
+		t.Errorf("Expected the deny to apply from the public network, got %s", decision)
+	}
+	requestData.Context = map[string]any{"request": map[string]any{}}
+	if decision := CheckOperation(requestData); decision.Allowed == true || decision.Entity != "role:suspended" || decision.Reason != constants.ReasonConditionError {
+		t.Errorf("Expected the deny to apply when request.network is missing, got %s", decision)
+	}
+}
+
+func TestRegisteredOperations(t *testing.T) {
+	for _, operation := range []OperationDefinition{
+		{Name: "share", Letter: "s"},
+		{Name: "publish", Letter: "p", QuotaEffect: constants.QuotaEffectIncrease},
+	} {
+		if err := RegisterOperation(operation); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterOperation(OperationDefinition{Name: "approve", Letter: "c"}); err == nil {
+		t.Errorf("Expected letter of a crude operation to be rejected")
+	}
+	if err := RegisterOperation(OperationDefinition{Name: "share", Letter: "s"}); err != nil {
+		t.Errorf("Expected registering the same operation again to do nothing, got %v", err)
+	}
+	if err := RegisterOperation(OperationDefinition{Name: "share", Letter: "h"}); err == nil {
+		t.Errorf("Expected registering a different operation with the same name to be rejected")
+	}
+
+	permission, err := ParseNotation("cr---!sp|q=5|s=hour:2|p=batch:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permission.Operations["share"].Denied == false || permission.Operations["publish"].Granted == false || permission.Operations["publish"].Limits.BatchLimit != 3 {
+		t.Errorf("Unexpected operations %+v", permission.Operations)
+	}
+	if notation := PermissionToNotation(permission); notation != "cr---p!s|q=5|p=batch:3" {
+		t.Errorf("Expected notation cr---p!s|q=5|p=batch:3, got %s", notation)
+	}
+	if _, err := ParseNotation("cr---ss"); errors.Is(err, ErrMalformedOperationSection) == false {
+		t.Errorf("Expected duplicate operation letter to be rejected, got %v", err)
+	}
+
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             "publish",
+			UserEntityPermissions: permission,
+			EntityPermissionOrder: constants.EntityUser,
+		},
+		OperationQuantity: 3,
+	}
+	decision, updatedUsages := Consume(requestData, time.Now())
+	if decision.Allowed == false || updatedUsages[constants.EntityUser].QuotaUsage != 3 || updatedUsages[constants.EntityUser].OperationUsages["publish"].AllTime != 3 {
+		t.Errorf("Expected publish to be permitted and to increase quota usage, got %s %+v", decision, updatedUsages)
+	}
+
+	requestData.UserEntityUsage = updatedUsages[constants.EntityUser]
+	if decision := CheckOperationWithUsage(requestData); decision.Reason != constants.ReasonQuotaLimitExceeded {
+		t.Errorf("Expected publish to be denied by quota, got %s", decision)
+	}
+	requestData.Operation = "share"
+	if decision := CheckOperationWithUsage(requestData); decision.Reason != constants.ReasonExplicitlyDenied {
+		t.Errorf("Expected share to be explicitly denied, got %s", decision)
+	}
+
+	// sliding windows enabled on a fresh usage apply to the usages of registered operations that are added later
+	now := time.Now()
+	slidingWindowUsage := PermissionUsage{}
+	slidingWindowUsage.EnableSlidingWindows()
+	for _, minutesAgo := range []int{118, 59, 0} {
+		slidingWindowUsage = UpdateUsage(UpdateUsageData{Operation: "share", OperationQuantity: 1, OperationTime: now.Add(-time.Duration(minutesAgo) * time.Minute)}, slidingWindowUsage)
+	}
+	if shareUsage := slidingWindowUsage.OperationUsages["share"]; shareUsage.SlidingWindow == false || shareUsage.WithinTheLastHour != 2 {
+		t.Errorf("Expected the share usage to be in sliding window mode with 2 shares within the last hour, got %+v", shareUsage)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := ParsePolicy(" files{crude|q=100} ; videos{ -r--- };")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy["files"].QuotaLimit != 100 || policy["videos"].Read == false || policy["videos"].Create == true {
+		t.Errorf("Unexpected policy %+v", policy)
+	}
+	if notation := PolicyToNotation(policy); notation != "files{crude|q=100};videos{-r---}" {
+		t.Errorf("Expected notation files{crude|q=100};videos{-r---}, got %s", notation)
+	}
+
+	_, err = ParsePolicy("files{crude};videos{-r---|r=minute:abc}")
+	var notationError *NotationError
+	if errors.As(err, &notationError) == false || notationError.Resource != "videos" || notationError.Token != "minute:abc" || notationError.Offset != 28 {
+		t.Errorf("Expected malformed limit in videos at offset 28, got %v", err)
+	}
+	for _, malformedPolicy := range []string{"files{crude", "{crude}", "files{crude};files{-r---}"} {
+		if _, err := ParsePolicy(malformedPolicy); err == nil {
+			t.Errorf("Expected %s to be rejected", malformedPolicy)
+		}
+	}
+
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation: constants.OperationCreate,
+			Resource:  "files",
+			Entities: []Entity{
+				{Type: constants.EntityOrg, Permission: NotationToPermission("crude|c=batch:10")},
+				{Type: constants.EntityUser, Policy: NotationToPolicy("files{crude|q=100|c=batch:5};videos{-r---}"), PolicyUsage: PolicyUsage{"files": {QuotaUsage: 98}, "videos": {QuotaUsage: 1000}}},
+			},
+		},
+		OperationQuantity: 2,
+	}
+	decision, updatedUsages := Consume(requestData, time.Now())
+	if decision.Allowed == false || updatedUsages[constants.EntityUser].QuotaUsage != 100 {
+		t.Errorf("Expected create on files to be permitted and charged to the files usage, got %s %+v", decision, updatedUsages)
+	}
+
+	requestData.Resource = "videos"
+	if decision := CheckOperationWithUsage(requestData); decision.Entity != constants.EntityUser || decision.Reason != constants.ReasonOperationNotGranted {
+		t.Errorf("Expected create on videos to be denied by the user, got %s", decision)
+	}
+	requestData.Resource = "invoices"
+	requestData.Operation = constants.OperationRead
+	requestData.OperationQuantity = 1
+	if decision := CheckOperationWithUsage(requestData); decision.Allowed == true {
+		t.Errorf("Expected resources that are not in the policy to be denied")
+	}
+}
+
+func TestResourcePaths(t *testing.T) {
+	policy := NotationToPolicy("/projects/alpha/**{-r---};/projects/alpha/tmp/*{-r-d-|d=batch:10};/projects/*/public/*.pdf{-r---|r=batch:5}")
+	resourcePaths := []struct {
+		resourcePath    string
+		matchedResource string
+	}{
+		{"/projects/alpha", "/projects/alpha/**"},
+		{"/projects/alpha/docs/2025/report.pdf", "/projects/alpha/**"},
+		{"/projects/alpha/tmp/cache.bin", "/projects/alpha/tmp/*"},
+		{"/projects/alpha/tmp/nested/cache.bin", "/projects/alpha/**"},
+		{"/projects/alpha/public/brochure.pdf", "/projects/*/public/*.pdf"},
+		{"/projects/beta/public/brochure.pdf", "/projects/*/public/*.pdf"},
+		{"/projects/beta/readme.md", ""},
+	}
+	for _, testCase := range resourcePaths {
+		if matchedResource, _ := policy.Match(testCase.resourcePath); matchedResource != testCase.matchedResource {
+			t.Errorf("Expected %s to match %q, got %q", testCase.resourcePath, testCase.matchedResource, matchedResource)
+		}
+	}
+
+	chain := []Entity{
+		{Type: constants.EntityOrg, Permission: NotationToPermission("crude|d=batch:100")},
+		{Type: constants.EntityUser, Policy: policy},
+	}
+	if IsAllowed(chain, constants.OperationRead, "/projects/alpha/docs/plan.md") == false {
+		t.Errorf("Expected read under /projects/alpha/** to be permitted")
+	}
+	if IsAllowed(chain, constants.OperationDelete, "/projects/alpha/docs/plan.md") == true {
+		t.Errorf("Expected delete outside /projects/alpha/tmp/* to be denied")
+	}
+	if IsAllowed(chain, constants.OperationDelete, "/projects/alpha/tmp/plan.md") == false {
+		t.Errorf("Expected delete under /projects/alpha/tmp/* to be permitted")
+	}
+	if decision := CheckResource(chain, constants.OperationRead, "/projects/beta/readme.md"); decision.Entity != constants.EntityUser || decision.Allowed == true {
+		t.Errorf("Expected paths that no pattern matches to be denied by the user, got %s", decision)
+	}
+
+	decision, updatedUsages := Consume(PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{Operation: constants.OperationDelete, Resource: "/projects/alpha/tmp/a.txt", Entities: chain},
+		OperationQuantity:     10,
+	}, time.Now())
+	if decision.Allowed == false || updatedUsages[constants.EntityUser].DeleteOperationUsages.AllTime != 10 {
+		t.Errorf("Expected the batch limit of /projects/alpha/tmp/* to apply, got %s %+v", decision, updatedUsages)
+	}
+
+	// ConsumeResource returns the pattern that matched with the usage, so it can be written back to the PolicyUsage
+	decision, resourceUsages := ConsumeResource(PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{Operation: constants.OperationDelete, Resource: "/projects/alpha/tmp/a.txt", Entities: chain},
+		OperationQuantity:     10,
+	}, time.Now())
+	userUsageKey := UsageKey{EntityType: constants.EntityUser, Resource: "/projects/alpha/tmp/*"}
+	orgUsageKey := UsageKey{EntityType: constants.EntityOrg, Resource: "/projects/alpha/tmp/a.txt"}
+	if decision.Allowed == false || len(resourceUsages) != 2 || resourceUsages[userUsageKey].DeleteOperationUsages.AllTime != 10 || resourceUsages[orgUsageKey].DeleteOperationUsages.AllTime != 10 {
+		t.Errorf("Expected the usage of the user to be keyed by the pattern that matched, got %s %+v", decision, resourceUsages)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	context := map[string]any{
+		"uid":      "42",
+		"owner":    "42",
+		"subject":  map[string]any{"id": "42", "mfa": true, "roles": []string{"editor", "viewer"}, "age": 30},
+		"resource": map[string]any{"owner": "7"},
+		"request":  map[string]any{"ip": "10.1.2.3"},
+	}
+	expressions := []struct {
+		expression string
+		isMet      bool
+		isInvalid  bool
+	}{
+		{"owner==$uid", true, false},
+		{"resource.owner == subject.id", false, false},
+		{"resource.owner == subject.id || subject.mfa == true", true, false},
+		{"subject.mfa && !(subject.age < 18)", true, false},
+		{"request.ip in '10.0.0.0/8'", true, false},
+		{"request.ip in '192.168.0.0/16'", false, false},
+		{"'editor' in subject.roles && subject.age >= 30", true, false},
+		{"subject.missing == 'x'", false, true},
+		{"subject.age < 'x'", false, true},
+		{"subject.roles == ['editor', 'viewer']", false, true},
+		{"subject.roles != subject.roles", false, true},
+		{"subject == resource", false, true},
+		{"subject.roles in [['editor', 'viewer']]", false, true},
+		{"owner ==", false, true},
+	}
+	for _, testCase := range expressions {
+		condition, err := ParseCondition(testCase.expression)
+		if err == nil {
+			var isMet bool
+			isMet, err = condition.Evaluate(context)
+			if isMet != testCase.isMet {
+				t.Errorf("%s: expected %v, got %v", testCase.expression, testCase.isMet, isMet)
+			}
+		}
+		if (err != nil) != testCase.isInvalid {
+			t.Errorf("%s: unexpected error %v", testCase.expression, err)
+		}
+	}
+
+	// conditions of permissions are parsed once, then reused for every check
+	checkPermissionCondition(Permission{Condition: "subject.mfa == true"}, context)
+	firstCondition, _ := parseCachedCondition("subject.mfa == true")
+	if cachedCondition, _ := parseCachedCondition("subject.mfa == true"); cachedCondition != firstCondition {
+		t.Errorf("Expected the parsed condition to be cached")
+	}
+	if _, err := parseCachedCondition("owner =="); err == nil {
+		t.Errorf("Expected the error of a malformed condition to be cached too")
+	}
+	for i := 0; i < constants.ConditionCacheSize+10; i++ {
+		parseCachedCondition(fmt.Sprintf("subject.age > %d", i))
+	}
+	if parsedConditions.len() != constants.ConditionCacheSize {
+		t.Errorf("Expected the condition cache to keep %d conditions, got %d", constants.ConditionCacheSize, parsedConditions.len())
+	}
+
+	// spaces are kept in the condition, and || has to be within parentheses in notation
+	permission, err := ParseNotation("crude | if=(request.ip in '10.0.0.0/8' || subject.mfa == true) | c=batch:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permission.Condition != "(request.ip in '10.0.0.0/8' || subject.mfa == true)" || permission.CreateOperationLimits.BatchLimit != 2 {
+		t.Errorf("Unexpected permission %+v", permission)
+	}
+	if notation := PermissionToNotation(Permission{Read: true, Condition: "a == 1 || b == 2"}); notation != "-r---|if=(a == 1 || b == 2)" {
+		t.Errorf("Expected notation -r---|if=(a == 1 || b == 2), got %s", notation)
+	}
+	if _, err := ParseNotation("crude|if=owner=="); errors.Is(err, ErrMalformedCondition) == false {
+		t.Errorf("Expected malformed condition, got %v", err)
+	}
+
+	requestData := PermissionRequestData{
+		Operation:             constants.OperationUpdate,
+		EntityPermissionOrder: "role->user",
+		RoleEntityPermissions: NotationToPermission("crude|c=batch:50"),
+		UserEntityPermissions: NotationToPermission("crude|if=resource.owner==subject.id"),
+		Context:               context,
+	}
+	if decision := CheckOperation(requestData); decision.Allowed == true || decision.Entity != constants.EntityUser || decision.Reason != constants.ReasonConditionNotMet {
+		t.Errorf("Expected the condition of the user to deny operation, got %s", decision)
+	}
+	requestData.Context = map[string]any{"subject": map[string]any{"id": "7"}, "resource": map[string]any{"owner": "7"}}
+	if IsOperationPermitted(requestData) == false {
+		t.Error("Expected the owner to be permitted")
+	}
+
+	// with first-applicable, a role whose condition isn't met is skipped
+	requestData.Entities = []Entity{
+		{Type: constants.EntityRole, ID: "mfa-admin", Permission: NotationToPermission("crude|if=subject.mfa==true")},
+		{Type: constants.EntityRole, ID: "editor", Permission: NotationToPermission("-r---")},
+	}
+	requestData.CombiningRules = map[string]string{constants.EntityRole: constants.CombiningRuleFirstApplicable}
+	requestData.Context["subject"] = map[string]any{"id": "7", "mfa": false}
+	if decision := CheckOperation(requestData); decision.Entity != "role:mfa-admin" || decision.Reason != constants.ReasonConditionNotMet {
+		t.Errorf("Expected no role to apply, got %s", decision)
+	}
+	requestData.Entities[1].Permission = NotationToPermission("-ru--")
+	if IsOperationPermitted(requestData) == false {
+		t.Error("Expected the editor role to apply")
+	}
+	requestData.Entities[1].Permission = NotationToPermission("-r---")
+	requestData.Context["subject"] = map[string]any{"id": "7", "mfa": true}
+	if IsOperationPermitted(requestData) == false {
+		t.Error("Expected the mfa-admin role to apply")
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	permission, err := ParseNotation("crude|schedule=days=mon-fri;hours=08:00-18:00;tz=Europe/Paris&days=sat,sun;hours=22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permission.Schedules) != 2 || len(permission.Schedules[0].Days) != 5 || permission.Schedules[0].From != 8*time.Hour || permission.Schedules[0].Location != "Europe/Paris" {
+		t.Fatalf("Unexpected schedules %+v", permission.Schedules)
+	}
+	if notation := PermissionToNotation(permission); notation != "crude|schedule=days=mon-fri;hours=08:00-18:00;tz=Europe/Paris&days=sat-sun;hours=22:00-06:00" {
+		t.Errorf("Unexpected notation %s", notation)
+	}
+	// a whole day that doesn't start at midnight keeps its hours, so it round trips exactly
+	wholeDayPermission := Permission{Create: true, Schedules: []Schedule{{From: 8 * time.Hour, Until: 8 * time.Hour}}}
+	if notation := PermissionToNotation(wholeDayPermission); notation != "c----|schedule=hours=08:00-08:00" {
+		t.Errorf("Expected the hours of a whole day from 08:00 to be kept, got %s", notation)
+	}
+	if roundTripPermission := NotationToPermission(PermissionToNotation(wholeDayPermission)); reflect.DeepEqual(wholeDayPermission.Schedules, roundTripPermission.Schedules) == false {
+		t.Errorf("Expected schedules %+v got %+v", wholeDayPermission.Schedules, roundTripPermission.Schedules)
+	}
+	for _, malformedNotation := range []string{"crude|schedule=days=mon-fry", "crude|schedule=hours=8-18", "crude|schedule=tz=Mars/Olympus", "crude|schedule=days=mon;days=tue", "crude|schedule=hour=08:00-18:00"} {
+		if _, err := ParseNotation(malformedNotation); errors.Is(err, ErrMalformedSchedule) == false {
+			t.Errorf("%s: expected malformed schedule, got %v", malformedNotation, err)
+		}
+	}
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+	times := []struct {
+		t        time.Time
+		isOpen   bool
+		nextOpen time.Time
+	}{
+		{time.Date(2025, 3, 12, 10, 0, 0, 0, paris), true, time.Time{}},                                    // Wednesday morning
+		{time.Date(2025, 3, 12, 19, 0, 0, 0, paris), false, time.Date(2025, 3, 13, 8, 0, 0, 0, paris)},     // Wednesday evening
+		{time.Date(2025, 3, 14, 18, 0, 0, 0, paris), false, time.Date(2025, 3, 15, 22, 0, 0, 0, time.UTC)}, // Friday at closing time
+		{time.Date(2025, 3, 16, 3, 0, 0, 0, time.UTC), true, time.Time{}},                                  // Sunday night, in the window that opened on Saturday
+		{time.Date(2025, 3, 17, 3, 0, 0, 0, time.UTC), true, time.Time{}},                                  // Monday night, in the window that opened on Sunday
+		{time.Date(2025, 3, 17, 6, 30, 0, 0, time.UTC), false, time.Date(2025, 3, 17, 8, 0, 0, 0, paris)},  // Monday, before opening in Paris
+	}
+	for _, testCase := range times {
+		isOpen, nextOpen, err := checkSchedules(permission.Schedules, testCase.t)
+		if err != nil || isOpen != testCase.isOpen || nextOpen.Equal(testCase.nextOpen) == false {
+			t.Errorf("%s: expected open %v next open %s, got %v %s %v", testCase.t, testCase.isOpen, testCase.nextOpen, isOpen, nextOpen, err)
+		}
+	}
+
+	// a window that never opens today or in the next week still denies with the time it opens next
+	decision := CheckEntityOperation(constants.OperationRead, Permission{Read: true, Schedules: []Schedule{{Days: []time.Weekday{time.Now().Add(48 * time.Hour).Weekday()}}}})
+	if decision.Allowed == true || decision.Reason != constants.ReasonOutsideSchedule || decision.NextOpen == nil || decision.NextOpen.After(time.Now()) == false {
+		t.Errorf("Expected operation to be denied outside schedule, got %s", decision)
+	}
+	if decisionJSON, _ := json.Marshal(decision); strings.Contains(string(decisionJSON), `"nextOpen":"`) == false {
+		t.Errorf("Expected nextOpen in the json of a decision outside schedule, got %s", decisionJSON)
+	}
+	if decisionJSON, _ := json.Marshal(deniedDecision(constants.EntityUser, constants.ReasonExpired)); strings.Contains(string(decisionJSON), "nextOpen") == true {
+		t.Errorf("Expected nextOpen to be left out of the json of other decisions, got %s", decisionJSON)
+	}
+	if IsEntityOperationPermitted(constants.OperationRead, Permission{Read: true, Schedules: []Schedule{{From: 0, Until: 24 * time.Hour}}}) == false {
+		t.Error("Expected operation to be permitted within schedule")
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1752817000, 0))
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationRead,
+			EntityPermissionOrder: "user",
+			UserEntityPermissions: NotationToPermission("-r---|start=1752817851|end=1752821969|r=minute:2"),
+			Clock:                 clock,
+		},
+		OperationQuantity: 1,
+	}
+	if decision := CheckOperation(requestData.PermissionRequestData); decision.Reason != constants.ReasonNotStarted {
+		t.Errorf("Expected permission not to have started, got %s", decision)
+	}
+	clock.Advance(time.Hour)
+	if IsOperationPermitted(requestData.PermissionRequestData) == false {
+		t.Error("Expected permission to be in effect")
+	}
+
+	// usage is sanitized at the time of the clock, so a minute limit is reached, then resets when the clock moves on
+	requestData.UserEntityUsage.ReadOperationUsages = OperationUsage{LastTime: clock.Now().Add(-30 * time.Second), WithinTheLastMinute: 2}
+	limitedPermission := NotationToPermission("-r---|r=minute:2")
+	if decision := checkEntityOperationWithUsage(constants.OperationRead, 1, Entity{Type: constants.EntityUser, Permission: limitedPermission, Usage: requestData.UserEntityUsage}, clock.Now()); decision.Reason != constants.ReasonMinuteLimitExceeded {
+		t.Errorf("Expected minute limit to be exceeded, got %s", decision)
+	}
+	clock.Advance(time.Minute)
+	if decision := checkEntityOperationWithUsage(constants.OperationRead, 1, Entity{Type: constants.EntityUser, Permission: limitedPermission, Usage: requestData.UserEntityUsage}, clock.Now()); decision.Allowed == false {
+		t.Errorf("Expected minute usage to be reset, got %s", decision)
+	}
+	if GetOperationUsagesAt(constants.OperationRead, requestData.UserEntityUsage, clock.Now()).WithinTheLastMinute != 0 {
+		t.Error("Expected minute usage to be reset")
+	}
+
+	clock.Set(time.Unix(1752821970, 0))
+	if decision := CheckOperation(requestData.PermissionRequestData); decision.Reason != constants.ReasonExpired {
+		t.Errorf("Expected permission to have expired, got %s", decision)
+	}
+}
+
+func TestStartEndTimes(t *testing.T) {
+	notations := map[string]time.Time{
+		"crude|start=1735693200":                time.Unix(1735693200, 0),
+		"crude|start=1735693200s":               time.Unix(1735693200, 0),
+		"crude|start=1735693200000":             time.Unix(1735693200, 0),
+		"crude|start=1735693200500ms":           time.UnixMilli(1735693200500),
+		"crude|start=2025-01-01T02:00:00+01:00": time.Unix(1735693200, 0),
+	}
+	for notation, expectedStartTime := range notations {
+		permission, err := ParseNotation(notation)
+		if err != nil || permission.StartTime.Equal(expectedStartTime) == false {
+			t.Errorf("%s: expected start time %s, got %s %v", notation, expectedStartTime, permission.StartTime, err)
+		}
+		// the notation is unambiguous, so it gives back the same time
+		if reparsedPermission, err := ParseNotation(PermissionToNotation(permission)); err != nil || reparsedPermission.StartTime.Equal(expectedStartTime) == false {
+			t.Errorf("%s: expected %s to give back start time %s, got %s %v", notation, PermissionToNotation(permission), expectedStartTime, reparsedPermission.StartTime, err)
+		}
+	}
+	for _, malformedNotation := range []string{"crude|start=yesterday", "crude|end=12ks", "crude|end=ms"} {
+		if _, err := ParseNotation(malformedNotation); errors.Is(err, ErrMalformedTime) == false {
+			t.Errorf("%s: expected malformed time, got %v", malformedNotation, err)
+		}
+	}
+
+	// checks with and without usage agree on when the permission is in effect
+	clock := NewFakeClock(time.Unix(1735693199, 0))
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			EntityPermissionOrder: "user",
+			UserEntityPermissions: NotationToPermission("crude|start=1735693200000ms|end=2025-01-02T01:00:00Z"),
+			Clock:                 clock,
+		},
+		OperationQuantity: 1,
+	}
+	for _, testCase := range []struct {
+		t      time.Time
+		reason string
+	}{
+		{time.Unix(1735693199, 0), constants.ReasonNotStarted},
+		{time.Unix(1735693200, 0), ""},
+		{time.Unix(1735779600, 0), ""},
+		{time.Unix(1735779601, 0), constants.ReasonExpired},
+	} {
+		clock.Set(testCase.t)
+		for _, decision := range []Decision{CheckOperation(requestData.PermissionRequestData), CheckOperationWithUsage(requestData)} {
+			if decision.Reason != testCase.reason {
+				t.Errorf("%s: expected reason %q, got %s", testCase.t, testCase.reason, decision)
+			}
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var logs strings.Builder
+	SetLogger(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	defer SetLogger(nil)
+
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			EntityPermissionOrder: "org->user",
+			OrgEntityPermissions:  NotationToPermission("crude|c=batch:2"),
+			UserEntityPermissions: NotationToPermission("crude|c=batch:5"),
+		},
+		OperationQuantity: 3,
+	}
+	if IsOperationPermittedWithUsage(requestData) == true {
+		t.Fatal("Expected batch limit of the org to be exceeded")
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(logs.String()), &record); err != nil {
+		t.Fatalf("Expected one JSON log record, got %q", logs.String())
+	}
+	expectedRecord := map[string]any{"level": "INFO", "msg": "operation denied", "entity": "org", "operation": "create", "reason": constants.ReasonBatchLimitExceeded, "limit": 2.0, "usage": 0.0, "quantity": 3.0}
+	for key, expectedValue := range expectedRecord {
+		if record[key] != expectedValue {
+			t.Errorf("Expected %s to be %v, got %v", key, expectedValue, record[key])
+		}
+	}
+
+	// the notation itself is never logged, only where the problem is
+	logs.Reset()
+	NotationToPermission("crude|secret=42")
+	if strings.Contains(logs.String(), "secret") || strings.Contains(logs.String(), `"level":"WARN","msg":"malformed permission notation","error":"unknown section","section":1,"offset":6`) == false {
+		t.Errorf("Unexpected log %q", logs.String())
+	}
+
+	// nothing is logged by default
+	SetLogger(nil)
+	logs.Reset()
+	CheckOperation(PermissionRequestData{Operation: "fly"})
+	if logs.Len() != 0 {
+		t.Errorf("Expected no logs, got %q", logs.String())
+	}
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	engine := NewEngine(NewMemoryUsageStore())
+	middleware := NewHTTPMiddleware(engine, func(request *http.Request) (StoreRequestData, error) {
+		userID := request.Header.Get("X-User")
+		if userID == "" {
+			return StoreRequestData{}, errors.New("no user")
+		}
+		notation := "cru-e|c=batch:5,hour:6|e=minute:1"
+		if userID == "quota" {
+			notation = "cru-e|q=1|c=batch:5"
+		}
+		return StoreRequestData{
+			PermissionRequestData: PermissionRequestData{
+				EntityPermissionOrder: "user",
+				UserEntityPermissions: NotationToPermission(notation),
+			},
+			EntityIDs: EntityIDs{constants.EntityUser: userID},
+		}, nil
+	})
+	middleware.Routes = map[string]string{"POST /jobs/*/run": constants.OperationExecute}
+
+	release := make(chan struct{})
+	handler := middleware.Handler(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/broken" {
+			responseWriter.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if request.URL.Path == "/slow" {
+			<-release
+		}
+		if request.URL.Path == "/events" {
+			flusher, isFlusher := responseWriter.(http.Flusher)
+			if isFlusher == false {
+				responseWriter.WriteHeader(http.StatusNotImplemented)
+				return
+			}
+			flusher.Flush()
+		}
+		responseWriter.Write([]byte("done"))
+	}))
+	serve := func(method string, path string, user string, quantity string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		if user != "" {
+			request.Header.Set("X-User", user)
+		}
+		if quantity != "" {
+			request.Header.Set(constants.DefaultQuantityHeader, quantity)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	requests := []struct {
+		method     string
+		path       string
+		user       string
+		quantity   string
+		statusCode int
+		reason     string
+	}{
+		{http.MethodGet, "/files", "", "", http.StatusUnauthorized, ""},
+		{http.MethodPatch, "/files/1", "42", "", http.StatusOK, ""},
+		{http.MethodDelete, "/files/1", "42", "", http.StatusForbidden, constants.ReasonOperationNotGranted},
+		{http.MethodPost, "/files", "42", "abc", http.StatusBadRequest, ""},
+		{http.MethodPost, "/files", "42", "6", http.StatusForbidden, constants.ReasonBatchLimitExceeded}, // limits that never reset can't be retried
+		{http.MethodPost, "/files", "42", "5", http.StatusOK, ""},
+		{http.MethodPost, "/broken", "42", "", http.StatusInternalServerError, ""}, // failed requests are not charged
+		{http.MethodPost, "/files", "42", "", http.StatusOK, ""},
+		{http.MethodPost, "/files", "42", "", http.StatusTooManyRequests, constants.ReasonHourLimitExceeded},
+		{http.MethodPost, "/jobs/7/run", "42", "", http.StatusOK, ""},
+		{http.MethodPost, "/jobs/7/run", "42", "", http.StatusTooManyRequests, constants.ReasonMinuteLimitExceeded},
+		{http.MethodPost, "/files", "7", "", http.StatusOK, ""}, // every user has their own usage
+		{http.MethodPost, "/files", "quota", "", http.StatusOK, ""},
+		{http.MethodPost, "/files", "quota", "", http.StatusForbidden, constants.ReasonQuotaLimitExceeded},
+	}
+	for _, testCase := range requests {
+		recorder := serve(testCase.method, testCase.path, testCase.user, testCase.quantity)
+		if recorder.Code != testCase.statusCode {
+			t.Errorf("%s %s: expected status %d, got %d %s", testCase.method, testCase.path, testCase.statusCode, recorder.Code, recorder.Body.String())
+			continue
+		}
+		if testCase.reason == "" {
+			continue
+		}
+		var body map[string]any
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || body["reason"] != testCase.reason || body["entity"] != constants.EntityUser || body["error"] == "" {
+			t.Errorf("%s %s: expected reason %s in body, got %s", testCase.method, testCase.path, testCase.reason, recorder.Body.String())
+		}
+	}
+
+	// handlers that stream e.g server-sent events can still flush the response
+	if recorder := serve(http.MethodGet, "/events", "42", ""); recorder.Code != http.StatusOK || recorder.Flushed == false {
+		t.Errorf("Expected the response to be flushed, got %d flushed %v", recorder.Code, recorder.Flushed)
+	}
+
+	// usage is reserved before the handler runs, so requests in flight together can't exceed the hour limit of 6
+	statusCodes := make(chan int)
+	for range 10 {
+		go func() {
+			statusCodes <- serve(http.MethodPost, "/slow", "9", "").Code
+		}()
+	}
+	deniedCount := 0
+	for range 4 {
+		if statusCode := <-statusCodes; statusCode == http.StatusTooManyRequests {
+			deniedCount++
+		}
+	}
+	close(release)
+	for range 6 {
+		if statusCode := <-statusCodes; statusCode == http.StatusTooManyRequests {
+			deniedCount++
+		}
+	}
+	if deniedCount != 4 {
+		t.Errorf("expected 4 of 10 concurrent requests to be denied, got %d", deniedCount)
+	}
+
+	// a refund takes back exactly what was charged, in both window modes
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	for _, isSlidingWindow := range []bool{false, true} {
+		usage := PermissionUsage{QuotaUsage: 3}
+		if isSlidingWindow {
+			usage.EnableSlidingWindows()
+		}
+		updateUsageData := UpdateUsageData{Operation: constants.OperationCreate, OperationQuantity: 2, OperationTime: now, OperationLimits: NotationToPermission("c----|c=hour:10,custom:[per_90_seconds_5]").CreateOperationLimits}
+		usage = UpdateUsage(updateUsageData, usage)
+		updateUsageData.OperationTime = now.Add(time.Minute)
+		refundedUsage := refundUsage(updateUsageData, UpdateUsage(updateUsageData, usage))
+		if refundedUsage.QuotaUsage != 5 || refundedUsage.CreateOperationUsages.AllTime != 2 || refundedUsage.CreateOperationUsages.WithinTheLastHour != 2 || refundedUsage.CreateOperationUsages.WithinTheLastCustomDurations["1m30s"] != 2 {
+			t.Errorf("sliding window %t: expected the second operation to be refunded, got %+v", isSlidingWindow, refundedUsage)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 30, 0, time.UTC)
+	userPermission := NotationToPermission("cr---|c=minute:5,hour:10,day@cal:20")
+	userUsage := PermissionUsage{CreateOperationUsages: OperationUsage{LastTime: now.Add(-10 * time.Second), WithinTheLastMinute: 3, WithinTheLastHour: 8, WithinTheLastDay: 8}}
+
+	// minute and hour both have 2 remaining, the hour resets later so it's the tightest
+	rateLimit, hasRateLimit := GetEntityRateLimit(constants.OperationCreate, userPermission, userUsage, now)
+	if hasRateLimit == false || rateLimit.Window != constants.NotationOperationHourLimitKey || rateLimit.Limit != 10 || rateLimit.Remaining != 2 || rateLimit.Reset.Equal(now.Add(-10*time.Second).Add(time.Hour)) == false {
+		t.Errorf("unexpected user rate limit %+v", rateLimit)
+	}
+	headers := rateLimit.Headers(now)
+	if headers.Get("RateLimit-Limit") != "10" || headers.Get("RateLimit-Remaining") != "2" || headers.Get("RateLimit-Reset") != "3590" || headers.Get("Retry-After") != "" {
+		t.Errorf("unexpected rate limit headers %v", headers)
+	}
+	if _, hasRateLimit := GetEntityRateLimit(constants.OperationRead, userPermission, userUsage, now); hasRateLimit == true {
+		t.Errorf("expected no rate limit for an operation without duration based limits")
+	}
+
+	// the org has less left for the day than the user has for the hour
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			EntityPermissionOrder: "org->user",
+			OrgEntityPermissions:  NotationToPermission("crude|c=day:100"),
+			UserEntityPermissions: userPermission,
+			Clock:                 NewFakeClock(now),
+		},
+		OrgEntityUsage:  PermissionUsage{CreateOperationUsages: OperationUsage{LastTime: now.Add(-time.Hour), WithinTheLastDay: 99}},
+		UserEntityUsage: userUsage,
+	}
+	rateLimit, _ = GetRateLimit(requestData)
+	if rateLimit.Entity != constants.EntityOrg || rateLimit.Window != constants.NotationOperationDayLimitKey || rateLimit.Remaining != 1 {
+		t.Errorf("expected the org day limit to be the tightest, got %+v", rateLimit)
+	}
+
+	// only the limits of the entities that are charged apply, with first-applicable only the first role that grants the operation is charged
+	roleRequestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			EntityPermissionOrder: "role",
+			Entities: []Entity{
+				{Type: constants.EntityRole, ID: "a", Permission: NotationToPermission("c----|c=hour:100")},
+				{Type: constants.EntityRole, ID: "b", Permission: NotationToPermission("c----|c=hour:1")},
+			},
+			CombiningRules: map[string]string{constants.EntityRole: constants.CombiningRuleFirstApplicable},
+			Clock:          NewFakeClock(now),
+		},
+	}
+	rateLimit, _ = GetRateLimit(roleRequestData)
+	if rateLimit.Entity != "role:a" || rateLimit.Limit != 100 || rateLimit.Remaining != 100 {
+		t.Errorf("expected the hour limit of role:a, the role that is charged, got %+v", rateLimit)
+	}
+
+	// calendar windows reset at the start of the next one, the day window of the user resets at midnight
+	requestData.OrgEntityUsage.CreateOperationUsages.WithinTheLastDay = 0
+	requestData.UserEntityUsage.CreateOperationUsages.WithinTheLastDay = 20
+	rateLimit, _ = GetRateLimit(requestData)
+	if rateLimit.Window != constants.NotationOperationDayLimitKey || rateLimit.Remaining != 0 || rateLimit.Reset.Equal(time.Date(2025, time.March, 11, 0, 0, 0, 0, time.UTC)) == false {
+		t.Errorf("expected the user calendar day limit to be the tightest, got %+v", rateLimit)
+	}
+	if rateLimit.Headers(now).Get("Retry-After") != rateLimit.Headers(now).Get("RateLimit-Reset") {
+		t.Errorf("expected Retry-After when nothing remains, got %v", rateLimit.Headers(now))
+	}
+	if end := calendarWindowEnd(constants.NotationOperationMonthLimitKey, time.Date(2025, time.February, 28, 10, 0, 0, 0, time.UTC), time.UTC, 31); end.Equal(time.Date(2025, time.March, 31, 0, 0, 0, 0, time.UTC)) == false {
+		t.Errorf("expected the month anchored on the 31st to reset on March 31st, got %s", end)
+	}
+
+	// in sliding window mode, the reset is when the oldest operation leaves the window
+	slidingUsage := PermissionUsage{}
+	slidingUsage.EnableSlidingWindows()
+	hourLimit := OperationLimit{PerHourLimit: 10}
+	for _, operationTime := range []time.Time{now, now.Add(30 * time.Minute)} {
+		slidingUsage = UpdateUsage(UpdateUsageData{Operation: constants.OperationCreate, OperationQuantity: 2, OperationTime: operationTime, OperationLimits: hourLimit}, slidingUsage)
+	}
+	rateLimit, _ = GetEntityRateLimit(constants.OperationCreate, Permission{Create: true, CreateOperationLimits: hourLimit}, slidingUsage, now.Add(40*time.Minute))
+	if rateLimit.Remaining != 6 || rateLimit.Reset.Before(now.Add(time.Hour)) || rateLimit.Reset.After(now.Add(62*time.Minute)) {
+		t.Errorf("unexpected sliding window rate limit %+v", rateLimit)
+	}
+
+	// the middleware adds the headers, with what's left after a permitted request, and Retry-After when a request is denied
+	clock := NewFakeClock(now)
+	middleware := NewHTTPMiddleware(NewEngine(NewMemoryUsageStore()), func(request *http.Request) (StoreRequestData, error) {
+		return StoreRequestData{
+			PermissionRequestData: PermissionRequestData{EntityPermissionOrder: "user", UserEntityPermissions: NotationToPermission("c----|c=hour:2"), Clock: clock},
+			EntityIDs:             EntityIDs{constants.EntityUser: "42"},
+		}, nil
+	})
+	handler := middleware.Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	expectedHeaders := []struct {
+		statusCode int
+		remaining  string
+		retryAfter string
+	}{
+		{http.StatusOK, "1", ""},
+		{http.StatusOK, "0", ""},
+		{http.StatusTooManyRequests, "0", "3600"},
+	}
+	for i, expected := range expectedHeaders {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/files", nil))
+		if recorder.Code != expected.statusCode || recorder.Header().Get("RateLimit-Limit") != "2" || recorder.Header().Get("RateLimit-Remaining") != expected.remaining || recorder.Header().Get("Retry-After") != expected.retryAfter {
+			t.Errorf("request %d: unexpected response %d %v", i, recorder.Code, recorder.Header())
+		}
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			EntityPermissionOrder: "org->role->user",
+			OrgEntityPermissions:  NotationToPermission("crude|q=5000|c=batch:10,month:100,custom:[per_30_seconds_8]"),
+			RoleEntityPermissions: NotationToPermission("crude|c=batch:50"),
+			UserEntityPermissions: NotationToPermission("crud-|q=3000|c=batch:20,hour:5,month:200,all:1000"),
+			Clock:                 NewFakeClock(now),
+		},
+		OrgEntityUsage:  PermissionUsage{QuotaUsage: 2500, CreateOperationUsages: OperationUsage{LastTime: now.Add(-time.Minute), WithinTheLastMonth: 60}},
+		UserEntityUsage: PermissionUsage{QuotaUsage: 1000, CreateOperationUsages: OperationUsage{LastTime: now.Add(-time.Minute), AllTime: 990, WithinTheLastHour: 2, WithinTheLastMonth: 40}},
+	}
+
+	allowance := Remaining(requestData)
+	if allowance.Decision.Allowed == false {
+		t.Fatalf("expected create to be permitted, got %s", allowance.Decision)
+	}
+	expectedWindows := []WindowAllowance{
+		{Window: "batch", Entity: constants.EntityOrg, Limit: 10, Remaining: 10},
+		{Window: "quota", Entity: constants.EntityUser, Limit: 3000, Remaining: 2000},
+		{Window: "all", Entity: constants.EntityUser, Limit: 1000, Remaining: 10},
+		{Window: "hour", Entity: constants.EntityUser, Limit: 5, Remaining: 3},
+		{Window: "month", Entity: constants.EntityOrg, Limit: 100, Remaining: 40},
+		{Window: "30s", Entity: constants.EntityOrg, Limit: 8, Remaining: 8},
+	}
+	if len(allowance.Windows) != len(expectedWindows) {
+		t.Fatalf("expected %d windows, got %+v", len(expectedWindows), allowance.Windows)
+	}
+	for i, expectedWindow := range expectedWindows {
+		window := allowance.Windows[i]
+		if window.Window != expectedWindow.Window || window.Entity != expectedWindow.Entity || window.Limit != expectedWindow.Limit || window.Remaining != expectedWindow.Remaining {
+			t.Errorf("expected window %+v, got %+v", expectedWindow, window)
+		}
+	}
+	if hourAllowance, _ := allowance.Window("hour"); hourAllowance.Reset.Equal(now.Add(59*time.Minute)) == false {
+		t.Errorf("expected the hour to reset an hour after the last operation, got %s", hourAllowance.Reset)
+	}
+	if _, isLimited := allowance.Window("day"); isLimited == true {
+		t.Errorf("expected no day window, since no entity limits it")
+	}
+	if binding, _ := allowance.Binding(); binding.Window != "hour" || binding.Remaining != 3 {
+		t.Errorf("expected the hour to be binding, got %+v", binding)
+	}
+
+	// the quota doesn't limit operations that don't increase it
+	requestData.Operation = constants.OperationDelete
+	if _, isLimited := Remaining(requestData).Window("quota"); isLimited == true {
+		t.Errorf("expected no quota window for delete")
+	}
+
+	// the user doesn't grant execute, so nothing remains
+	requestData.Operation = constants.OperationExecute
+	allowance = Remaining(requestData)
+	if allowance.Decision.Reason != constants.ReasonOperationNotGranted || allowance.Decision.Entity != constants.EntityUser {
+		t.Errorf("expected execute to be denied by the user, got %s", allowance.Decision)
+	}
+	for _, window := range allowance.Windows {
+		if window.Remaining != 0 {
+			t.Errorf("expected nothing to remain when the operation is denied, got %+v", window)
+		}
+	}
+
+	// with first-applicable, only the first role that grants the operation is charged, so its limits are the only ones that bind
+	requestData = PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{
+			Operation:             constants.OperationCreate,
+			EntityPermissionOrder: "role",
+			Entities: []Entity{
+				{Type: constants.EntityRole, ID: "a", Permission: NotationToPermission("c----|c=hour:100")},
+				{Type: constants.EntityRole, ID: "b", Permission: NotationToPermission("c----|c=hour:1")},
+			},
+			CombiningRules: map[string]string{constants.EntityRole: constants.CombiningRuleFirstApplicable},
+			Clock:          NewFakeClock(now),
+		},
+	}
+	if hourAllowance, _ := Remaining(requestData).Window("hour"); hourAllowance.Entity != "role:a" || hourAllowance.Remaining != 100 {
+		t.Errorf("expected role:a to be binding with 100 remaining, got %+v", hourAllowance)
+	}
+}
+
+func TestEffectivePermission(t *testing.T) {
+	permissionRequestData := PermissionRequestData{
+		EntityPermissionOrder: "org->role->user",
+		OrgEntityPermissions:  NotationToPermission("crude|q=500|c=batch:5,hour:10,month@cal:1000,tz:Europe/Paris|r=day:100|schedule=days=mon-fri;hours=08:00-18:00"),
+		RoleEntityPermissions: NotationToPermission("cru-e|start=2025-01-01T00:00:00Z|end=2026-01-01T00:00:00Z|c=batch:10,hour:20,day:50,custom:[per_30_seconds_8]|schedule=days=fri-sat;hours=12:00-22:00|if=subject.mfa == true"),
+		UserEntityPermissions: NotationToPermission("cru!de|q=200|end=2025-06-01T00:00:00Z|c=batch:2,month:900|r=batch:3,day:80"),
+	}
+
+	expectedNotation := "cru!de|start=2025-01-01T00:00:00Z|end=2025-06-01T00:00:00Z|schedule=days=fri;hours=12:00-18:00|q=200|if=subject.mfa == true|c=batch:2,hour:10,day:50,month:900,custom:[per_30_seconds_8]|r=day:80"
+	if notation := EffectiveNotation(permissionRequestData); notation != expectedNotation {
+		t.Errorf("Expected effective notation %s, got %s", expectedNotation, notation)
+	}
+	if normalizedNotation, err := NormalizeNotation(expectedNotation); err != nil || normalizedNotation != expectedNotation {
+		t.Errorf("Expected the effective notation to be a canonical notation, got %s %v", normalizedNotation, err)
+	}
+	if permissionRequestData.OrgEntityPermissions.CreateOperationLimits.PerMonthLimit != 1000 || len(permissionRequestData.OrgEntityPermissions.CreateOperationLimits.CalendarWindows) != 1 {
+		t.Errorf("Expected the permissions of the entities to be left as they are")
+	}
+
+	// the effective permission decides the same as the entities, for a request that every entity permits, and one that one of them denies
+	effectiveRequestData := PermissionRequestData{EntityPermissionOrder: "user", UserEntityPermissions: EffectivePermission(permissionRequestData), Context: map[string]any{"subject": map[string]any{"mfa": true}}}
+	permissionRequestData.Context = effectiveRequestData.Context
+	for _, operation := range []string{constants.OperationCreate, constants.OperationDelete} {
+		permissionRequestData.Operation, effectiveRequestData.Operation = operation, operation
+		friday := time.Date(2025, time.March, 14, 13, 0, 0, 0, time.UTC)
+		permissionRequestData.Clock, effectiveRequestData.Clock = NewFakeClock(friday), NewFakeClock(friday)
+		if decision, effectiveDecision := CheckOperation(permissionRequestData), CheckOperation(effectiveRequestData); decision.Allowed != effectiveDecision.Allowed {
+			t.Errorf("%s: expected the same decision, got %s and %s", operation, decision, effectiveDecision)
+		}
+	}
+
+	// schedules in different time zones are intersected in UTC, and entities that are never in effect at the same time grant nothing
+	permissionRequestData = PermissionRequestData{
+		EntityPermissionOrder: "org->user",
+		OrgEntityPermissions:  NotationToPermission("crude|schedule=days=mon;hours=00:00-17:00;tz=Europe/Paris"),
+		UserEntityPermissions: NotationToPermission("crude|schedule=days=mon;hours=08:00-12:00&days=sun;hours=22:00-02:00"),
+		Clock:                 NewFakeClock(time.Date(2025, time.January, 6, 0, 0, 0, 0, time.UTC)),
+	}
+	if notation := EffectiveNotation(permissionRequestData); notation != "crude|schedule=days=sun;hours=23:00-00:00&days=mon;hours=00:00-02:00&days=mon;hours=08:00-12:00" {
+		t.Errorf("Expected the schedules to be intersected in UTC, got %s", notation)
+	}
+	permissionRequestData.UserEntityPermissions = NotationToPermission("crude|schedule=days=tue")
+	if notation := EffectiveNotation(permissionRequestData); notation != "-----" {
+		t.Errorf("Expected nothing to be granted, got %s", notation)
+	}
+
+	// an entity type that isn't registered denies every operation, so nothing is granted
+	permissionRequestData = PermissionRequestData{
+		Operation:             constants.OperationCreate,
+		EntityPermissionOrder: "org->grop->user",
+		OrgEntityPermissions:  NotationToPermission("crude"),
+		UserEntityPermissions: NotationToPermission("crude"),
+	}
+	if decision := CheckOperation(permissionRequestData); decision.Reason != constants.ReasonInvalidEntity {
+		t.Errorf("Expected the invalid entity to deny the operation, got %s", decision)
+	}
+	if notation := EffectiveNotation(permissionRequestData); notation != "-----" {
+		t.Errorf("Expected nothing to be granted with an invalid entity, got %s", notation)
+	}
+}
+
+// compiledNotation is the notation of TestCompiler and the benchmarks, with a schedule and a calendar window, so they are evaluated too
+const compiledNotation = "crud-|q=500|c=batch:5,hour:100,day:1000,month@cal:10000,tz:Europe/Paris|r=minute:60|schedule=days=mon-fri;hours=08:00-18:00"
+
+func TestCompiler(t *testing.T) {
+	compiler := NewCompiler(2)
+	compiledPermission, err := compiler.Compile(compiledNotation)
+	if err != nil {
+		t.Fatalf("Expected the notation to compile, got %v", err)
+	}
+	if cachedPermission, _ := compiler.Compile(compiledNotation); cachedPermission != compiledPermission {
+		t.Errorf("Expected the compiled permission to be cached")
+	}
+	if reflect.DeepEqual(compiledPermission.Permission(), NotationToPermission(compiledNotation)) == false {
+		t.Errorf("Expected the compiled permission to be the parsed notation")
+	}
+	permission := compiledPermission.Permission()
+	permission.CreateOperationLimits.CalendarWindows[0] = constants.NotationOperationDayLimitKey
+	if compiledPermission.Permission().CreateOperationLimits.CalendarWindows[0] != constants.NotationOperationMonthLimitKey {
+		t.Errorf("Expected the compiled permission not to change when its copy is modified")
+	}
+
+	// errors aren't cached, and the least recently used notation is evicted when the cache is full
+	if _, err := compiler.Compile("crude|c=batch:x"); err == nil || compiler.Len() != 1 {
+		t.Errorf("Expected a malformed notation to fail without being cached, got %v and %d cached", err, compiler.Len())
+	}
+	compiler.Compile("-r---")
+	compiler.Compile(compiledNotation)
+	compiler.Compile("cr---")
+	if compiler.Len() != 2 {
+		t.Errorf("Expected the cache to be bounded to 2 notations, got %d", compiler.Len())
+	}
+	if cachedPermission, _ := compiler.Compile(compiledNotation); cachedPermission != compiledPermission {
+		t.Errorf("Expected the most recently used notation to stay cached")
+	}
+
+	// the compiled permission decides the same as CheckOperationWithUsage, without allocating
+	monday := time.Date(2025, time.March, 10, 9, 0, 0, 0, time.UTC)
+	usage := PermissionUsage{QuotaUsage: 499, CreateOperationUsages: OperationUsage{LastTime: monday.Add(-time.Minute), WithinTheLastHour: 10, WithinTheLastDay: 10, WithinTheLastMonth: 10}}
+	for _, operationQuantity := range []uint{1, 2} {
+		requestData := PermissionWithUsageRequestData{
+			PermissionRequestData: PermissionRequestData{Operation: constants.OperationCreate, EntityPermissionOrder: "user", UserEntityPermissions: NotationToPermission(compiledNotation), Clock: NewFakeClock(monday)},
+			OperationQuantity:     operationQuantity,
+			UserEntityUsage:       usage,
+		}
+		decision := CheckOperationWithUsage(requestData)
+		compiledDecision := compiledPermission.CheckWithUsage(constants.OperationCreate, operationQuantity, usage, nil, monday)
+		compiledDecision.Entity = decision.Entity
+		if reflect.DeepEqual(decision, compiledDecision) == false {
+			t.Errorf("Expected the decision %s, got %s", decision, compiledDecision)
+		}
+	}
+	if allocations := testing.AllocsPerRun(100, func() { compiledPermission.Check(constants.OperationRead, nil, monday) }); allocations != 0 {
+		t.Errorf("Expected Check not to allocate, got %v allocations", allocations)
+	}
+	if allocations := testing.AllocsPerRun(100, func() { compiledPermission.CheckWithUsage(constants.OperationCreate, 1, usage, nil, monday) }); allocations != 0 {
+		t.Errorf("Expected CheckWithUsage not to allocate, got %v allocations", allocations)
+	}
+
+	// the condition is parsed once, when the notation is compiled
+	conditionalPermission, _ := Compile("crude|if=subject.mfa == true")
+	if decision := conditionalPermission.Check(constants.OperationRead, map[string]any{"subject": map[string]any{"mfa": false}}, monday); decision.Reason != constants.ReasonConditionNotMet {
+		t.Errorf("Expected the condition not to be met, got %s", decision)
+	}
+	if _, err := Compile("crude|if=subject.mfa =="); err == nil {
+		t.Errorf("Expected a malformed condition not to compile")
+	}
+}
+
+func BenchmarkNotationToPermission(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NotationToPermission(compiledNotation)
+	}
+}
+
+func BenchmarkCompilerCompile(b *testing.B) {
+	compiler := NewCompiler(0)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		compiler.Compile(compiledNotation)
+	}
+}
+
+func BenchmarkCompiledPermissionCheck(b *testing.B) {
+	compiledPermission, _ := Compile(compiledNotation)
+	monday := time.Date(2025, time.March, 10, 9, 0, 0, 0, time.UTC)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		compiledPermission.Check(constants.OperationRead, nil, monday)
+	}
+}
+
+func BenchmarkCompiledPermissionCheckWithUsage(b *testing.B) {
+	compiledPermission, _ := Compile(compiledNotation)
+	monday := time.Date(2025, time.March, 10, 9, 0, 0, 0, time.UTC)
+	usage := PermissionUsage{QuotaUsage: 10, CreateOperationUsages: OperationUsage{LastTime: monday.Add(-time.Minute), WithinTheLastHour: 10, WithinTheLastDay: 10, WithinTheLastMonth: 10}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		compiledPermission.CheckWithUsage(constants.OperationCreate, 1, usage, nil, monday)
+	}
+}
+
+func BenchmarkCheckOperationWithUsage(b *testing.B) {
+	monday := time.Date(2025, time.March, 10, 9, 0, 0, 0, time.UTC)
+	requestData := PermissionWithUsageRequestData{
+		PermissionRequestData: PermissionRequestData{Operation: constants.OperationCreate, EntityPermissionOrder: "user", UserEntityPermissions: NotationToPermission(compiledNotation), Clock: NewFakeClock(monday)},
+		OperationQuantity:     1,
+		UserEntityUsage:       PermissionUsage{QuotaUsage: 10, CreateOperationUsages: OperationUsage{LastTime: monday.Add(-time.Minute), WithinTheLastHour: 10, WithinTheLastDay: 10, WithinTheLastMonth: 10}},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CheckOperationWithUsage(requestData)
+	}
+}
@@ -0,0 +1,225 @@
+package permitta
+
+import (
+	"errors"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Policy holds the permission of an entity for every resource it has access to, keyed by resource name e.g files, videos or invoices, or resource path pattern e.g /projects/alpha/** , see Policy.Match
+// In notation, each resource's permission is written in braces after the resource name, and resources are separated with ";" e.g files{crude|q=100};videos{-r---}
+type Policy map[string]Permission
+
+// PolicyUsage holds the usage of an entity for every resource, keyed by resource name or pattern, so usage of one resource never counts against another
+type PolicyUsage map[string]PermissionUsage
+
+// NotationToPolicy converts a policy notation e.g files{crude|q=100};videos{-r---} to a Policy
+// If the notation is malformed, an empty Policy is returned, which denies every operation on every resource. Use ParsePolicy if you need to know what is wrong with the notation
+func NotationToPolicy(notation string) Policy {
+	policy, err := ParsePolicy(notation)
+	if err != nil {
+		logNotationError("malformed policy notation", err)
+		return Policy{}
+	}
+	return policy
+}
+
+// ParsePolicy converts a policy notation e.g files{crude|q=100};videos{-r---} to a Policy, the notation of each resource is parsed with ParseNotation
+// If the notation is malformed, a *NotationError is returned, its Resource is the resource whose notation has the problem, and its Offset is in the whole policy notation
+// White spaces around resource names are ignored, and empty resources e.g a trailing ";" are skipped
+func ParsePolicy(notation string) (Policy, error) {
+	policy := make(Policy)
+	resourceOffset := 0
+	for resourceIndex, resourceNotation := range splitPolicyNotation(notation) {
+		currentResourceOffset := resourceOffset
+		resourceOffset = resourceOffset + len(resourceNotation) + len(constants.NotationPolicySeparator)
+		if strings.TrimSpace(resourceNotation) == "" {
+			continue
+		}
+
+		resourceName, permissionNotation, hasStart := strings.Cut(resourceNotation, constants.NotationResourceStart)
+		permissionNotation, hasEnd := strings.CutSuffix(strings.TrimRightFunc(permissionNotation, unicode.IsSpace), constants.NotationResourceEnd)
+		resourceName = strings.TrimSpace(resourceName)
+		if hasStart == false || hasEnd == false || resourceName == "" || strings.ContainsAny(resourceName, constants.NotationResourceStart+constants.NotationResourceEnd) {
+			return nil, &NotationError{Err: ErrMalformedPolicy, Section: resourceIndex, Token: strings.TrimSpace(resourceNotation), Offset: currentResourceOffset, Suggestion: "write every resource as name{notation} e.g files{crude|q=100}"}
+		}
+		if _, isDuplicate := policy[resourceName]; isDuplicate {
+			return nil, &NotationError{Err: ErrDuplicateResource, Section: resourceIndex, Token: resourceName, Offset: currentResourceOffset, Suggestion: "merge the notations of '" + resourceName + "' into one", Resource: resourceName}
+		}
+
+		permission, err := ParseNotation(permissionNotation)
+		if err != nil {
+			var notationError *NotationError
+			if errors.As(err, &notationError) {
+				resourceNotationError := *notationError
+				resourceNotationError.Offset = resourceNotationError.Offset + currentResourceOffset + strings.Index(resourceNotation, constants.NotationResourceStart) + 1
+				resourceNotationError.Resource = resourceName
+				return nil, &resourceNotationError
+			}
+			return nil, err
+		}
+		policy[resourceName] = permission
+	}
+
+	return policy, nil
+}
+
+// PolicyToNotation converts a Policy back to a policy notation, resources are sorted by name and each permission is in its canonical form, see PermissionToNotation
+func PolicyToNotation(policy Policy) string {
+	resourceNames := make([]string, 0, len(policy))
+	for resourceName := range policy {
+		resourceNames = append(resourceNames, resourceName)
+	}
+	slices.Sort(resourceNames)
+
+	resourceNotations := make([]string, 0, len(resourceNames))
+	for _, resourceName := range resourceNames {
+		resourceNotations = append(resourceNotations, resourceName+constants.NotationResourceStart+PermissionToNotation(policy[resourceName])+constants.NotationResourceEnd)
+	}
+	return strings.Join(resourceNotations, constants.NotationPolicySeparator)
+}
+
+// splitPolicyNotation splits a policy notation into the notations of its resources, separators within braces are not split on
+func splitPolicyNotation(notation string) []string {
+	var resourceNotations []string
+	depth := 0
+	resourceStart := 0
+	for i := 0; i < len(notation); i++ {
+		switch {
+		case strings.HasPrefix(notation[i:], constants.NotationResourceStart):
+			depth++
+		case strings.HasPrefix(notation[i:], constants.NotationResourceEnd) && depth > 0:
+			depth--
+		case strings.HasPrefix(notation[i:], constants.NotationPolicySeparator) && depth == 0:
+			resourceNotations = append(resourceNotations, notation[resourceStart:i])
+			resourceStart = i + len(constants.NotationPolicySeparator)
+		}
+	}
+	return append(resourceNotations, notation[resourceStart:])
+}
+
+// Match returns the resource name or pattern in the policy that applies to the resource, and reports if there is one
+// A resource name that is exactly the resource always applies. Otherwise resource names can be path patterns e.g /projects/alpha/** , where "*" matches within one path segment, and "**" matches any number of segments,
+// and the most specific pattern that matches wins, which is the one with the most segments without wildcards, then the one with the most segments
+func (policy Policy) Match(resource string) (string, bool) {
+	if _, isFound := policy[resource]; isFound {
+		return resource, true
+	}
+
+	bestPattern := ""
+	isMatched := false
+	for pattern := range policy {
+		if matchResourcePattern(pattern, resource) == false {
+			continue
+		}
+		if isMatched == false || compareResourcePatterns(pattern, bestPattern) > 0 {
+			bestPattern = pattern
+			isMatched = true
+		}
+	}
+	return bestPattern, isMatched
+}
+
+// matchResourcePattern reports if the resource path matches the pattern, see Policy.Match
+func matchResourcePattern(pattern string, resource string) bool {
+	if strings.Contains(pattern, "*") == false && strings.Contains(pattern, "?") == false && strings.Contains(pattern, "[") == false {
+		return pattern == resource
+	}
+	return matchResourceSegments(strings.Split(pattern, "/"), strings.Split(resource, "/"))
+}
+
+// matchResourceSegments matches the path segments of a resource against the segments of a pattern, "**" matches any number of segments and other segments are matched with path.Match
+func matchResourceSegments(patternSegments []string, resourceSegments []string) bool {
+	if len(patternSegments) == 0 {
+		return len(resourceSegments) == 0
+	}
+	if patternSegments[0] == "**" {
+		for skippedSegments := 0; skippedSegments <= len(resourceSegments); skippedSegments++ {
+			if matchResourceSegments(patternSegments[1:], resourceSegments[skippedSegments:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(resourceSegments) == 0 {
+		return false
+	}
+	isSegmentMatched, err := path.Match(patternSegments[0], resourceSegments[0])
+	if err != nil || isSegmentMatched == false {
+		return false
+	}
+	return matchResourceSegments(patternSegments[1:], resourceSegments[1:])
+}
+
+// compareResourcePatterns returns a positive number if pattern a is more specific than b, a negative number if it's less specific, see Policy.Match
+// patterns that are as specific as each other are compared by their text, so the result is always the same
+func compareResourcePatterns(a string, b string) int {
+	specificity := func(pattern string) (int, int) {
+		literalSegments := 0
+		segments := 0
+		for _, segment := range strings.Split(pattern, "/") {
+			if segment == "**" {
+				continue
+			}
+			segments++
+			if strings.ContainsAny(segment, "*?[") == false {
+				literalSegments++
+			}
+		}
+		return literalSegments, segments
+	}
+
+	aLiteralSegments, aSegments := specificity(a)
+	bLiteralSegments, bSegments := specificity(b)
+	if aLiteralSegments != bLiteralSegments {
+		return aLiteralSegments - bLiteralSegments
+	}
+	if aSegments != bSegments {
+		return aSegments - bSegments
+	}
+	return strings.Compare(b, a)
+}
+
+// forResource returns the entity with the permission and usage of the resource, if the entity has a Policy and a resource is requested
+// An entity without a Policy has the same permission for every resource, while an entity with a Policy has no permission for resources that no resource name or pattern in it matches
+// The usage is the usage of the resource name or pattern that matched, see Policy.Match
+func (entity Entity) forResource(resource string) Entity {
+	if resource == "" || entity.Policy == nil {
+		return entity
+	}
+
+	matchedResource, isMatched := entity.Policy.Match(resource)
+	if isMatched == false {
+		entity.Permission = Permission{}
+		entity.Usage = PermissionUsage{}
+		return entity
+	}
+	entity.Permission = entity.Policy[matchedResource]
+	if entity.PolicyUsage != nil {
+		entity.Usage = entity.PolicyUsage[matchedResource]
+	}
+	return entity
+}
+
+// usageResource returns the resource the usage of the entity is kept for, the resource name or pattern of its Policy that matches the resource, or the resource itself if the entity has no policy or nothing in it matches
+func (entity Entity) usageResource(resource string) string {
+	if matchedResource, isMatched := entity.Policy.Match(resource); isMatched {
+		return matchedResource
+	}
+	return resource
+}
+
+// IsAllowed checks if the operation on the resource path e.g /projects/alpha/report.pdf is permitted for the chain of entities, in their order, without considering usage
+// It is a thin wrapper around CheckResource
+func IsAllowed(entities []Entity, operation string, resourcePath string) bool {
+	return CheckResource(entities, operation, resourcePath).Allowed
+}
+
+// CheckResource checks if the operation on the resource path is permitted for the chain of entities, in their order, and returns a Decision describing the result
+// The permission of entities with a Policy is the permission of the most specific resource pattern that matches the path, see Policy.Match
+func CheckResource(entities []Entity, operation string, resourcePath string) Decision {
+	return CheckOperation(PermissionRequestData{Operation: operation, Resource: resourcePath, Entities: entities})
+}
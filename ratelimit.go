@@ -0,0 +1,240 @@
+package permitta
+
+import (
+	constants "github.com/limitlessdonald/permitta/constants"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit is the state of a duration based limit of an operation e.g the hour limit of the user, which is what the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and Retry-After headers are made of, see RateLimit.Headers
+type RateLimit struct {
+	Entity    string `json:"entity,omitempty"` // the entity the limit belongs to e.g constants.EntityUser , empty for GetEntityRateLimit
+	Window    string `json:"window"`           // the notation limit key of the window e.g "hour", or the key of the custom duration e.g "32s"
+	Limit     uint   `json:"limit"`
+	Remaining uint   `json:"remaining"` // how many more operations can be performed within the window
+	// Reset is when the usage of the window is reset. For calendar windows, it's the start of the next calendar window, for rolling windows it's a window after the last operation,
+	// and in sliding window mode, it's when the oldest operation within the window leaves it, which is the next time Remaining goes up
+	Reset time.Time `json:"reset"`
+}
+
+// durationWindowKeys are the notation limit keys of the duration based limits, shortest first
+var durationWindowKeys = []string{
+	constants.NotationOperationMinuteLimitKey,
+	constants.NotationOperationHourLimitKey,
+	constants.NotationOperationDayLimitKey,
+	constants.NotationOperationWeekLimitKey,
+	constants.NotationOperationFortnightLimitKey,
+	constants.NotationOperationMonthLimitKey,
+	constants.NotationOperationQuarterLimitKey,
+	constants.NotationOperationYearLimitKey,
+}
+
+// reasonWindowKeys are the notation limit keys of the windows of the limit exceeded reasons, custom duration limits use Decision.Window instead
+var reasonWindowKeys = map[string]string{
+	constants.ReasonMinuteLimitExceeded:    constants.NotationOperationMinuteLimitKey,
+	constants.ReasonHourLimitExceeded:      constants.NotationOperationHourLimitKey,
+	constants.ReasonDayLimitExceeded:       constants.NotationOperationDayLimitKey,
+	constants.ReasonWeekLimitExceeded:      constants.NotationOperationWeekLimitKey,
+	constants.ReasonFortnightLimitExceeded: constants.NotationOperationFortnightLimitKey,
+	constants.ReasonMonthLimitExceeded:     constants.NotationOperationMonthLimitKey,
+	constants.ReasonQuarterLimitExceeded:   constants.NotationOperationQuarterLimitKey,
+	constants.ReasonYearLimitExceeded:      constants.NotationOperationYearLimitKey,
+}
+
+// GetRateLimit returns the tightest duration based limit of the operation across the entities in the EntityPermissionOrder that are charged for it, see Consume, which is the limit with the least remaining, at the time of the Clock of the request
+// If two limits have the same remaining, the one that resets later is the tightest. It reports false if none of the entities has a duration based limit for the operation
+//
+// Quota, all time and batch limits are left out, since they don't reset, use CheckOperationWithUsage to know if an operation exceeds them
+func GetRateLimit(requestData PermissionWithUsageRequestData) (RateLimit, bool) {
+	return tightestRateLimit(getRateLimits(requestData, requestData.now()))
+}
+
+// GetEntityRateLimit returns the tightest duration based limit of the operation in a single entity's permission and usage at the time now, see GetRateLimit
+func GetEntityRateLimit(operation string, permission Permission, usage PermissionUsage, now time.Time) (RateLimit, bool) {
+	return tightestRateLimit(entityRateLimits(operation, Entity{Permission: permission, Usage: usage}, now))
+}
+
+// getRateLimits returns every duration based limit of the operation of the entities that are charged for it, see chargedEntities
+func getRateLimits(requestData PermissionWithUsageRequestData, now time.Time) []RateLimit {
+	var rateLimits []RateLimit
+	for _, entity := range chargedEntities(requestData, now) {
+		rateLimits = append(rateLimits, entityRateLimits(requestData.Operation, entity, now)...)
+	}
+	return rateLimits
+}
+
+// chargedEntities returns the entities that checkEntityLevels charges for the operation at the time now, like Consume, so the CombiningRules and CombiningAlgorithm decide whose limits apply e.g only the first applicable role
+// The operation quantity is at least 1, since it's what the next operation is charged. If the usage of the entities denies the operation, the entities that grant it without considering usage are returned instead, so the limit that denied it is among their limits
+func chargedEntities(requestData PermissionWithUsageRequestData, now time.Time) []Entity {
+	operationQuantity := max(requestData.OperationQuantity, 1)
+	decision, entities := checkEntityLevels(requestData, now, func(entity Entity) Decision {
+		return checkEntityOperationWithUsage(requestData.Operation, operationQuantity, entity, now)
+	})
+	if decision.Allowed == true {
+		return entities
+	}
+	_, entities = checkEntityLevels(requestData, now, func(entity Entity) Decision {
+		return checkEntityOperation(requestData.Operation, entity.Permission, now)
+	})
+	return entities
+}
+
+// entityRateLimits returns every duration based limit of the operation of the entity, with the usage sanitized at the time now
+func entityRateLimits(operation string, entity Entity, now time.Time) []RateLimit {
+	operationLimits := GetOperationLimits(operation, entity.Permission)
+	operationUsage := getOperationUsage(operation, entity.Usage)
+	operationUsage.sanitizeDurationUsage(operationLimits, now)
+
+	var rateLimits []RateLimit
+	for _, limitKey := range durationWindowKeys {
+		limit := operationLimits.notationLimit(limitKey)
+		if limit == constants.Unlimited {
+			continue
+		}
+		usage := *operationUsage.withinTheLast(limitKey)
+		rateLimits = append(rateLimits, RateLimit{
+			Entity:    entity.Key(),
+			Window:    limitKey,
+			Limit:     limit,
+			Remaining: remainingWithin(limit, usage),
+			Reset:     operationUsage.windowReset(limitKey, slidingWindowDurations[limitKey], operationLimits, usage, now),
+		})
+	}
+	for _, customDurationLimit := range operationLimits.CustomDurationsLimit {
+		if customDurationLimit.Max == constants.Unlimited {
+			continue
+		}
+		usage := operationUsage.WithinTheLastCustomDurations[customDurationLimit.Key()]
+		rateLimits = append(rateLimits, RateLimit{
+			Entity:    entity.Key(),
+			Window:    customDurationLimit.Key(),
+			Limit:     customDurationLimit.Max,
+			Remaining: remainingWithin(customDurationLimit.Max, usage),
+			Reset:     operationUsage.windowReset(customDurationLimit.Key(), customDurationLimit.Every, operationLimits, usage, now),
+		})
+	}
+	return rateLimits
+}
+
+// remainingWithin returns what's left of the limit after the usage, it's 0 if the usage is already over the limit e.g because the limit was lowered
+func remainingWithin(limit uint, usage uint) uint {
+	if usage >= limit {
+		return 0
+	}
+	return limit - usage
+}
+
+// windowReset returns when the usage of the window of the limit key is reset, usage is the sanitized usage within the window as at now
+func (operationUsage OperationUsage) windowReset(limitKey string, window time.Duration, operationLimits OperationLimit, usage uint, now time.Time) time.Time {
+	if operationLimits.isCalendarWindow(limitKey) {
+		return calendarWindowEnd(limitKey, now, operationLimits.location(), operationLimits.AnchorDay)
+	}
+	// nothing to reset, so the window would start with the next operation
+	if usage == 0 {
+		return now.Add(window)
+	}
+	if operationUsage.SlidingWindow == true {
+		if buckets, isBucketsFound := operationUsage.SlidingWindowBuckets[limitKey]; isBucketsFound {
+			return buckets.nextExpiry(now)
+		}
+	}
+	return operationUsage.LastTime.Add(window)
+}
+
+// nextExpiry returns when the oldest bucket with usage within the trailing window as at now leaves the window
+func (slidingWindowBuckets SlidingWindowBuckets) nextExpiry(now time.Time) time.Time {
+	bucketCount := int64(len(slidingWindowBuckets.Buckets))
+	if bucketCount == 0 || slidingWindowBuckets.BucketSize < 1 {
+		return now
+	}
+	currentBucket := now.UnixNano() / int64(slidingWindowBuckets.BucketSize)
+
+	// the same buckets that are added up by sum, oldest first
+	for i := max(currentBucket, slidingWindowBuckets.Head) - bucketCount + 1; i <= min(currentBucket, slidingWindowBuckets.Head); i++ {
+		if slidingWindowBuckets.Buckets[ringIndex(i, bucketCount)] > 0 {
+			return time.Unix(0, (i+bucketCount)*int64(slidingWindowBuckets.BucketSize))
+		}
+	}
+	return now
+}
+
+// calendarWindowEnd returns the end of the calendar window that t is in, which is the start of the next one, see calendarWindowStart
+func calendarWindowEnd(limitKey string, t time.Time, location *time.Location, anchorDay uint) time.Time {
+	windowStart := calendarWindowStart(limitKey, t, location, anchorDay)
+	year, month, day := windowStart.Date()
+
+	switch limitKey {
+	case constants.NotationOperationMinuteLimitKey:
+		return windowStart.Add(time.Minute)
+	case constants.NotationOperationHourLimitKey:
+		return windowStart.Add(time.Hour)
+	case constants.NotationOperationDayLimitKey:
+		return time.Date(year, month, day+1, 0, 0, 0, 0, location)
+	case constants.NotationOperationWeekLimitKey:
+		return time.Date(year, month, day+7, 0, 0, 0, 0, location)
+	case constants.NotationOperationMonthLimitKey:
+		return anchoredDate(year, month+1, anchorDay, location)
+	case constants.NotationOperationQuarterLimitKey:
+		return anchoredDate(year, month+3, anchorDay, location)
+	case constants.NotationOperationYearLimitKey:
+		return anchoredDate(year, month+12, anchorDay, location)
+	}
+
+	return t
+}
+
+// tightestRateLimit returns the rate limit with the least remaining, or the one that resets later if they have the same remaining
+func tightestRateLimit(rateLimits []RateLimit) (RateLimit, bool) {
+	if len(rateLimits) == 0 {
+		return RateLimit{}, false
+	}
+	tightest := rateLimits[0]
+	for _, rateLimit := range rateLimits[1:] {
+		if rateLimit.Remaining < tightest.Remaining || rateLimit.Remaining == tightest.Remaining && rateLimit.Reset.After(tightest.Reset) {
+			tightest = rateLimit
+		}
+	}
+	return tightest, true
+}
+
+// deniedRateLimit returns the rate limit whose window denied the operation, it reports false if the decision isn't the denial of a duration based limit
+func deniedRateLimit(rateLimits []RateLimit, decision Decision) (RateLimit, bool) {
+	window, isWindowFound := reasonWindowKeys[decision.Reason]
+	if decision.Reason == constants.ReasonCustomDurationLimitExceeded {
+		window, isWindowFound = decision.Window, true
+	}
+	if isWindowFound == false {
+		return RateLimit{}, false
+	}
+	for _, rateLimit := range rateLimits {
+		if rateLimit.Entity == decision.Entity && rateLimit.Window == window {
+			return rateLimit, true
+		}
+	}
+	return RateLimit{}, false
+}
+
+// Headers returns the rate limit as the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, RateLimit-Reset is the number of seconds until Reset from now, rounded up
+// Retry-After is added with the same number of seconds when nothing remains
+func (rateLimit RateLimit) Headers(now time.Time) http.Header {
+	headers := make(http.Header)
+	resetSeconds := secondsUntil(rateLimit.Reset, now)
+	headers.Set(constants.HeaderRateLimitLimit, strconv.FormatUint(uint64(rateLimit.Limit), 10))
+	headers.Set(constants.HeaderRateLimitRemaining, strconv.FormatUint(uint64(rateLimit.Remaining), 10))
+	headers.Set(constants.HeaderRateLimitReset, resetSeconds)
+	if rateLimit.Remaining == 0 {
+		headers.Set(constants.HeaderRetryAfter, resetSeconds)
+	}
+	return headers
+}
+
+// secondsUntil returns the number of whole seconds from now until t, rounded up, it's 0 if t has passed
+func secondsUntil(t time.Time, now time.Time) string {
+	seconds := math.Ceil(t.Sub(now).Seconds())
+	if seconds < 0 {
+		seconds = 0
+	}
+	return strconv.FormatInt(int64(seconds), 10)
+}
@@ -0,0 +1,264 @@
+package permitta
+
+import (
+	"errors"
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a recurring window of time in which a permission is in effect, e.g from Monday to Friday, 08:00 to 18:00 in Europe/Paris, see Permission.Schedules
+// In notation, it's written in the schedule= section as days=mon-fri;hours=08:00-18:00;tz=Europe/Paris
+type Schedule struct {
+	Days []time.Weekday `json:"days,omitempty"` // the days the window opens on, the window opens every day if it's empty
+	// From and Until are the times of day the window opens and closes, as durations since midnight e.g 8*time.Hour for 08:00
+	// If Until is before From, the window spans midnight e.g 22:00-06:00 , and if they are the same e.g both 0, the window lasts the whole day
+	From  time.Duration `json:"from,omitempty"`
+	Until time.Duration `json:"until,omitempty"`
+	// Location is the IANA time zone name e.g Europe/Paris the days and times of day are in, UTC is used if it's empty
+	Location string `json:"location,omitempty"`
+}
+
+// scheduleDayNames are the names of the days in notation, in the order of time.Weekday
+var scheduleDayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// validate checks that the times of day are within a day and that the location exists
+func (schedule Schedule) validate() error {
+	if schedule.From < 0 || schedule.From > 24*time.Hour || schedule.Until < 0 || schedule.Until > 24*time.Hour {
+		return errors.New("the times of day of a schedule must be between 00:00 and 24:00")
+	}
+	for _, day := range schedule.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return fmt.Errorf("invalid day %d in schedule", day)
+		}
+	}
+	if _, err := loadLocation(schedule.Location); err != nil {
+		return err
+	}
+	return nil
+}
+
+// opensOn reports if the window opens on the day of the week
+func (schedule Schedule) opensOn(day time.Weekday) bool {
+	return len(schedule.Days) == 0 || slices.Contains(schedule.Days, day)
+}
+
+// window returns when the window that opens on the date opens and closes, time.Date is used for both, so they are right on days when the clocks change
+func (schedule Schedule) window(year int, month time.Month, day int, location *time.Location) (time.Time, time.Time) {
+	opens := time.Date(year, month, day, int(schedule.From/time.Hour), int(schedule.From%time.Hour/time.Minute), 0, 0, location)
+	closingDay := day
+	if schedule.Until <= schedule.From {
+		closingDay = day + 1
+	}
+	closes := time.Date(year, month, closingDay, int(schedule.Until/time.Hour), int(schedule.Until%time.Hour/time.Minute), 0, 0, location)
+	return opens, closes
+}
+
+// isOpen reports if t is within the window, the window that opened the day before is checked too, since it can span midnight
+func (schedule Schedule) isOpen(t time.Time, location *time.Location) bool {
+	year, month, day := t.In(location).Date()
+	for dayOffset := -1; dayOffset <= 0; dayOffset++ {
+		if schedule.opensOn(time.Date(year, month, day+dayOffset, 12, 0, 0, 0, location).Weekday()) == false {
+			continue
+		}
+		opens, closes := schedule.window(year, month, day+dayOffset, location)
+		if t.Before(opens) == false && t.Before(closes) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpen returns when the window opens next after t
+func (schedule Schedule) nextOpen(t time.Time, location *time.Location) time.Time {
+	year, month, day := t.In(location).Date()
+	for dayOffset := 0; dayOffset <= 7; dayOffset++ {
+		if schedule.opensOn(time.Date(year, month, day+dayOffset, 12, 0, 0, 0, location).Weekday()) == false {
+			continue
+		}
+		if opens, _ := schedule.window(year, month, day+dayOffset, location); opens.After(t) {
+			return opens
+		}
+	}
+	return time.Time{}
+}
+
+// checkSchedules reports if t is within any of the schedules, and if it's not, when the first of them opens next
+// A permission without schedules is in effect at any time of any day
+func checkSchedules(schedules []Schedule, t time.Time) (bool, time.Time, error) {
+	var nextOpen time.Time
+	for _, schedule := range schedules {
+		if err := schedule.validate(); err != nil {
+			return false, time.Time{}, err
+		}
+		location, _ := loadLocation(schedule.Location)
+		if schedule.isOpen(t, location) == true {
+			return true, time.Time{}, nil
+		}
+		if scheduleNextOpen := schedule.nextOpen(t, location); nextOpen.IsZero() || scheduleNextOpen.Before(nextOpen) {
+			nextOpen = scheduleNextOpen
+		}
+	}
+	return len(schedules) == 0, nextOpen, nil
+}
+
+// getNotationSchedules converts the value of a schedule= section e.g days=mon-fri;hours=08:00-18:00;tz=Europe/Paris to schedules
+// A section can have multiple schedules separated with & e.g days=mon-fri;hours=08:00-18:00&days=sat;hours=10:00-14:00 , the permission is in effect within any of them
+func getNotationSchedules(schedulesString string) ([]Schedule, *NotationError) {
+	var schedules []Schedule
+	offset := 0
+	for _, scheduleString := range strings.Split(schedulesString, constants.NotationScheduleSeparator) {
+		var schedule Schedule
+		seenParts := make(map[string]bool)
+		partOffset := offset
+		for _, part := range strings.Split(scheduleString, constants.NotationSchedulePartSeparator) {
+			currentOffset := partOffset
+			partOffset = partOffset + len(part) + len(constants.NotationSchedulePartSeparator)
+
+			partKey, partValue, hasSeparator := strings.Cut(part, "=")
+			if hasSeparator == false || seenParts[partKey] == true {
+				return nil, &NotationError{Err: ErrMalformedSchedule, Token: part, Offset: currentOffset, Suggestion: "schedules must be written as days=<days>;hours=<from>-<until>;tz=<time zone>, with each part at most once e.g days=mon-fri;hours=08:00-18:00;tz=Europe/Paris"}
+			}
+			seenParts[partKey] = true
+
+			switch partKey {
+			case "days":
+				days, err := parseScheduleDays(partValue)
+				if err != nil {
+					return nil, &NotationError{Err: ErrMalformedSchedule, Token: part, Offset: currentOffset, Suggestion: "days must be day names or ranges separated with ',' e.g days=mon-fri or days=mon,wed,fri"}
+				}
+				schedule.Days = days
+			case "hours":
+				fromString, untilString, hasRange := strings.Cut(partValue, "-")
+				from, fromErr := parseScheduleTimeOfDay(fromString)
+				until, untilErr := parseScheduleTimeOfDay(untilString)
+				if hasRange == false || fromErr != nil || untilErr != nil {
+					return nil, &NotationError{Err: ErrMalformedSchedule, Token: part, Offset: currentOffset, Suggestion: "hours must be written as HH:MM-HH:MM e.g hours=08:00-18:00 , use e.g hours=22:00-06:00 for windows that span midnight"}
+				}
+				schedule.From = from
+				schedule.Until = until
+			case "tz":
+				if _, err := loadLocation(partValue); err != nil || partValue == "" {
+					return nil, &NotationError{Err: ErrMalformedSchedule, Token: part, Offset: currentOffset, Suggestion: "tz must be an IANA time zone name e.g tz=Europe/Paris"}
+				}
+				schedule.Location = partValue
+			default:
+				suggestion := "schedule parts must be days=, hours= or tz="
+				if closestKey := closestMatch(partKey, []string{"days", "hours", "tz"}); closestKey != "" {
+					suggestion = fmt.Sprintf("did you mean '%s='", closestKey)
+				}
+				return nil, &NotationError{Err: ErrMalformedSchedule, Token: part, Offset: currentOffset, Suggestion: suggestion}
+			}
+		}
+		schedules = append(schedules, schedule)
+		offset = offset + len(scheduleString) + len(constants.NotationScheduleSeparator)
+	}
+	return schedules, nil
+}
+
+// parseScheduleDays parses day names and ranges separated with ',' e.g mon-fri,sun , ranges can wrap around the end of the week e.g fri-mon
+// The days are returned in week order from Monday, without duplicates
+func parseScheduleDays(daysString string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, item := range strings.Split(daysString, ",") {
+		firstDayName, lastDayName, isRange := strings.Cut(item, "-")
+		if isRange == false {
+			lastDayName = firstDayName
+		}
+		firstDay := slices.Index(scheduleDayNames, strings.ToLower(firstDayName))
+		lastDay := slices.Index(scheduleDayNames, strings.ToLower(lastDayName))
+		if firstDay == -1 || lastDay == -1 {
+			return nil, fmt.Errorf("invalid days '%s'", item)
+		}
+		for day := firstDay; ; day = (day + 1) % 7 {
+			if slices.Contains(days, time.Weekday(day)) == false {
+				days = append(days, time.Weekday(day))
+			}
+			if day == lastDay {
+				break
+			}
+		}
+	}
+	slices.SortFunc(days, func(a, b time.Weekday) int {
+		return mondayFirstDayIndex(a) - mondayFirstDayIndex(b)
+	})
+	return days, nil
+}
+
+// mondayFirstDayIndex returns the index of the day in a week that starts on Monday
+func mondayFirstDayIndex(day time.Weekday) int {
+	return (int(day) + 6) % 7
+}
+
+// parseScheduleTimeOfDay parses a time of day e.g 08:30 to a duration since midnight, 24:00 is the end of the day
+func parseScheduleTimeOfDay(timeOfDay string) (time.Duration, error) {
+	hoursString, minutesString, hasSeparator := strings.Cut(timeOfDay, ":")
+	if hasSeparator == false || len(hoursString) != 2 || len(minutesString) != 2 {
+		return 0, fmt.Errorf("invalid time of day '%s'", timeOfDay)
+	}
+	hours, hoursErr := strconv.Atoi(hoursString)
+	minutes, minutesErr := strconv.Atoi(minutesString)
+	if hoursErr != nil || minutesErr != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || hours == 24 && minutes != 0 {
+		return 0, fmt.Errorf("invalid time of day '%s'", timeOfDay)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// schedulesToNotation converts schedules back to the value of a schedule= section, parts that are the default are left out e.g hours for whole days from midnight
+// hours are kept for a whole day that doesn't start at midnight e.g hours=08:00-08:00 , since leaving them out would move the window to midnight
+func schedulesToNotation(schedules []Schedule) string {
+	scheduleStrings := make([]string, 0, len(schedules))
+	for _, schedule := range schedules {
+		var parts []string
+		if daysString := scheduleDaysToNotation(schedule.Days); daysString != "" {
+			parts = append(parts, "days="+daysString)
+		}
+		if schedule.From != 0 || schedule.Until != 0 {
+			parts = append(parts, "hours="+scheduleTimeOfDayToNotation(schedule.From)+"-"+scheduleTimeOfDayToNotation(schedule.Until))
+		}
+		if schedule.Location != "" {
+			parts = append(parts, "tz="+schedule.Location)
+		}
+		if len(parts) == 0 {
+			parts = append(parts, "days=mon-sun")
+		}
+		scheduleStrings = append(scheduleStrings, strings.Join(parts, constants.NotationSchedulePartSeparator))
+	}
+	return strings.Join(scheduleStrings, constants.NotationScheduleSeparator)
+}
+
+// scheduleDaysToNotation writes the days in week order from Monday, with consecutive days as ranges e.g mon-fri,sun , or an empty string for every day
+func scheduleDaysToNotation(days []time.Weekday) string {
+	isOpenOn := make([]bool, 7)
+	for _, day := range days {
+		isOpenOn[mondayFirstDayIndex(day)] = true
+	}
+	if len(days) == 0 || slices.Contains(isOpenOn, false) == false {
+		return ""
+	}
+
+	var items []string
+	for first := 0; first < 7; first++ {
+		if isOpenOn[first] == false {
+			continue
+		}
+		last := first
+		for last+1 < 7 && isOpenOn[last+1] == true {
+			last++
+		}
+		item := scheduleDayNames[(first+1)%7]
+		if last > first {
+			item = item + "-" + scheduleDayNames[(last+1)%7]
+		}
+		items = append(items, item)
+		first = last
+	}
+	return strings.Join(items, ",")
+}
+
+func scheduleTimeOfDayToNotation(timeOfDay time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(timeOfDay/time.Hour), int(timeOfDay%time.Hour/time.Minute))
+}
@@ -0,0 +1,180 @@
+package permitta
+
+import (
+	constants "github.com/limitlessdonald/permitta/constants"
+	"maps"
+	"slices"
+	"time"
+)
+
+// SlidingWindowBuckets is a ring of buckets that counts usage within a trailing window accurately.
+// The window is divided into constants.SlidingWindowBucketCount buckets, every operation is added to the bucket of its operation time,
+// and the usage within the trailing window is the sum of the buckets that are still within the window.
+// The usage is counted per bucket, so it can include operations that are at most one BucketSize older than the window, it never excludes operations within the window
+type SlidingWindowBuckets struct {
+	BucketSize time.Duration `json:"bucketSize"`
+	Head       int64         `json:"head"` // the number of the most recent bucket, counted in BucketSize from the unix epoch
+	Buckets    []uint        `json:"buckets"`
+}
+
+// slidingWindowDurations are the windows of the duration based limits, keyed by their notation limit key
+var slidingWindowDurations = map[string]time.Duration{
+	constants.NotationOperationMinuteLimitKey:    time.Minute,
+	constants.NotationOperationHourLimitKey:      time.Hour,
+	constants.NotationOperationDayLimitKey:       constants.TimeDurationDay,
+	constants.NotationOperationWeekLimitKey:      constants.TimeDurationWeek,
+	constants.NotationOperationFortnightLimitKey: constants.TimeDurationFortnight,
+	constants.NotationOperationMonthLimitKey:     constants.TimeDurationMonth,
+	constants.NotationOperationQuarterLimitKey:   constants.TimeDurationQuarter,
+	constants.NotationOperationYearLimitKey:      constants.TimeDurationYear,
+}
+
+// EnableSlidingWindows turns on the accurate sliding window mode for all the operation usages, including the usages of registered operations that are added later, see OperationUsage.EnableSlidingWindows
+func (permissionUsage *PermissionUsage) EnableSlidingWindows() {
+	permissionUsage.SlidingWindow = true
+	permissionUsage.CreateOperationUsages.EnableSlidingWindows()
+	permissionUsage.ReadOperationUsages.EnableSlidingWindows()
+	permissionUsage.UpdateOperationUsages.EnableSlidingWindows()
+	permissionUsage.DeleteOperationUsages.EnableSlidingWindows()
+	permissionUsage.ExecuteOperationUsages.EnableSlidingWindows()
+	for operation, operationUsage := range permissionUsage.OperationUsages {
+		operationUsage.EnableSlidingWindows()
+		setOperationUsage(operation, permissionUsage, operationUsage)
+	}
+}
+
+// EnableSlidingWindows turns on the accurate sliding window mode for the operation usage.
+// By default, a duration usage like WithinTheLastHour is only reset when the time since LastTime is more than the duration, so an operation every 59 minutes keeps adding to WithinTheLastHour forever.
+// In sliding window mode, UpdateUsage also records every operation in SlidingWindowBuckets, and the WithinTheLast... usages are computed from the buckets, so they hold exactly what happened within the trailing window
+// The WithinTheLast... usages are still set, so they can be read just like before
+func (operationUsage *OperationUsage) EnableSlidingWindows() {
+	operationUsage.SlidingWindow = true
+}
+
+func newSlidingWindowBuckets(window time.Duration) SlidingWindowBuckets {
+	bucketSize := window / constants.SlidingWindowBucketCount
+	if bucketSize < 1 {
+		bucketSize = 1
+	}
+	// one extra bucket for the bucket that is partly outside the window
+	return SlidingWindowBuckets{BucketSize: bucketSize, Buckets: make([]uint, constants.SlidingWindowBucketCount+1)}
+}
+
+// add adds the quantity to the bucket of the operation time, and returns the updated buckets, the buckets of the caller are not modified
+func (slidingWindowBuckets SlidingWindowBuckets) add(operationTime time.Time, quantity uint) SlidingWindowBuckets {
+	slidingWindowBuckets.Buckets = slices.Clone(slidingWindowBuckets.Buckets)
+	bucketCount := int64(len(slidingWindowBuckets.Buckets))
+	if bucketCount == 0 || slidingWindowBuckets.BucketSize < 1 {
+		return slidingWindowBuckets
+	}
+	bucket := operationTime.UnixNano() / int64(slidingWindowBuckets.BucketSize)
+
+	// if we moved to a new bucket, clear the buckets that were skipped, since they are now outside the window
+	if bucket > slidingWindowBuckets.Head {
+		for i := slidingWindowBuckets.Head + 1; i <= bucket && i <= slidingWindowBuckets.Head+bucketCount; i++ {
+			slidingWindowBuckets.Buckets[ringIndex(i, bucketCount)] = 0
+		}
+		slidingWindowBuckets.Head = bucket
+	}
+
+	// the operation is too old to be within the window
+	if bucket <= slidingWindowBuckets.Head-bucketCount {
+		return slidingWindowBuckets
+	}
+
+	slidingWindowBuckets.Buckets[ringIndex(bucket, bucketCount)] = slidingWindowBuckets.Buckets[ringIndex(bucket, bucketCount)] + quantity
+	return slidingWindowBuckets
+}
+
+// subtract takes the quantity back out of the bucket of the operation time, and returns the updated buckets, the buckets of the caller are not modified
+// Nothing is taken out if the bucket has already left the ring, since its usage is no longer within the window
+func (slidingWindowBuckets SlidingWindowBuckets) subtract(operationTime time.Time, quantity uint) SlidingWindowBuckets {
+	slidingWindowBuckets.Buckets = slices.Clone(slidingWindowBuckets.Buckets)
+	bucketCount := int64(len(slidingWindowBuckets.Buckets))
+	if bucketCount == 0 || slidingWindowBuckets.BucketSize < 1 {
+		return slidingWindowBuckets
+	}
+	bucket := operationTime.UnixNano() / int64(slidingWindowBuckets.BucketSize)
+	if bucket > slidingWindowBuckets.Head || bucket <= slidingWindowBuckets.Head-bucketCount {
+		return slidingWindowBuckets
+	}
+
+	index := ringIndex(bucket, bucketCount)
+	slidingWindowBuckets.Buckets[index] = remainingWithin(slidingWindowBuckets.Buckets[index], quantity)
+	return slidingWindowBuckets
+}
+
+// sum returns the usage within the trailing window as at now
+func (slidingWindowBuckets SlidingWindowBuckets) sum(now time.Time) uint {
+	bucketCount := int64(len(slidingWindowBuckets.Buckets))
+	if bucketCount == 0 || slidingWindowBuckets.BucketSize < 1 {
+		return 0
+	}
+	currentBucket := now.UnixNano() / int64(slidingWindowBuckets.BucketSize)
+
+	var total uint
+	for i := max(currentBucket, slidingWindowBuckets.Head) - bucketCount + 1; i <= min(currentBucket, slidingWindowBuckets.Head); i++ {
+		total = total + slidingWindowBuckets.Buckets[ringIndex(i, bucketCount)]
+	}
+	return total
+}
+
+func ringIndex(bucket int64, bucketCount int64) int64 {
+	index := bucket % bucketCount
+	if index < 0 {
+		index = index + bucketCount
+	}
+	return index
+}
+
+// updateSlidingWindows records the operation in the sliding window buckets of every duration based limit and custom duration that is tracked, then sets the WithinTheLast... usages from the buckets
+func (operationUsage *OperationUsage) updateSlidingWindows(customDurationLimits []CustomDurationLimit, operationQuantity uint, operationTime time.Time) {
+	updatedBuckets := make(map[string]SlidingWindowBuckets)
+	windows := maps.Clone(slidingWindowDurations)
+	for key := range operationUsage.WithinTheLastCustomDurations {
+		if every, err := time.ParseDuration(key); err == nil {
+			windows[key] = every
+		}
+	}
+	for _, customDurationLimit := range customDurationLimits {
+		windows[customDurationLimit.Key()] = customDurationLimit.Every
+	}
+
+	for key, window := range windows {
+		buckets, isBucketsFound := operationUsage.SlidingWindowBuckets[key]
+		if isBucketsFound == false {
+			buckets = newSlidingWindowBuckets(window)
+		}
+		updatedBuckets[key] = buckets.add(operationTime, operationQuantity)
+	}
+
+	operationUsage.SlidingWindowBuckets = updatedBuckets
+	operationUsage.applySlidingWindows(operationTime)
+}
+
+// applySlidingWindows sets the WithinTheLast... usages to the usage within each trailing window as at now, it does nothing if there are no buckets yet
+func (operationUsage *OperationUsage) applySlidingWindows(now time.Time) {
+	if len(operationUsage.SlidingWindowBuckets) == 0 {
+		return
+	}
+
+	usageWithin := func(key string) uint {
+		return operationUsage.SlidingWindowBuckets[key].sum(now)
+	}
+	operationUsage.WithinTheLastMinute = usageWithin(constants.NotationOperationMinuteLimitKey)
+	operationUsage.WithinTheLastHour = usageWithin(constants.NotationOperationHourLimitKey)
+	operationUsage.WithinTheLastDay = usageWithin(constants.NotationOperationDayLimitKey)
+	operationUsage.WithinTheLastWeek = usageWithin(constants.NotationOperationWeekLimitKey)
+	operationUsage.WithinTheLastFortnight = usageWithin(constants.NotationOperationFortnightLimitKey)
+	operationUsage.WithinTheLastMonth = usageWithin(constants.NotationOperationMonthLimitKey)
+	operationUsage.WithinTheLastQuarter = usageWithin(constants.NotationOperationQuarterLimitKey)
+	operationUsage.WithinTheLastYear = usageWithin(constants.NotationOperationYearLimitKey)
+
+	if operationUsage.WithinTheLastCustomDurations != nil {
+		customDurationUsages := make(CustomDurationUsages)
+		for key := range operationUsage.WithinTheLastCustomDurations {
+			customDurationUsages[key] = usageWithin(key)
+		}
+		operationUsage.WithinTheLastCustomDurations = customDurationUsages
+	}
+}
@@ -0,0 +1,145 @@
+package permitta
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sqlTableNameRegex is used to validate table names, since they can't be passed as query arguments
+var sqlTableNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLUsageStore is a UsageStore that keeps usage in a database/sql table, it works with any driver, and it's safe to share the table between multiple instances of an app
+// There is one row per entity type, entity ID and resource, with the usage stored as json, and a version column that is used for CompareAndSwap, so concurrent updates don't lose increments
+type SQLUsageStore struct {
+	db          *sql.DB
+	table       string
+	placeholder string
+}
+
+// NewSQLUsageStore returns a SQLUsageStore that keeps usage in table, creating the table if it doesn't exist. constants.DefaultSQLUsageTableName is used if table is empty
+// placeholder is the query argument placeholder of the driver, either constants.SQLPlaceholderQuestionMark e.g for MySQL and SQLite or constants.SQLPlaceholderDollar e.g for PostgreSQL
+func NewSQLUsageStore(db *sql.DB, table string, placeholder string) (*SQLUsageStore, error) {
+	if table == "" {
+		table = constants.DefaultSQLUsageTableName
+	}
+	if sqlTableNameRegex.MatchString(table) == false {
+		return nil, fmt.Errorf("invalid table name '%s', it can only contain letters, digits and underscores", table)
+	}
+	if placeholder != constants.SQLPlaceholderQuestionMark && placeholder != constants.SQLPlaceholderDollar {
+		return nil, fmt.Errorf("invalid placeholder '%s', it must be '%s' or '%s'", placeholder, constants.SQLPlaceholderQuestionMark, constants.SQLPlaceholderDollar)
+	}
+
+	sqlUsageStore := &SQLUsageStore{db: db, table: table, placeholder: placeholder}
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + table + " (" +
+		"entity_type VARCHAR(255) NOT NULL, " +
+		"entity_id VARCHAR(255) NOT NULL, " +
+		"resource VARCHAR(255) NOT NULL, " +
+		"version BIGINT NOT NULL, " +
+		"usage_data TEXT NOT NULL, " +
+		"PRIMARY KEY (entity_type, entity_id, resource))")
+	if err != nil {
+		return nil, err
+	}
+
+	return sqlUsageStore, nil
+}
+
+// query replaces every ? in query with the placeholder of the driver
+func (sqlUsageStore *SQLUsageStore) query(query string) string {
+	if sqlUsageStore.placeholder == constants.SQLPlaceholderQuestionMark {
+		return query
+	}
+
+	var builder strings.Builder
+	argumentNumber := 0
+	for _, character := range query {
+		if character == '?' {
+			argumentNumber++
+			builder.WriteString(sqlUsageStore.placeholder + strconv.Itoa(argumentNumber))
+			continue
+		}
+		builder.WriteRune(character)
+	}
+	return builder.String()
+}
+
+func (sqlUsageStore *SQLUsageStore) Get(key UsageKey) (PermissionUsage, uint64, error) {
+	var version uint64
+	var usageData string
+	err := sqlUsageStore.db.QueryRow(
+		sqlUsageStore.query("SELECT version, usage_data FROM "+sqlUsageStore.table+" WHERE entity_type = ? AND entity_id = ? AND resource = ?"),
+		key.EntityType, key.EntityID, key.Resource,
+	).Scan(&version, &usageData)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PermissionUsage{}, 0, nil
+	}
+	if err != nil {
+		return PermissionUsage{}, 0, err
+	}
+
+	var usage PermissionUsage
+	if err := json.Unmarshal([]byte(usageData), &usage); err != nil {
+		return PermissionUsage{}, 0, fmt.Errorf("invalid usage for %s : %w", key, err)
+	}
+	return usage, version, nil
+}
+
+// Put saves the usage whatever its current version is
+// The row is saved with CompareAndSwap, so if it keeps being changed by someone else, ErrUsageConflict is returned after constants.DefaultUsageStoreMaxRetries retries
+func (sqlUsageStore *SQLUsageStore) Put(key UsageKey, usage PermissionUsage) error {
+	for attempt := 0; attempt <= constants.DefaultUsageStoreMaxRetries; attempt++ {
+		_, version, err := sqlUsageStore.Get(key)
+		if err != nil {
+			return err
+		}
+		isSaved, err := sqlUsageStore.CompareAndSwap(key, version, usage)
+		if err != nil || isSaved {
+			return err
+		}
+	}
+
+	return ErrUsageConflict
+}
+
+// CompareAndSwap inserts the row if version is 0, else it updates the row only if its version is still version
+func (sqlUsageStore *SQLUsageStore) CompareAndSwap(key UsageKey, version uint64, usage PermissionUsage) (bool, error) {
+	usageData, err := json.Marshal(usage)
+	if err != nil {
+		return false, err
+	}
+
+	if version == 0 {
+		_, err := sqlUsageStore.db.Exec(
+			sqlUsageStore.query("INSERT INTO "+sqlUsageStore.table+" (entity_type, entity_id, resource, version, usage_data) VALUES (?, ?, ?, ?, ?)"),
+			key.EntityType, key.EntityID, key.Resource, 1, string(usageData),
+		)
+		if err == nil {
+			return true, nil
+		}
+		// drivers report duplicate keys differently, so if the row exists now, someone else inserted it first
+		_, currentVersion, getErr := sqlUsageStore.Get(key)
+		if getErr == nil && currentVersion != 0 {
+			return false, nil
+		}
+		return false, err
+	}
+
+	result, err := sqlUsageStore.db.Exec(
+		sqlUsageStore.query("UPDATE "+sqlUsageStore.table+" SET version = ?, usage_data = ? WHERE entity_type = ? AND entity_id = ? AND resource = ? AND version = ?"),
+		version+1, string(usageData), key.EntityType, key.EntityID, key.Resource, version,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
@@ -0,0 +1,335 @@
+package permitta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// UsageKey identifies the usage of an entity, e.g the usage of the user with ID 42 is UsageKey{EntityType: constants.EntityUser, EntityID: "42"}
+// Resource is optional, it's used to keep separate usages for the same entity e.g one for "files" and another for "videos"
+type UsageKey struct {
+	EntityType string `json:"entityType"`
+	EntityID   string `json:"entityId"`
+	Resource   string `json:"resource,omitempty"`
+}
+
+// String returns the key as <entityType>:<entityID>:<resource> e.g user:42:files
+func (usageKey UsageKey) String() string {
+	return usageKey.EntityType + ":" + usageKey.EntityID + ":" + usageKey.Resource
+}
+
+// UsageStore loads and saves the PermissionUsage of entities, so permitta can check and update usage with just the IDs of the entities, see Engine
+// Every saved usage has a version, which increases every time it's saved. A usage that has never been saved has version 0, and Get returns an empty PermissionUsage for it
+//
+// CompareAndSwap saves the usage only if its version is still the version that was loaded, so concurrent updates of the same usage don't overwrite each other,
+// it reports false, without an error, if the usage was saved by someone else in between
+type UsageStore interface {
+	Get(key UsageKey) (PermissionUsage, uint64, error)
+	Put(key UsageKey, usage PermissionUsage) error
+	CompareAndSwap(key UsageKey, version uint64, usage PermissionUsage) (bool, error)
+}
+
+// ErrUsageStoreClosed is returned when a closed usage store is used
+var ErrUsageStoreClosed = errors.New("usage store is closed")
+
+type versionedUsage struct {
+	usage   PermissionUsage
+	version uint64
+}
+
+// MemoryUsageStore is a UsageStore that keeps usage in memory, it's safe for concurrent use
+// Usage is lost when the program exits, so it's mostly useful for tests and single instance apps that don't need to keep usage
+type MemoryUsageStore struct {
+	mutex  sync.Mutex
+	usages map[UsageKey]versionedUsage
+}
+
+// NewMemoryUsageStore returns an empty MemoryUsageStore
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{usages: make(map[UsageKey]versionedUsage)}
+}
+
+func (memoryUsageStore *MemoryUsageStore) Get(key UsageKey) (PermissionUsage, uint64, error) {
+	memoryUsageStore.mutex.Lock()
+	defer memoryUsageStore.mutex.Unlock()
+
+	storedUsage := memoryUsageStore.usages[key]
+	return storedUsage.usage, storedUsage.version, nil
+}
+
+func (memoryUsageStore *MemoryUsageStore) Put(key UsageKey, usage PermissionUsage) error {
+	memoryUsageStore.mutex.Lock()
+	defer memoryUsageStore.mutex.Unlock()
+
+	memoryUsageStore.set(key, memoryUsageStore.usages[key].version+1, usage)
+	return nil
+}
+
+func (memoryUsageStore *MemoryUsageStore) CompareAndSwap(key UsageKey, version uint64, usage PermissionUsage) (bool, error) {
+	memoryUsageStore.mutex.Lock()
+	defer memoryUsageStore.mutex.Unlock()
+
+	if memoryUsageStore.usages[key].version != version {
+		return false, nil
+	}
+	memoryUsageStore.set(key, version+1, usage)
+	return true, nil
+}
+
+// set saves the usage with the version, the caller must hold the mutex
+func (memoryUsageStore *MemoryUsageStore) set(key UsageKey, version uint64, usage PermissionUsage) {
+	memoryUsageStore.usages[key] = versionedUsage{usage: usage, version: version}
+}
+
+// fileUsageRecord is a line in the file of a FileUsageStore
+type fileUsageRecord struct {
+	UsageKey
+	Version uint64          `json:"version"`
+	Usage   PermissionUsage `json:"usage"`
+}
+
+// FileUsageStore is a UsageStore that appends every saved usage to a JSON lines file, one usage per line, and keeps the latest usages in memory
+// When the file is opened, the lines are replayed, so the latest version of every usage wins. It's safe for concurrent use within a program,
+// but the file must not be shared by multiple programs at the same time
+//
+// Since every save adds a line, the file is compacted to the latest version of every usage when it has at least constants.FileUsageStoreCompactionThreshold lines, and more than twice as many lines as usages, see Compact
+type FileUsageStore struct {
+	mutex       sync.Mutex
+	path        string
+	file        *os.File
+	memory      *MemoryUsageStore
+	recordCount int // the number of usages in the file, including old versions, which are removed by Compact
+}
+
+// OpenFileUsageStore opens the JSON lines file at path, creating it if it doesn't exist, and loads the usages in it
+// If the program crashed while a usage was written, the last line can be incomplete, it's removed from the file, since the usage was never saved. An invalid line anywhere else is an error, since the file is corrupted
+func OpenFileUsageStore(path string) (*FileUsageStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	fileUsageStore := &FileUsageStore{path: path, file: file, memory: NewMemoryUsageStore()}
+	if err := fileUsageStore.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fileUsageStore, nil
+}
+
+// load replays the lines of the file into memory, and removes an incomplete last line
+func (fileUsageStore *FileUsageStore) load() error {
+	reader := bufio.NewReader(fileUsageStore.file)
+	var offset int64
+	var invalidLineOffset int64 = -1
+	var invalidLineErr error
+	isLastLineEnded := true
+	lineNumber := 0
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if len(line) > 0 {
+			lineNumber++
+			isLastLineEnded = line[len(line)-1] == '\n'
+		}
+		if trimmedLine := bytes.TrimSpace(line); len(trimmedLine) > 0 {
+			// only the last line can be incomplete, so an invalid line followed by another line is corruption
+			if invalidLineErr != nil {
+				return invalidLineErr
+			}
+			var record fileUsageRecord
+			if err := json.Unmarshal(trimmedLine, &record); err != nil {
+				invalidLineOffset = offset
+				invalidLineErr = fmt.Errorf("invalid usage on line %d of %s : %w", lineNumber, fileUsageStore.path, err)
+			} else {
+				fileUsageStore.recordCount++
+				if record.Version >= fileUsageStore.memory.usages[record.UsageKey].version {
+					fileUsageStore.memory.set(record.UsageKey, record.Version, record.Usage)
+				}
+			}
+		}
+		offset += int64(len(line))
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if invalidLineErr != nil {
+		logUsageStoreError("removed the incomplete last line of the usage file", invalidLineErr)
+		if err := fileUsageStore.file.Truncate(invalidLineOffset); err != nil {
+			return err
+		}
+	} else if isLastLineEnded == false {
+		// the last usage was written without its line ending, it's added, so the next usage starts on a new line
+		if _, err := fileUsageStore.file.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	if fileUsageStore.shouldCompact() {
+		return fileUsageStore.compact()
+	}
+	return nil
+}
+
+func (fileUsageStore *FileUsageStore) Get(key UsageKey) (PermissionUsage, uint64, error) {
+	fileUsageStore.mutex.Lock()
+	defer fileUsageStore.mutex.Unlock()
+
+	if fileUsageStore.file == nil {
+		return PermissionUsage{}, 0, ErrUsageStoreClosed
+	}
+	return fileUsageStore.memory.Get(key)
+}
+
+func (fileUsageStore *FileUsageStore) Put(key UsageKey, usage PermissionUsage) error {
+	fileUsageStore.mutex.Lock()
+	defer fileUsageStore.mutex.Unlock()
+
+	_, version, err := fileUsageStore.memory.Get(key)
+	if err != nil {
+		return err
+	}
+	return fileUsageStore.append(key, version+1, usage)
+}
+
+func (fileUsageStore *FileUsageStore) CompareAndSwap(key UsageKey, version uint64, usage PermissionUsage) (bool, error) {
+	fileUsageStore.mutex.Lock()
+	defer fileUsageStore.mutex.Unlock()
+
+	_, currentVersion, err := fileUsageStore.memory.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if currentVersion != version {
+		return false, nil
+	}
+	if err := fileUsageStore.append(key, version+1, usage); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// append writes the usage to the end of the file, then keeps it in memory, the caller must hold the mutex
+// The usage is kept in memory only if it was written, so the file and memory never disagree
+func (fileUsageStore *FileUsageStore) append(key UsageKey, version uint64, usage PermissionUsage) error {
+	if fileUsageStore.file == nil {
+		return ErrUsageStoreClosed
+	}
+
+	line, err := json.Marshal(fileUsageRecord{UsageKey: key, Version: version, Usage: usage})
+	if err != nil {
+		return err
+	}
+	if _, err := fileUsageStore.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	fileUsageStore.recordCount++
+
+	fileUsageStore.memory.mutex.Lock()
+	fileUsageStore.memory.set(key, version, usage)
+	fileUsageStore.memory.mutex.Unlock()
+
+	// the usage is already saved, so if compacting fails, the file is just left as it is until the next time
+	if fileUsageStore.shouldCompact() {
+		if err := fileUsageStore.compact(); err != nil {
+			logUsageStoreError("couldn't compact the usage file", err)
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the file with only the latest version of every usage, it's done automatically, see FileUsageStore
+func (fileUsageStore *FileUsageStore) Compact() error {
+	fileUsageStore.mutex.Lock()
+	defer fileUsageStore.mutex.Unlock()
+
+	if fileUsageStore.file == nil {
+		return ErrUsageStoreClosed
+	}
+	return fileUsageStore.compact()
+}
+
+// shouldCompact reports if the file has enough old versions of usages to be compacted, the caller must hold the mutex
+func (fileUsageStore *FileUsageStore) shouldCompact() bool {
+	return fileUsageStore.recordCount >= constants.FileUsageStoreCompactionThreshold && fileUsageStore.recordCount > 2*len(fileUsageStore.memory.usages)
+}
+
+// compact writes the latest version of every usage to a temporary file next to the file, then replaces the file with it, so the file is never left half written, the caller must hold the mutex
+func (fileUsageStore *FileUsageStore) compact() error {
+	compactedFile, err := os.CreateTemp(filepath.Dir(fileUsageStore.path), filepath.Base(fileUsageStore.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// the temporary file is removed if anything fails before it replaces the file
+	isReplaced := false
+	defer func() {
+		if isReplaced == false {
+			compactedFile.Close()
+			os.Remove(compactedFile.Name())
+		}
+	}()
+
+	fileUsageStore.memory.mutex.Lock()
+	usageKeys := slices.SortedFunc(maps.Keys(fileUsageStore.memory.usages), func(a UsageKey, b UsageKey) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	writer := bufio.NewWriter(compactedFile)
+	for _, key := range usageKeys {
+		storedUsage := fileUsageStore.memory.usages[key]
+		line, err := json.Marshal(fileUsageRecord{UsageKey: key, Version: storedUsage.version, Usage: storedUsage.usage})
+		if err != nil {
+			fileUsageStore.memory.mutex.Unlock()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	fileUsageStore.memory.mutex.Unlock()
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := compactedFile.Sync(); err != nil {
+		return err
+	}
+	if err := compactedFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(compactedFile.Name(), fileUsageStore.path); err != nil {
+		return err
+	}
+	isReplaced = true
+
+	// the old file was replaced, so it's closed whether the new one can be opened or not, and the store is closed if it can't
+	fileUsageStore.file.Close()
+	fileUsageStore.file, err = os.OpenFile(fileUsageStore.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		fileUsageStore.file = nil
+		return err
+	}
+	fileUsageStore.recordCount = len(usageKeys)
+	return nil
+}
+
+// Close closes the file, the store can't be used after it's closed
+func (fileUsageStore *FileUsageStore) Close() error {
+	fileUsageStore.mutex.Lock()
+	defer fileUsageStore.mutex.Unlock()
+
+	if fileUsageStore.file == nil {
+		return nil
+	}
+	err := fileUsageStore.file.Close()
+	fileUsageStore.file = nil
+	return err
+}
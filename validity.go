@@ -0,0 +1,75 @@
+package permitta
+
+import (
+	"errors"
+	constants "github.com/limitlessdonald/permitta/constants"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxUnixSecondsDigits is the number of digits above which a unix timestamp without a unit is read as milliseconds, 11 digits of seconds is beyond the year 5000, while timestamps in milliseconds have had 13 digits since 2001
+const maxUnixSecondsDigits = 11
+
+// checkValidity checks that the permission is in effect at the time now, which means now is not before its StartTime, not after its EndTime, and within one of its Schedules
+// It's used by every check, so a permission is in effect at exactly the same times whether usage is checked or not
+func checkValidity(permission Permission, now time.Time) Decision {
+	// we are attempting to get permission for something before the time its permitted
+	if permission.StartTime.IsZero() == false && now.Before(permission.StartTime) {
+		return deniedDecision("", constants.ReasonNotStarted)
+	}
+
+	// in the same vein if the permission has expired, this means if now is after EndTime
+	if permission.EndTime.IsZero() == false && now.After(permission.EndTime) {
+		return deniedDecision("", constants.ReasonExpired)
+	}
+
+	// the permission is only in effect within its schedules e.g from Monday to Friday, 08:00 to 18:00 , if it's outside all of them, the decision says when the next one opens
+	isWithinSchedule, nextOpen, scheduleErr := checkSchedules(permission.Schedules, now)
+	if scheduleErr != nil {
+		return deniedDecision("", constants.ReasonInvalidSchedule)
+	}
+	if isWithinSchedule == false {
+		// copied within the branch, so only denials outside the schedules allocate it
+		nextOpenTime := nextOpen
+		return Decision{Reason: constants.ReasonOutsideSchedule, NextOpen: &nextOpenTime}
+	}
+
+	return Decision{Allowed: true}
+}
+
+// parseNotationTime parses the value of a start= or end= section, which is a unix timestamp with a unit e.g 1735693200000ms or 1735693200s , or an RFC 3339 timestamp e.g 2025-01-01T01:00:00Z
+// Unix timestamps without a unit are read as milliseconds if they have more than 11 digits, else as seconds. The time is returned in UTC, whatever form it's written in
+func parseNotationTime(value string) (time.Time, error) {
+	digits, unit := value, ""
+	if strings.HasSuffix(value, "ms") {
+		digits, unit = strings.TrimSuffix(value, "ms"), "ms"
+	} else if strings.HasSuffix(value, "s") {
+		digits, unit = strings.TrimSuffix(value, "s"), "s"
+	}
+
+	if digits != "" && strings.Trim(digits, "0123456789") == "" {
+		timestamp, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if unit == "ms" || unit == "" && len(digits) > maxUnixSecondsDigits {
+			return time.UnixMilli(timestamp).UTC(), nil
+		}
+		return time.Unix(timestamp, 0).UTC(), nil
+	}
+	if unit != "" {
+		return time.Time{}, errors.New("invalid unix timestamp")
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+// timeToNotation writes a start or end time as an RFC 3339 timestamp in UTC, which can't be mistaken for a timestamp in another unit
+func timeToNotation(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}